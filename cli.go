@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cjimti/iotwifi/client"
+	"github.com/cjimti/iotwifi/iotwifi"
+)
+
+// cliUsage describes the cli subcommands.
+const cliUsage = `Usage: iotwifi <command> [flags]
+
+Commands:
+  serve      run the wifi manager and API (default)
+  status     show the station status
+  scan       scan for wifi networks, or probe for one with -ssid
+  connect    connect to a wifi network (-ssid, -psk, -hidden, -sae)
+  networks   list networks saved in wpa_supplicant
+  clients    list clients associated with the AP
+  ap         show the AP status
+
+Flags:
+`
+
+// cli talks to a running daemon.
+type cli struct {
+	client *client.Client
+	json   bool
+	out    io.Writer
+}
+
+// runCli runs a cli subcommand and returns the process exit code.
+func runCli(command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	socket := flags.String("socket", getEnv("IOTWIFI_SOCKET", "/var/run/iotwifi.sock"), "daemon unix socket")
+	url := flags.String("url", "", "daemon url, e.g. http://192.168.27.1:8080, used instead of the socket")
+	jsonOut := flags.Bool("json", false, "print the JSON payload instead of a table")
+	ssid := flags.String("ssid", "", "network ssid (scan, connect)")
+	psk := flags.String("psk", "", "network passphrase, - reads it from stdin (connect)")
+	hidden := flags.Bool("hidden", false, "the network does not broadcast its ssid (connect)")
+	sae := flags.Bool("sae", false, "the network is WPA3-Personal (connect)")
+
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, cliUsage)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	c := newCli(*socket, *url)
+	c.json = *jsonOut
+
+	var err error
+	switch command {
+	case "status":
+		err = c.status()
+	case "scan":
+		err = c.scan(*ssid)
+	case "connect":
+		err = c.connect(iotwifi.WpaCredentials{Ssid: *ssid, Psk: *psk, Hidden: *hidden, Sae: *sae})
+	case "networks":
+		err = c.networks()
+	case "clients":
+		err = c.clients()
+	case "ap":
+		err = c.ap()
+	case "help", "-h", "-help", "--help":
+		flags.Usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// newCli produces a cli using the url when set, otherwise the unix
+// socket when it exists and the local http port as a last resort.
+func newCli(socket string, url string) *cli {
+	c := &cli{
+		out: os.Stdout,
+	}
+
+	switch _, err := os.Stat(socket); {
+	case url != "":
+		c.client = client.New(url)
+	case err == nil:
+		c.client = client.NewUnix(socket)
+	default:
+		c.client = client.New("http://localhost:" + getEnv("IOTWIFI_PORT", "8080"))
+	}
+
+	if c.client.HttpClient == nil {
+		c.client.HttpClient = &http.Client{}
+	}
+	c.client.HttpClient.Timeout = 60 * time.Second
+
+	return c
+}
+
+// printJson prints v as indented JSON when the cli is in JSON mode and
+// reports whether it did.
+func (c *cli) printJson(v interface{}) bool {
+	if !c.json {
+		return false
+	}
+
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintln(c.out, string(data))
+
+	return true
+}
+
+// table returns a tab aligned writer on the cli output.
+func (c *cli) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+}
+
+// status prints the station status.
+func (c *cli) status() error {
+	status, err := c.client.Status(context.Background())
+	if err != nil || c.printJson(status) {
+		return err
+	}
+
+	t := c.table()
+	fmt.Fprintf(t, "State\t%s\n", status.State)
+	fmt.Fprintf(t, "SSID\t%s\n", status.Ssid)
+	fmt.Fprintf(t, "BSSID\t%s\n", status.Bssid)
+	fmt.Fprintf(t, "Frequency\t%d MHz (channel %d)\n", status.Frequency, status.Channel)
+	fmt.Fprintf(t, "Key management\t%s\n", status.KeyMgmt)
+	fmt.Fprintf(t, "Link speed\t%d Mbps\n", status.LinkSpeed)
+	fmt.Fprintf(t, "IPv4\t%s\n", strings.Join(status.Ipv4, ", "))
+	fmt.Fprintf(t, "IPv6\t%s\n", strings.Join(status.Ipv6, ", "))
+	fmt.Fprintf(t, "Gateway\t%s\n", status.Gateway)
+	fmt.Fprintf(t, "DNS\t%s\n", strings.Join(status.Dns, ", "))
+	fmt.Fprintf(t, "Connectivity\t%s (%d ms)\n", status.Connectivity.State, status.Connectivity.LatencyMs)
+
+	return t.Flush()
+}
+
+// scan prints visible networks, strongest first. With an ssid only
+// networks answering a probe for it are printed.
+func (c *cli) scan(ssid string) error {
+	var networks map[string]iotwifi.WpaNetwork
+	var err error
+	if ssid != "" {
+		networks, err = c.client.ScanSsid(context.Background(), ssid)
+	} else {
+		networks, err = c.client.Scan(context.Background())
+	}
+	if err != nil || c.printJson(networks) {
+		return err
+	}
+
+	sorted := make([]iotwifi.WpaNetwork, 0, len(networks))
+	for _, network := range networks {
+		sorted = append(sorted, network)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		si, _ := strconv.Atoi(sorted[i].SignalLevel)
+		sj, _ := strconv.Atoi(sorted[j].SignalLevel)
+		return si > sj
+	})
+
+	t := c.table()
+	fmt.Fprintln(t, "SSID\tBSSID\tFREQUENCY\tSIGNAL\tFLAGS")
+	for _, network := range sorted {
+		ssid := network.Ssid
+		if network.Hidden {
+			ssid = "(hidden)"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n", ssid, network.Bssid, network.Frequency, network.SignalLevel, network.Flags)
+	}
+
+	return t.Flush()
+}
+
+// connect connects the station to a network.
+func (c *cli) connect(creds iotwifi.WpaCredentials) error {
+	if creds.Ssid == "" {
+		return errors.New("connect requires -ssid")
+	}
+
+	if creds.Psk == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		creds.Psk = strings.TrimRight(line, "\r\n")
+	}
+
+	connection, err := c.client.Connect(context.Background(), creds)
+	if err != nil || c.printJson(connection) {
+		return err
+	}
+
+	t := c.table()
+	fmt.Fprintln(t, "SSID\tSTATE\tMESSAGE")
+	fmt.Fprintf(t, "%s\t%s\t%s\n", connection.Ssid, connection.State, connection.Message)
+
+	return t.Flush()
+}
+
+// networks prints the networks saved in wpa_supplicant.
+func (c *cli) networks() error {
+	networks, err := c.client.Networks(context.Background())
+	if err != nil || c.printJson(networks) {
+		return err
+	}
+
+	t := c.table()
+	fmt.Fprintln(t, "ID\tSSID\tBSSID\tFLAGS")
+	for _, network := range networks {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", network.Id, network.Ssid, network.Bssid, network.Flags)
+	}
+
+	return t.Flush()
+}
+
+// clients prints the clients associated with the AP.
+func (c *cli) clients() error {
+	clients, err := c.client.Clients(context.Background())
+	if err != nil || c.printJson(clients) {
+		return err
+	}
+
+	t := c.table()
+	fmt.Fprintln(t, "MAC\tIP\tHOSTNAME\tSIGNAL\tCONNECTED")
+	for _, client := range clients {
+		connected := time.Duration(client.ConnectedSeconds) * time.Second
+		fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%s\n", client.Mac, client.Ip, client.Hostname, client.Signal, connected)
+	}
+
+	return t.Flush()
+}
+
+// ap prints the AP status.
+func (c *cli) ap() error {
+	status, err := c.client.Ap(context.Background())
+	if err != nil || c.printJson(status) {
+		return err
+	}
+
+	t := c.table()
+	fmt.Fprintf(t, "Up\t%t\n", status.Up)
+	fmt.Fprintf(t, "Interface\t%s\n", status.Interface)
+	fmt.Fprintf(t, "SSID\t%s\n", status.Ssid)
+	fmt.Fprintf(t, "Channel\t%s\n", status.Channel)
+	fmt.Fprintf(t, "IP\t%s\n", status.Ip)
+	fmt.Fprintf(t, "Bridge\t%s\n", status.Bridge)
+	fmt.Fprintf(t, "Clients\t%d\n", status.Clients)
+
+	return t.Flush()
+}
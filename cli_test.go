@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cjimti/iotwifi/client"
+	"github.com/cjimti/iotwifi/iotwifi"
+)
+
+// testDaemon serves canned payloads for the cli commands. Connect
+// requests are sent on the returned channel.
+func testDaemon(t *testing.T) (*httptest.Server, chan iotwifi.WpaCredentials) {
+	connects := make(chan iotwifi.WpaCredentials, 1)
+
+	payloads := map[string]interface{}{
+		"/v1/status": iotwifi.StationStatus{
+			State:     "COMPLETED",
+			Ssid:      "home",
+			Frequency: 2437,
+			Channel:   6,
+			Ipv4:      []string{"192.168.1.20/24"},
+		},
+		"/v1/scan": map[string]iotwifi.WpaNetwork{
+			"cafe":              {Ssid: "cafe", Bssid: "aa:bb:cc:dd:ee:02", SignalLevel: "-70"},
+			"home":              {Ssid: "home", Bssid: "aa:bb:cc:dd:ee:01", SignalLevel: "-40"},
+			"aa:bb:cc:dd:ee:03": {Bssid: "aa:bb:cc:dd:ee:03", SignalLevel: "-55", Hidden: true},
+		},
+		"/v1/networks": []iotwifi.WpaConfiguredNetwork{{Id: "0", Ssid: "home"}},
+		"/v1/clients":  []iotwifi.ApClient{{Mac: "aa:bb:cc:dd:ee:10", Ip: "192.168.27.20", ConnectedSeconds: 90}},
+		"/v1/ap":       iotwifi.ApStatus{Up: true, Interface: "uap0", Ssid: "iot-wifi", Channel: "6"},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/connect" {
+			var creds iotwifi.WpaCredentials
+			json.NewDecoder(r.Body).Decode(&creds)
+			connects <- creds
+			apiPayloadReturn(w, "Connection", iotwifi.WpaConnection{Ssid: creds.Ssid, State: "COMPLETED"})
+			return
+		}
+
+		payload, ok := payloads[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		apiPayloadReturn(w, r.URL.Path, payload)
+	}))
+
+	return srv, connects
+}
+
+func TestCliCommands(t *testing.T) {
+	srv, _ := testDaemon(t)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name  string
+		json  bool
+		run   func(c *cli) error
+		lines []string
+	}{
+		{"status", false, (*cli).status, []string{"State           COMPLETED", "SSID            home", "Frequency       2437 MHz (channel 6)", "IPv4            192.168.1.20/24"}},
+		{"scan", false, func(c *cli) error { return c.scan("") }, []string{
+			"SSID      BSSID              FREQUENCY  SIGNAL  FLAGS",
+			"home      aa:bb:cc:dd:ee:01             -40",
+			"(hidden)  aa:bb:cc:dd:ee:03             -55",
+			"cafe      aa:bb:cc:dd:ee:02             -70",
+		}},
+		{"networks", false, (*cli).networks, []string{"ID  SSID  BSSID  FLAGS", "0   home"}},
+		{"clients", false, (*cli).clients, []string{"aa:bb:cc:dd:ee:10  192.168.27.20", "1m30s"}},
+		{"ap", false, (*cli).ap, []string{"Up         true", "Interface  uap0", "Channel    6"}},
+		{"ap json", true, (*cli).ap, []string{`"up": true`, `"ssid": "iot-wifi"`}},
+	} {
+		out := &bytes.Buffer{}
+		c := &cli{client: client.New(srv.URL), json: tc.json, out: out}
+
+		if err := tc.run(c); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		for _, line := range tc.lines {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("%s: output has no %q:\n%s", tc.name, line, out)
+			}
+		}
+	}
+}
+
+func TestCliScanOrder(t *testing.T) {
+	srv, _ := testDaemon(t)
+	defer srv.Close()
+
+	out := &bytes.Buffer{}
+	c := &cli{client: client.New(srv.URL), out: out}
+	if err := c.scan(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// strongest first
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "home") || !strings.HasPrefix(lines[2], "(hidden)") || !strings.HasPrefix(lines[3], "cafe") {
+		t.Errorf("scan output:\n%s", out)
+	}
+}
+
+func TestCliConnect(t *testing.T) {
+	srv, connects := testDaemon(t)
+	defer srv.Close()
+
+	c := &cli{client: client.New(srv.URL), out: &bytes.Buffer{}}
+
+	if err := c.connect(iotwifi.WpaCredentials{Psk: "mystrongpassword"}); err == nil {
+		t.Error("connect without ssid accepted")
+	}
+
+	if err := c.connect(iotwifi.WpaCredentials{Ssid: "home", Psk: "mystrongpassword", Sae: true}); err != nil {
+		t.Fatal(err)
+	}
+	if creds := <-connects; creds.Ssid != "home" || creds.Psk != "mystrongpassword" || !creds.Sae {
+		t.Errorf("daemon got %+v", creds)
+	}
+}
+
+func TestNewCli(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iotwifi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "iotwifi.sock")
+	listener, err := listenSocket(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("socket mode %v, want 0600", mode)
+	}
+
+	port := os.Getenv("IOTWIFI_PORT")
+	os.Unsetenv("IOTWIFI_PORT")
+	defer os.Setenv("IOTWIFI_PORT", port)
+
+	for _, tc := range []struct {
+		name    string
+		socket  string
+		url     string
+		baseUrl string
+	}{
+		{"url", socket, "http://192.168.27.1:8080", "http://192.168.27.1:8080"},
+		{"socket", socket, "", "http://iotwifi"},
+		{"fallback", filepath.Join(dir, "missing.sock"), "", "http://localhost:8080"},
+	} {
+		if c := newCli(tc.socket, tc.url); c.client.BaseUrl != tc.baseUrl {
+			t.Errorf("%s: base url %q, want %q", tc.name, c.client.BaseUrl, tc.baseUrl)
+		}
+	}
+}
+
+func TestRunCliUsage(t *testing.T) {
+	for _, tc := range []struct {
+		command string
+		args    []string
+		code    int
+	}{
+		{"help", nil, 0},
+		{"unknown", nil, 2},
+		{"status", []string{"-nosuchflag"}, 2},
+	} {
+		if code := runCli(tc.command, tc.args); code != tc.code {
+			t.Errorf("%s %v: exit code %d, want %d", tc.command, tc.args, code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Package client is a Go client for the iotwifi HTTP API.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cjimti/iotwifi/iotwifi"
+)
+
+// Client calls the iotwifi HTTP API.
+type Client struct {
+	BaseUrl    string       // http://192.168.27.1:8080
+	HttpClient *http.Client // http.DefaultClient when nil
+	Token      string       // sent as a bearer token when set
+}
+
+// ApiError is returned when the API answers with a FAIL status or a
+// response that is not an API return.
+type ApiError struct {
+	HttpStatus int             `json:"-"`
+	Status     string          `json:"-"`
+	Code       string          `json:"code"`
+	Message    string          `json:"message"`
+	Details    json.RawMessage `json:"details"`
+}
+
+// Error implements error.
+func (e *ApiError) Error() string {
+	if e.Code != "" {
+		return "iotwifi: " + e.Code + ": " + e.Message
+	}
+
+	return "iotwifi: " + e.Status + ": " + e.Message
+}
+
+// apiReturn is the API return with the payload left encoded.
+type apiReturn struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Payload json.RawMessage `json:"payload"`
+	Error   *ApiError       `json:"error"`
+}
+
+// New produces a Client for an API base url.
+func New(baseUrl string) *Client {
+	return &Client{
+		BaseUrl: strings.TrimRight(baseUrl, "/"),
+	}
+}
+
+// NewUnix produces a Client for an API served on a unix socket.
+func NewUnix(socket string) *Client {
+	return &Client{
+		BaseUrl: "http://iotwifi",
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the station status.
+func (c *Client) Status(ctx context.Context) (iotwifi.StationStatus, error) {
+	status := iotwifi.StationStatus{}
+	err := c.call(ctx, "GET", "/v1/status", nil, &status)
+
+	return status, err
+}
+
+// Scan scans for networks, keyed by ssid or by bssid for hidden
+// networks.
+func (c *Client) Scan(ctx context.Context) (map[string]iotwifi.WpaNetwork, error) {
+	networks := map[string]iotwifi.WpaNetwork{}
+	err := c.call(ctx, "GET", "/v1/scan", nil, &networks)
+
+	return networks, err
+}
+
+// ScanSsid actively probes for an ssid, which finds hidden networks
+// broadcasting it.
+func (c *Client) ScanSsid(ctx context.Context, ssid string) (map[string]iotwifi.WpaNetwork, error) {
+	networks := map[string]iotwifi.WpaNetwork{}
+	err := c.call(ctx, "GET", "/v1/scan?ssid="+url.QueryEscape(ssid), nil, &networks)
+
+	return networks, err
+}
+
+// Connect connects the station to a network. A network that does not
+// associate is returned as an *ApiError with the connect_failed code and
+// the connection in Details.
+func (c *Client) Connect(ctx context.Context, creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+	connection := iotwifi.WpaConnection{}
+	err := c.call(ctx, "POST", "/v1/connect", creds, &connection)
+
+	return connection, err
+}
+
+// Kill stops the daemon.
+func (c *Client) Kill(ctx context.Context) error {
+	return c.call(ctx, "POST", "/v1/kill", nil, nil)
+}
+
+// Networks returns the networks saved in wpa_supplicant.
+func (c *Client) Networks(ctx context.Context) ([]iotwifi.WpaConfiguredNetwork, error) {
+	networks := []iotwifi.WpaConfiguredNetwork{}
+	err := c.call(ctx, "GET", "/v1/networks", nil, &networks)
+
+	return networks, err
+}
+
+// Clients returns the clients associated with the AP.
+func (c *Client) Clients(ctx context.Context) ([]iotwifi.ApClient, error) {
+	clients := []iotwifi.ApClient{}
+	err := c.call(ctx, "GET", "/v1/clients", nil, &clients)
+
+	return clients, err
+}
+
+// Ap returns the AP status.
+func (c *Client) Ap(ctx context.Context) (iotwifi.ApStatus, error) {
+	status := iotwifi.ApStatus{}
+	err := c.call(ctx, "GET", "/v1/ap", nil, &status)
+
+	return status, err
+}
+
+// Wps returns the status of the last WPS run.
+func (c *Client) Wps(ctx context.Context) (iotwifi.ProvisionStatus, error) {
+	status := iotwifi.ProvisionStatus{}
+	err := c.call(ctx, "GET", "/v1/wps", nil, &status)
+
+	return status, err
+}
+
+// WpsPbc starts WPS push button provisioning of the station.
+func (c *Client) WpsPbc(ctx context.Context, req iotwifi.WpsRequest) (iotwifi.ProvisionStatus, error) {
+	status := iotwifi.ProvisionStatus{}
+	err := c.call(ctx, "POST", "/v1/wps/pbc", req, &status)
+
+	return status, err
+}
+
+// WpsPin starts WPS PIN provisioning of the station. The returned
+// status carries the pin to enter on the AP.
+func (c *Client) WpsPin(ctx context.Context, req iotwifi.WpsRequest) (iotwifi.ProvisionStatus, error) {
+	status := iotwifi.ProvisionStatus{}
+	err := c.call(ctx, "POST", "/v1/wps/pin", req, &status)
+
+	return status, err
+}
+
+// Dpp returns the DPP bootstrap URI and onboarding status.
+func (c *Client) Dpp(ctx context.Context) (iotwifi.DppStatus, error) {
+	status := iotwifi.DppStatus{}
+	err := c.call(ctx, "GET", "/v1/dpp", nil, &status)
+
+	return status, err
+}
+
+// DppStart makes the station listen for a DPP configurator. The
+// returned URI is shown as a QR code for a phone to scan.
+func (c *Client) DppStart(ctx context.Context, req iotwifi.DppRequest) (iotwifi.DppStatus, error) {
+	status := iotwifi.DppStatus{}
+	err := c.call(ctx, "POST", "/v1/dpp", req, &status)
+
+	return status, err
+}
+
+// DppStop stops listening for a DPP configurator.
+func (c *Client) DppStop(ctx context.Context) (iotwifi.DppStatus, error) {
+	status := iotwifi.DppStatus{}
+	err := c.call(ctx, "DELETE", "/v1/dpp", nil, &status)
+
+	return status, err
+}
+
+// ApWpsPbc presses the WPS button of the AP.
+func (c *Client) ApWpsPbc(ctx context.Context) error {
+	return c.call(ctx, "POST", "/v1/ap/wps/pbc", nil, nil)
+}
+
+// ApWpsPin lets a client with a WPS pin join the AP.
+func (c *Client) ApWpsPin(ctx context.Context, pin string) error {
+	return c.call(ctx, "POST", "/v1/ap/wps/pin", iotwifi.WpsRequest{Pin: pin}, nil)
+}
+
+// Radios returns the radio capabilities and the PHYs the station and
+// AP run on.
+func (c *Client) Radios(ctx context.Context) (iotwifi.RadioStatus, error) {
+	status := iotwifi.RadioStatus{}
+	err := c.call(ctx, "GET", "/v1/radios", nil, &status)
+
+	return status, err
+}
+
+// Regulatory returns the configured country, the regulatory rules in
+// effect and whether the AP channel is allowed.
+func (c *Client) Regulatory(ctx context.Context) (iotwifi.RegulatoryStatus, error) {
+	status := iotwifi.RegulatoryStatus{}
+	err := c.call(ctx, "GET", "/v1/regulatory", nil, &status)
+
+	return status, err
+}
+
+// LinkHistory returns the station link samples recorded after since,
+// all samples when since is zero.
+func (c *Client) LinkHistory(ctx context.Context, since time.Time) ([]iotwifi.LinkSample, error) {
+	path := "/v1/link/history"
+	if !since.IsZero() {
+		path += "?since=" + url.QueryEscape(since.Format(time.RFC3339))
+	}
+
+	samples := []iotwifi.LinkSample{}
+	err := c.call(ctx, "GET", path, nil, &samples)
+
+	return samples, err
+}
+
+// Journal returns the journal entries matching q.
+func (c *Client) Journal(ctx context.Context, q iotwifi.JournalQuery) ([]iotwifi.Event, error) {
+	params := url.Values{}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		params.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if len(q.Types) > 0 {
+		params.Set("type", strings.Join(q.Types, ","))
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	path := "/v1/journal"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	events := []iotwifi.Event{}
+	err := c.call(ctx, "GET", path, nil, &events)
+
+	return events, err
+}
+
+// Metrics returns the metrics in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	data, err := c.raw(ctx, "/v1/metrics")
+
+	return string(data), err
+}
+
+// OpenApi returns the OpenAPI 3 document describing the API.
+func (c *Client) OpenApi(ctx context.Context) ([]byte, error) {
+	return c.raw(ctx, "/openapi.json")
+}
+
+// raw requests a path that does not answer with an API return.
+func (c *Client) raw(ctx context.Context, path string) ([]byte, error) {
+	res, err := c.do(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &ApiError{HttpStatus: res.StatusCode, Status: res.Status, Message: string(data)}
+	}
+
+	return data, nil
+}
+
+// call requests an API path and decodes the payload into v.
+func (c *Client) call(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	res, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	ret := apiReturn{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return &ApiError{HttpStatus: res.StatusCode, Status: res.Status, Message: strings.TrimSpace(string(data))}
+	}
+
+	if ret.Status != "OK" {
+		apiErr := ret.Error
+		if apiErr == nil {
+			apiErr = &ApiError{Message: ret.Message}
+		}
+		apiErr.HttpStatus = res.StatusCode
+		apiErr.Status = ret.Status
+
+		return apiErr
+	}
+
+	if v == nil || len(ret.Payload) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(ret.Payload, v)
+}
+
+// do sends a request with an optional JSON body.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var reqBody *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	var req *http.Request
+	var err error
+	if reqBody != nil {
+		req, err = http.NewRequest(method, c.BaseUrl+path, reqBody)
+	} else {
+		req, err = http.NewRequest(method, c.BaseUrl+path, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return httpClient.Do(req)
+}
@@ -0,0 +1,346 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cjimti/iotwifi/iotwifi"
+)
+
+// testRequest is a request recorded by a test server.
+type testRequest struct {
+	method string
+	uri    string
+	header http.Header
+	body   string
+}
+
+// testServer answers every request with status and body and records
+// the requests on the returned channel.
+func testServer(t *testing.T, status int, body string) (*httptest.Server, chan testRequest) {
+	requests := make(chan testRequest, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- testRequest{r.Method, r.URL.RequestURI(), r.Header, string(data)}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+
+	return srv, requests
+}
+
+func TestClientMethods(t *testing.T) {
+	since := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	started := time.Date(2026, 10, 19, 8, 1, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name    string
+		call    func(ctx context.Context, c *Client) (interface{}, error)
+		method  string
+		uri     string
+		body    string
+		payload interface{}
+	}{
+		{
+			"Status",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Status(ctx) },
+			"GET", "/v1/status", "",
+			iotwifi.StationStatus{State: "COMPLETED", Ssid: "home", Channel: 6},
+		},
+		{
+			"Scan",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Scan(ctx) },
+			"GET", "/v1/scan", "",
+			map[string]iotwifi.WpaNetwork{"home": {Bssid: "aa:bb:cc:dd:ee:ff", Ssid: "home"}},
+		},
+		{
+			"ScanSsid",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.ScanSsid(ctx, "my home") },
+			"GET", "/v1/scan?ssid=my+home", "",
+			map[string]iotwifi.WpaNetwork{"my home": {Ssid: "my home", Hidden: true}},
+		},
+		{
+			"Connect",
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Connect(ctx, iotwifi.WpaCredentials{Ssid: "home", Psk: "password1"})
+			},
+			"POST", "/v1/connect", `{"ssid":"home","psk":"password1","hidden":false,"sae":false}`,
+			iotwifi.WpaConnection{Ssid: "home", State: "COMPLETED", Ip: "192.168.1.20"},
+		},
+		{
+			"Kill",
+			func(ctx context.Context, c *Client) (interface{}, error) { return nil, c.Kill(ctx) },
+			"POST", "/v1/kill", "",
+			nil,
+		},
+		{
+			"Networks",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Networks(ctx) },
+			"GET", "/v1/networks", "",
+			[]iotwifi.WpaConfiguredNetwork{{Id: "0", Ssid: "home", Flags: "[CURRENT]"}},
+		},
+		{
+			"Clients",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Clients(ctx) },
+			"GET", "/v1/clients", "",
+			[]iotwifi.ApClient{{Mac: "aa:bb:cc:dd:ee:01", Ip: "192.168.27.10", Signal: -40}},
+		},
+		{
+			"Ap",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Ap(ctx) },
+			"GET", "/v1/ap", "",
+			iotwifi.ApStatus{Up: true, Interface: "uap0", Ssid: "iotwifi", Clients: 1},
+		},
+		{
+			"Wps",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Wps(ctx) },
+			"GET", "/v1/wps", "",
+			iotwifi.ProvisionStatus{Method: "pbc", State: "running", StartedAt: started},
+		},
+		{
+			"WpsPbc",
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.WpsPbc(ctx, iotwifi.WpsRequest{Bssid: "aa:bb:cc:dd:ee:ff"})
+			},
+			"POST", "/v1/wps/pbc", `{"bssid":"aa:bb:cc:dd:ee:ff","pin":""}`,
+			iotwifi.ProvisionStatus{Method: "pbc", State: "running"},
+		},
+		{
+			"WpsPin",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.WpsPin(ctx, iotwifi.WpsRequest{}) },
+			"POST", "/v1/wps/pin", `{"bssid":"","pin":""}`,
+			iotwifi.ProvisionStatus{Method: "pin", State: "running", Pin: "12345670"},
+		},
+		{
+			"Dpp",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Dpp(ctx) },
+			"GET", "/v1/dpp", "",
+			iotwifi.DppStatus{Uri: "DPP:K:abc;;", Channel: 6},
+		},
+		{
+			"DppStart",
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.DppStart(ctx, iotwifi.DppRequest{Channel: 6})
+			},
+			"POST", "/v1/dpp", `{"channel":6}`,
+			iotwifi.DppStatus{Uri: "DPP:K:abc;;", Channel: 6, Provision: iotwifi.ProvisionStatus{Method: "dpp", State: "running"}},
+		},
+		{
+			"DppStop",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.DppStop(ctx) },
+			"DELETE", "/v1/dpp", "",
+			iotwifi.DppStatus{Provision: iotwifi.ProvisionStatus{Method: "dpp", State: "stopped"}},
+		},
+		{
+			"ApWpsPbc",
+			func(ctx context.Context, c *Client) (interface{}, error) { return nil, c.ApWpsPbc(ctx) },
+			"POST", "/v1/ap/wps/pbc", "",
+			nil,
+		},
+		{
+			"ApWpsPin",
+			func(ctx context.Context, c *Client) (interface{}, error) { return nil, c.ApWpsPin(ctx, "12345670") },
+			"POST", "/v1/ap/wps/pin", `{"bssid":"","pin":"12345670"}`,
+			nil,
+		},
+		{
+			"Radios",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Radios(ctx) },
+			"GET", "/v1/radios", "",
+			iotwifi.RadioStatus{Radios: []iotwifi.Radio{}, Error: "no radios"},
+		},
+		{
+			"Regulatory",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.Regulatory(ctx) },
+			"GET", "/v1/regulatory", "",
+			iotwifi.RegulatoryStatus{Country: "DE", ApChannel: "6"},
+		},
+		{
+			"LinkHistory",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.LinkHistory(ctx, time.Time{}) },
+			"GET", "/v1/link/history", "",
+			[]iotwifi.LinkSample{{Time: since, Rssi: -60, LinkSpeed: 72}},
+		},
+		{
+			"LinkHistory since",
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.LinkHistory(ctx, since) },
+			"GET", "/v1/link/history?since=2026-10-19T08%3A00%3A00Z", "",
+			[]iotwifi.LinkSample{},
+		},
+		{
+			"Journal",
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Journal(ctx, iotwifi.JournalQuery{Since: since, Types: []string{"connect", "disconnect"}, Limit: 5})
+			},
+			"GET", "/v1/journal?limit=5&since=2026-10-19T08%3A00%3A00Z&type=connect%2Cdisconnect", "",
+			[]iotwifi.Event{{Type: "connect", Time: since, Message: "connected"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, err := json.Marshal(tc.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv, requests := testServer(t, http.StatusOK, `{"status":"OK","message":"done","payload":`+string(payload)+`}`)
+			defer srv.Close()
+
+			got, err := tc.call(context.Background(), New(srv.URL+"/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := <-requests
+			if req.method != tc.method || req.uri != tc.uri {
+				t.Errorf("request %s %s, want %s %s", req.method, req.uri, tc.method, tc.uri)
+			}
+			if req.body != tc.body {
+				t.Errorf("request body %s, want %s", req.body, tc.body)
+			}
+			if tc.body != "" && req.header.Get("Content-Type") != "application/json" {
+				t.Errorf("Content-Type %q", req.header.Get("Content-Type"))
+			}
+			if req.header.Get("Authorization") != "" {
+				t.Errorf("Authorization %q sent without a token", req.header.Get("Authorization"))
+			}
+
+			if tc.payload != nil && !reflect.DeepEqual(got, tc.payload) {
+				t.Errorf("payload %#v, want %#v", got, tc.payload)
+			}
+		})
+	}
+}
+
+func TestClientRaw(t *testing.T) {
+	srv, requests := testServer(t, http.StatusOK, "iotwifi_up 1\n")
+	defer srv.Close()
+
+	metrics, err := New(srv.URL).Metrics(context.Background())
+	if err != nil || metrics != "iotwifi_up 1\n" {
+		t.Errorf("Metrics() = %q, %v", metrics, err)
+	}
+	if req := <-requests; req.method != "GET" || req.uri != "/v1/metrics" {
+		t.Errorf("request %s %s", req.method, req.uri)
+	}
+
+	srv, requests = testServer(t, http.StatusNotFound, "not found")
+	defer srv.Close()
+
+	_, err = New(srv.URL).OpenApi(context.Background())
+	apiErr, ok := err.(*ApiError)
+	if !ok || apiErr.HttpStatus != http.StatusNotFound || apiErr.Message != "not found" {
+		t.Errorf("OpenApi() error %#v", err)
+	}
+	if req := <-requests; req.uri != "/openapi.json" {
+		t.Errorf("request %s", req.uri)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   ApiError
+	}{
+		{
+			"error envelope",
+			http.StatusUnprocessableEntity,
+			`{"status":"FAIL","message":"no association","payload":null,"error":{"code":"connect_failed","message":"no association","details":{"ssid":"home","state":"FAIL"}}}`,
+			ApiError{
+				HttpStatus: http.StatusUnprocessableEntity,
+				Status:     "FAIL",
+				Code:       "connect_failed",
+				Message:    "no association",
+				Details:    json.RawMessage(`{"ssid":"home","state":"FAIL"}`),
+			},
+		},
+		{
+			"envelope without error",
+			http.StatusOK,
+			`{"status":"FAIL","message":"wpa_cli failed","payload":null}`,
+			ApiError{HttpStatus: http.StatusOK, Status: "FAIL", Message: "wpa_cli failed"},
+		},
+		{
+			"not an api return",
+			http.StatusBadGateway,
+			"bad gateway\n",
+			ApiError{HttpStatus: http.StatusBadGateway, Status: "502 Bad Gateway", Message: "bad gateway"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := testServer(t, tc.status, tc.body)
+			defer srv.Close()
+
+			_, err := New(srv.URL).Connect(context.Background(), iotwifi.WpaCredentials{Ssid: "home"})
+			apiErr, ok := err.(*ApiError)
+			if !ok {
+				t.Fatalf("error %#v is not an *ApiError", err)
+			}
+			if !reflect.DeepEqual(*apiErr, tc.want) {
+				t.Errorf("error %#v, want %#v", *apiErr, tc.want)
+			}
+			if tc.want.Code != "" && apiErr.Error() != "iotwifi: "+tc.want.Code+": "+tc.want.Message {
+				t.Errorf("Error() = %q", apiErr.Error())
+			}
+		})
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	srv, requests := testServer(t, http.StatusOK, `{"status":"OK","message":"","payload":null}`)
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.Token = "s3cret"
+	if err := c.Kill(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if got := req.header.Get("Authorization"); got != "Bearer s3cret" {
+		t.Errorf("Authorization %q, want Bearer s3cret", got)
+	}
+	if got := req.header.Get("Accept"); got != "application/json" {
+		t.Errorf("Accept %q", got)
+	}
+}
+
+func TestClientContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := New(srv.URL).Status(ctx)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+			t.Errorf("error %v, want the context deadline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not canceled with its context")
+	}
+}
@@ -0,0 +1,121 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ApStatus describes the provisioning AP.
+type ApStatus struct {
+	Up        bool   `json:"up"`
+	Interface string `json:"interface"`
+	Ssid      string `json:"ssid"`
+	Channel   string `json:"channel"`
+	Ip        string `json:"ip"`
+	Bridge    string `json:"bridge"`
+	Clients   int    `json:"clients"`
+}
+
+// ApClient is a client associated with the AP.
+type ApClient struct {
+	Mac              string `json:"mac"`
+	Ip               string `json:"ip"`
+	Hostname         string `json:"hostname"`
+	Signal           int    `json:"signal"`
+	ConnectedSeconds int    `json:"connected_seconds"`
+	InactiveMs       int    `json:"inactive_ms"`
+}
+
+// ApStatus returns the status of the AP.
+func (wpa *WpaCfg) ApStatus() ApStatus {
+	wpa.mu.Lock()
+	up := wpa.hostapd != nil
+	wpa.mu.Unlock()
+
+	status := ApStatus{
+		Up:        up,
+		Interface: "uap0",
+		Ssid:      wpa.WpaCfg.HostApdCfg.Ssid,
+		Channel:   wpa.apChannel(),
+		Ip:        wpa.WpaCfg.HostApdCfg.Ip,
+	}
+
+	if wpa.WpaCfg.BridgeCfg.Enabled {
+		status.Bridge = wpa.WpaCfg.BridgeCfg.Name
+		status.Ip = ""
+	}
+
+	if up {
+		status.Clients = wpa.ApClientCount()
+	}
+
+	return status
+}
+
+// ApClients returns the clients associated with the AP along with the
+// address and hostname of their DHCP lease.
+func (wpa *WpaCfg) ApClients() ([]ApClient, error) {
+	clients := []ApClient{}
+
+	dumpOut, err := exec.Command("iw", "dev", "uap0", "station", "dump").Output()
+	if err != nil {
+		return clients, err
+	}
+
+	leases := dhcpLeases(wpa.WpaCfg.DnsmasqCfg.LeaseFile)
+
+	// each station block starts with "Station <mac> (on uap0)"
+	for _, block := range strings.Split(string(dumpOut), "Station ")[1:] {
+		fields := strings.Fields(block)
+		if len(fields) == 0 {
+			continue
+		}
+
+		dump := stationDumpMapper([]byte(block))
+		client := ApClient{
+			Mac: fields[0],
+		}
+		client.Signal, _ = strconv.Atoi(dump["signal"])
+		client.ConnectedSeconds, _ = strconv.Atoi(dump["connected time"])
+		client.InactiveMs, _ = strconv.Atoi(dump["inactive time"])
+
+		if lease, ok := leases[strings.ToLower(client.Mac)]; ok {
+			client.Ip = lease[0]
+			client.Hostname = lease[1]
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// dhcpLeases reads a dnsmasq lease file into a map of lowercase MAC
+// address to IP address and hostname.
+func dhcpLeases(leaseFile string) map[string][2]string {
+	leases := make(map[string][2]string, 0)
+
+	leaseData, err := ioutil.ReadFile(leaseFile)
+	if err != nil {
+		return leases
+	}
+
+	// <expiry> <mac> <ip> <hostname> <client id>
+	for _, line := range strings.Split(string(leaseData), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+
+		leases[strings.ToLower(fields[1])] = [2]string{fields[2], hostname}
+	}
+
+	return leases
+}
@@ -0,0 +1,279 @@
+package iotwifi
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ApChannelAuto is the HostApdCfg channel that has the AP pick the
+// least congested channel from scan results.
+const ApChannelAuto = "auto"
+
+// apChannelFallback is used when auto has no scan results to go by.
+const apChannelFallback = 6
+
+// apChannelCandidates are the non-overlapping 2.4 GHz channels auto
+// picks from.
+var apChannelCandidates = []int{1, 6, 11}
+
+// ApChannelSwitch is the payload of EventApChannelChanged.
+type ApChannelSwitch struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Frequency int    `json:"frequency"`
+}
+
+// channelCongestion scores how busy a channel is from the networks
+// overlapping it, weighted by their signal and how close they are.
+func channelCongestion(networks map[string]WpaNetwork, channel int) float64 {
+	score := 0.0
+
+	for _, network := range networks {
+		freq, _ := strconv.Atoi(network.Frequency)
+		other := frequencyToChannel(freq)
+		if freq > 2484 || other == 0 {
+			continue
+		}
+
+		// 20 MHz channels 5 or more apart do not overlap
+		distance := other - channel
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance >= 5 {
+			continue
+		}
+
+		// -100 dBm and weaker barely counts
+		signal, _ := strconv.Atoi(network.SignalLevel)
+		weight := float64(100 + signal)
+		if weight < 1 {
+			weight = 1
+		}
+
+		score += weight * float64(5-distance) / 5
+	}
+
+	return score
+}
+
+// pickApChannel returns the least congested candidate channel that
+// allowed accepts, the first one on a tie.
+func pickApChannel(networks map[string]WpaNetwork, allowed func(channel int) bool) (int, error) {
+	best := 0
+	bestScore := 0.0
+
+	for _, channel := range apChannelCandidates {
+		if !allowed(channel) {
+			continue
+		}
+
+		score := channelCongestion(networks, channel)
+		if best == 0 || score < bestScore {
+			best = channel
+			bestScore = score
+		}
+	}
+
+	if best == 0 {
+		return 0, errors.New("none of channels 1, 6 and 11 are allowed")
+	}
+
+	return best, nil
+}
+
+// stationFrequency returns the frequency of the station when it has
+// completed association.
+func stationFrequency() (int, bool) {
+	statusOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+	if err != nil {
+		return 0, false
+	}
+
+	status := cfgMapper(statusOut)
+	if status["wpa_state"] != "COMPLETED" {
+		return 0, false
+	}
+
+	freq, err := strconv.Atoi(status["freq"])
+	if err != nil {
+		return 0, false
+	}
+
+	return freq, true
+}
+
+// apChannelAllowed returns a check of a channel against the global
+// regulatory domain, which allows every channel when it can not be read.
+func apChannelAllowed() func(channel int) bool {
+	domains, err := RegDomains()
+	if err != nil {
+		return func(channel int) bool { return true }
+	}
+
+	domain, ok := globalDomain(domains)
+	if !ok {
+		return func(channel int) bool { return true }
+	}
+
+	return func(channel int) bool {
+		return ValidateApChannel(domain, strconv.Itoa(channel)) == nil
+	}
+}
+
+// errStationNotAssociated is returned by stationApChannel when the
+// station has no channel to share.
+var errStationNotAssociated = errors.New("station is not associated")
+
+// stationApChannel returns the frequency and channel of the station for
+// an AP sharing its radio, or why the AP can not use it: hostapd runs
+// the AP in 2.4 GHz only and the channel has to be allowed for an AP.
+func stationApChannel(allowed func(channel int) bool) (int, string, error) {
+	freq, ok := stationFrequency()
+	if !ok {
+		return 0, "", errStationNotAssociated
+	}
+
+	channel := strconv.Itoa(frequencyToChannel(freq))
+
+	if freq > 2484 {
+		return freq, channel, errors.New("station is on " + strconv.Itoa(freq) + " MHz, the AP can not use it out of the 2.4 GHz band")
+	}
+
+	if !allowed(frequencyToChannel(freq)) {
+		return freq, channel, errors.New("station channel " + channel + " may not be used by the AP")
+	}
+
+	return freq, channel, nil
+}
+
+// resolveApChannel returns the channel to start the AP on. An AP sharing
+// the station's radio has to use the station's channel, otherwise auto
+// picks the least congested channel from the station's scan results.
+func (wpa *WpaCfg) resolveApChannel() string {
+	configured := wpa.WpaCfg.HostApdCfg.Channel
+
+	wpa.mu.Lock()
+	shared := wpa.placement.Shared
+	wpa.mu.Unlock()
+
+	if shared {
+		_, channel, err := stationApChannel(apChannelAllowed())
+		if err == nil {
+			wpa.Log.Info("AP shares the station radio, using the station channel %s", channel)
+			return channel
+		}
+		if err != errStationNotAssociated {
+			wpa.Log.Warn("AP shares the station radio but can not use its channel: %s", err.Error())
+		}
+	}
+
+	if configured != ApChannelAuto {
+		return configured
+	}
+
+	// wpa_supplicant is not running yet in dual and ap-only mode
+	networks := make(map[string]WpaNetwork, 0)
+	if wpa.supplicantUp() {
+		networks, _ = wpa.ScanNetworks()
+	}
+
+	if len(networks) == 0 {
+		wpa.Log.Info("No scan results, using AP channel %d", apChannelFallback)
+		return strconv.Itoa(apChannelFallback)
+	}
+
+	channel, err := pickApChannel(networks, apChannelAllowed())
+	if err != nil {
+		wpa.Log.Error("Could not pick an AP channel: %s", err.Error())
+		return strconv.Itoa(apChannelFallback)
+	}
+
+	wpa.Log.Info("Picked AP channel %d from %d scanned networks", channel, len(networks))
+
+	return strconv.Itoa(channel)
+}
+
+// apChannel returns the channel the AP is on, or the configured channel
+// when it is down.
+func (wpa *WpaCfg) apChannel() string {
+	wpa.mu.Lock()
+	defer wpa.mu.Unlock()
+
+	if wpa.hostapd != nil && wpa.apChan != "" {
+		return wpa.apChan
+	}
+
+	return wpa.WpaCfg.HostApdCfg.Channel
+}
+
+// followStation moves an AP sharing the station's radio to the channel
+// the station connected on with a hostapd channel switch, which keeps
+// its clients associated.
+func (wpa *WpaCfg) followStation() {
+	wpa.mu.Lock()
+	up := wpa.hostapd != nil
+	shared := wpa.placement.Shared
+	current := wpa.apChan
+	wpa.mu.Unlock()
+
+	if !up || !shared {
+		return
+	}
+
+	freq, channel, err := stationApChannel(apChannelAllowed())
+	if err == errStationNotAssociated || channel == current {
+		return
+	}
+	if err != nil {
+		wpa.Log.Warn("AP not following the station: %s", err.Error())
+		return
+	}
+
+	out, err := exec.Command("hostapd_cli", "-p", hostapdCtrl, "-i", "uap0", "chan_switch", "5", strconv.Itoa(freq)).Output()
+	if err != nil {
+		wpa.Log.Error("AP channel switch to %s failed: %s", channel, err.Error())
+		return
+	}
+
+	result := strings.TrimSpace(string(out))
+	wpa.Log.Info("Hostapd chan_switch got: %s", result)
+
+	if strings.HasPrefix(result, "FAIL") {
+		wpa.Log.Error("Hostapd refused the channel switch to %s", channel)
+		return
+	}
+
+	wpa.mu.Lock()
+	wpa.apChan = channel
+	wpa.mu.Unlock()
+
+	wpa.Events.Publish(Event{
+		Type:    EventApChannelChanged,
+		Message: "AP moved from channel " + current + " to " + channel + " to follow the station",
+		Payload: ApChannelSwitch{From: current, To: channel, Frequency: freq},
+	})
+}
+
+// FollowStation moves an AP sharing the station's radio after the
+// station connects, one connect at a time, until the process exits.
+func (wpa *WpaCfg) FollowStation() {
+	for range wpa.follow {
+		wpa.followStation()
+	}
+}
+
+// handleChannelEvent has FollowStation follow the station when it
+// connects. Connects while a switch is pending are folded into it.
+func (wpa *WpaCfg) handleChannelEvent(event Event) {
+	if event.Type != EventStationConnected {
+		return
+	}
+
+	select {
+	case wpa.follow <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,118 @@
+package iotwifi
+
+import (
+	"strconv"
+	"testing"
+)
+
+// fakeWpaStatus puts a wpa_cli on the PATH that answers status with
+// status. The returned func restores the PATH.
+func fakeWpaStatus(t *testing.T, status string) func() {
+	_, cleanup := fakeCommand(t, "wpa_cli", func(string) string {
+		return "printf '" + status + "'\n"
+	})
+
+	return cleanup
+}
+
+func TestStationApChannel(t *testing.T) {
+	noChannel12 := func(channel int) bool { return channel != 12 }
+
+	for _, tc := range []struct {
+		name    string
+		status  string
+		channel string
+		fails   bool
+	}{
+		{"associated", `wpa_state=COMPLETED\nfreq=2437\n`, "6", false},
+		{"not associated", `wpa_state=SCANNING\n`, "", true},
+		{"5 GHz", `wpa_state=COMPLETED\nfreq=5180\n`, "36", true},
+		{"not allowed", `wpa_state=COMPLETED\nfreq=2467\n`, "12", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cleanup := fakeWpaStatus(t, tc.status)
+			defer cleanup()
+
+			_, channel, err := stationApChannel(noChannel12)
+			if (err != nil) != tc.fails || channel != tc.channel {
+				t.Errorf("stationApChannel() = %q, %v", channel, err)
+			}
+		})
+	}
+}
+
+func TestResolveApChannelShared(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		status     string
+		configured string
+		channel    string
+	}{
+		{"station channel", `wpa_state=COMPLETED\nfreq=2462\n`, "6", "11"},
+		{"5 GHz station", `wpa_state=COMPLETED\nfreq=5180\n`, "6", "6"},
+		{"not associated", `wpa_state=SCANNING\n`, "1", "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cleanup := fakeWpaStatus(t, tc.status)
+			defer cleanup()
+
+			wpa := testWpaCfg(t)
+			wpa.WpaCfg.HostApdCfg.Channel = tc.configured
+			wpa.placement.Shared = true
+
+			if channel := wpa.resolveApChannel(); channel != tc.channel {
+				t.Errorf("resolveApChannel() = %s, want %s", channel, tc.channel)
+			}
+		})
+	}
+}
+
+func TestHandleChannelEvent(t *testing.T) {
+	wpa := testWpaCfg(t)
+	wpa.follow = make(chan struct{}, 1)
+
+	wpa.handleChannelEvent(Event{Type: EventStationDisconnected})
+	if len(wpa.follow) != 0 {
+		t.Fatal("disconnect triggered a follow")
+	}
+
+	// connects while a follow is pending are folded into it
+	for i := 0; i < 3; i++ {
+		wpa.handleChannelEvent(Event{Type: EventStationConnected})
+	}
+	if len(wpa.follow) != 1 {
+		t.Errorf("%d follows pending, want 1", len(wpa.follow))
+	}
+}
+
+func TestPickApChannel(t *testing.T) {
+	network := func(freq int, signal int) WpaNetwork {
+		return WpaNetwork{Frequency: strconv.Itoa(freq), SignalLevel: strconv.Itoa(signal)}
+	}
+	all := func(channel int) bool { return true }
+
+	for _, tc := range []struct {
+		name     string
+		networks map[string]WpaNetwork
+		allowed  func(channel int) bool
+		channel  int
+	}{
+		{"empty", map[string]WpaNetwork{}, all, 1},
+		{"busy 1", map[string]WpaNetwork{"a": network(2412, -40)}, all, 6},
+		{"busy 1 and 6", map[string]WpaNetwork{"a": network(2412, -40), "b": network(2437, -50)}, all, 11},
+		{"overlap counts", map[string]WpaNetwork{"a": network(2422, -40), "b": network(2462, -90)}, all, 11},
+		{"5 GHz ignored", map[string]WpaNetwork{"a": network(5180, -30)}, all, 1},
+		{"not allowed", map[string]WpaNetwork{"a": network(2412, -40)}, func(channel int) bool { return channel == 1 }, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			channel, err := pickApChannel(tc.networks, tc.allowed)
+			if err != nil || channel != tc.channel {
+				t.Errorf("pickApChannel() = %d, %v, want %d", channel, err, tc.channel)
+			}
+		})
+	}
+
+	if _, err := pickApChannel(map[string]WpaNetwork{}, func(channel int) bool { return false }); err == nil {
+		t.Error("no allowed channel: no error")
+	}
+}
@@ -9,7 +9,7 @@ import (
 // Command for device network commands.
 type Command struct {
 	Log      bunyan.Logger
-	Runner   CmdRunner
+	Runner   *CmdRunner
 	SetupCfg *SetupCfg
 }
 
@@ -34,24 +34,58 @@ func (c *Command) UpApInterface() {
 	cmd.Wait()
 }
 
-// AddApInterface adds the AP interface.
-func (c *Command) AddApInterface() {
-	cmd := exec.Command("iw", "phy", "phy0", "interface", "add", "uap0", "type", "__ap")
+// AddApInterface adds the AP interface to a PHY.
+func (c *Command) AddApInterface(phy string) {
+	cmd := exec.Command("iw", "phy", phy, "interface", "add", "uap0", "type", "__ap")
 	cmd.Start()
 	cmd.Wait()
 }
 
+// AddBridge adds the bridge interface. It fails when the bridge
+// already exists.
+func (c *Command) AddBridge() error {
+	return exec.Command("brctl", "addbr", c.SetupCfg.BridgeCfg.Name).Run()
+}
+
+// AddBridgeInterface enslaves the wired interface to the bridge.
+func (c *Command) AddBridgeInterface() {
+	cmd := exec.Command("brctl", "addif", c.SetupCfg.BridgeCfg.Name, c.SetupCfg.BridgeCfg.Interface)
+	cmd.Start()
+	cmd.Wait()
+}
+
+// UpBridge ups the bridge interface.
+func (c *Command) UpBridge() {
+	cmd := exec.Command("ifconfig", c.SetupCfg.BridgeCfg.Name, "up")
+	cmd.Start()
+	cmd.Wait()
+}
+
+// RemoveBridge releases the wired interface and removes the bridge.
+func (c *Command) RemoveBridge() {
+	for _, args := range [][]string{
+		{"ifconfig", c.SetupCfg.BridgeCfg.Name, "down"},
+		{"brctl", "delif", c.SetupCfg.BridgeCfg.Name, c.SetupCfg.BridgeCfg.Interface},
+		{"brctl", "delbr", c.SetupCfg.BridgeCfg.Name},
+	} {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Start()
+		cmd.Wait()
+	}
+}
+
 // CheckInterface checks the AP interface.
 func (c *Command) CheckApInterface() {
 	cmd := exec.Command("ifconfig", "uap0")
 	go c.Runner.ProcessCmd("ifconfig_uap0", cmd)
 }
 
-// StartWpaSupplicant starts wpa_supplicant.
+// StartWpaSupplicant starts wpa_supplicant. It logs at the default
+// level, which has the events the handlers need without the key dumps
+// of -d.
 func (c *Command) StartWpaSupplicant() {
 
 	args := []string{
-		"-d",
 		"-Dnl80211",
 		"-iwlan0",
 		"-c/etc/wpa_supplicant/wpa_supplicant.conf",
@@ -61,6 +95,11 @@ func (c *Command) StartWpaSupplicant() {
 	go c.Runner.ProcessCmd("wpa_supplicant", cmd)
 }
 
+// StopWpaSupplicant stops wpa_supplicant.
+func (c *Command) StopWpaSupplicant() {
+	c.Runner.StopCmd("wpa_supplicant")
+}
+
 // StartDnsmasq starts dnsmasq.
 func (c *Command) StartDnsmasq() {
 	// hostapd is enabled, fire up dnsmasq
@@ -72,6 +111,7 @@ func (c *Command) StartDnsmasq() {
 		"--address=" + c.SetupCfg.DnsmasqCfg.Address,
 		"--dhcp-range=" + c.SetupCfg.DnsmasqCfg.DhcpRange,
 		"--dhcp-vendorclass=" + c.SetupCfg.DnsmasqCfg.VendorClass,
+		"--dhcp-leasefile=" + c.SetupCfg.DnsmasqCfg.LeaseFile,
 		"--dhcp-authoritative",
 		"--log-facility=-",
 	}
@@ -79,3 +119,24 @@ func (c *Command) StartDnsmasq() {
 	cmd := exec.Command("dnsmasq", args...)
 	go c.Runner.ProcessCmd("dnsmasq", cmd)
 }
+
+// StartBridgeDhcp starts a DHCP client on the bridge interface.
+func (c *Command) StartBridgeDhcp() {
+	args := []string{
+		"-f", // Run in foreground.
+		"-i", c.SetupCfg.BridgeCfg.Name,
+	}
+
+	cmd := exec.Command("udhcpc", args...)
+	go c.Runner.ProcessCmd("udhcpc", cmd)
+}
+
+// StopDnsmasq stops dnsmasq.
+func (c *Command) StopDnsmasq() {
+	c.Runner.StopCmd("dnsmasq")
+}
+
+// StopBridgeDhcp stops the bridge DHCP client.
+func (c *Command) StopBridgeDhcp() {
+	c.Runner.StopCmd("udhcpc")
+}
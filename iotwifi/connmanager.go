@@ -0,0 +1,217 @@
+package iotwifi
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// Connectivity modes for ConnectivityCfg.
+const (
+	ModeApOnly      = "ap-only"
+	ModeStationOnly = "station-only"
+	ModeDual        = "dual"
+	ModeAuto        = "auto"
+)
+
+// connPollInterval is how often the station state is checked in auto mode.
+const connPollInterval = 2 * time.Second
+
+// ConnManager brings the AP and station up and down according to
+// the configured connectivity mode.
+type ConnManager struct {
+	Log     bunyan.Logger
+	WpaCfg  *WpaCfg
+	Command *Command
+
+	mu    sync.Mutex
+	apUp  bool
+	since time.Time // start of the current connected or disconnected period
+	state string
+
+	// startAp and stopAp bring the AP and the DHCP service for its
+	// clients up and down.
+	startAp func() error
+	stopAp  func()
+}
+
+// NewConnManager produces a ConnManager.
+func NewConnManager(log bunyan.Logger, wpacfg *WpaCfg, command *Command) *ConnManager {
+	m := &ConnManager{
+		Log:     log,
+		WpaCfg:  wpacfg,
+		Command: command,
+	}
+	m.startAp = m.startHostapd
+	m.stopAp = m.stopHostapd
+
+	return m
+}
+
+// Start brings up the AP and station for the configured mode. In auto
+// mode the AP is only started when no saved network connects within the
+// connect window and Start returns once that decision has been made.
+func (m *ConnManager) Start() {
+	cfg := m.WpaCfg.WpaCfg.ConnectivityCfg
+	m.Log.Info("Connectivity mode: %s", cfg.Mode)
+
+	switch cfg.Mode {
+	case ModeApOnly:
+		m.startAP()
+
+	case ModeStationOnly:
+		m.Command.StartWpaSupplicant()
+
+	case ModeAuto:
+		m.Command.StartWpaSupplicant()
+
+		window := time.Duration(cfg.ConnectWindow) * time.Second
+		deadline := time.Now().Add(window)
+		for time.Now().Before(deadline) && !m.connected() {
+			time.Sleep(connPollInterval)
+		}
+
+		if !m.connected() {
+			m.Log.Info("No saved network connected within %s, starting AP.", window)
+			m.startAP()
+		}
+
+		m.since = time.Now()
+		m.state = m.stationState()
+		go m.monitor()
+
+	default:
+		if cfg.Mode != ModeDual {
+			m.Log.Warn("Unknown connectivity mode %s, using %s.", cfg.Mode, ModeDual)
+		}
+
+		m.startAP()
+		time.Sleep(10 * time.Second)
+
+		m.Command.StartWpaSupplicant()
+
+		// Scan
+		time.Sleep(5 * time.Second)
+		m.WpaCfg.ScanNetworks()
+	}
+}
+
+// ApUp reports whether the AP is currently running.
+func (m *ConnManager) ApUp() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.apUp
+}
+
+// monitor checks the station state every poll interval.
+func (m *ConnManager) monitor() {
+	for {
+		time.Sleep(connPollInterval)
+		m.check(m.stationState(), time.Now())
+	}
+}
+
+// check stops the AP once the station has been in state COMPLETED for
+// the grace period and restarts it when the uplink has been lost for
+// too long. An AP that failed to start is tried again on the next check.
+func (m *ConnManager) check(state string, now time.Time) {
+	cfg := m.WpaCfg.WpaCfg.ConnectivityCfg
+	grace := time.Duration(cfg.ApStopGrace) * time.Second
+	lossTimeout := time.Duration(cfg.UplinkLossTimeout) * time.Second
+
+	if (state == "COMPLETED") != (m.state == "COMPLETED") {
+		m.Log.Info("Station state changed from %s to %s.", m.state, state)
+		m.since = now
+		m.WpaCfg.Prober.Trigger()
+	}
+	m.state = state
+
+	elapsed := now.Sub(m.since)
+
+	if state == "COMPLETED" && m.ApUp() && elapsed >= grace {
+		m.Log.Info("Station connected for %s, stopping AP.", elapsed)
+		m.stopAP()
+	}
+
+	if state != "COMPLETED" && !m.ApUp() && elapsed >= lossTimeout {
+		m.Log.Info("Uplink lost for %s, starting AP.", elapsed)
+		m.startAP()
+	}
+}
+
+// connected reports whether the station has completed association.
+func (m *ConnManager) connected() bool {
+	return m.stationState() == "COMPLETED"
+}
+
+// stationState returns the current wpa_state of the station.
+func (m *ConnManager) stationState() string {
+	status, err := m.WpaCfg.Status()
+	if err != nil {
+		return ""
+	}
+
+	return status["wpa_state"]
+}
+
+// startAP starts the AP unless it is up.
+func (m *ConnManager) startAP() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.apUp {
+		return
+	}
+
+	if err := m.startAp(); err != nil {
+		m.Log.Error("Could not start the AP: %s", err.Error())
+		return
+	}
+
+	m.apUp = true
+}
+
+// stopAP stops the AP if it is up.
+func (m *ConnManager) stopAP() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.apUp {
+		return
+	}
+
+	m.stopAp()
+
+	m.apUp = false
+}
+
+// startHostapd starts hostapd along with the DHCP service for its
+// clients.
+func (m *ConnManager) startHostapd() error {
+	if err := m.WpaCfg.StartAP(); err != nil {
+		return err
+	}
+
+	// in bridge mode the upstream LAN serves DHCP to AP clients
+	// so only the bridge itself needs an address.
+	if m.WpaCfg.WpaCfg.BridgeCfg.Enabled {
+		m.Command.StartBridgeDhcp()
+	} else {
+		m.Command.StartDnsmasq()
+	}
+
+	return nil
+}
+
+// stopHostapd stops hostapd and the DHCP service for its clients.
+func (m *ConnManager) stopHostapd() {
+	if m.WpaCfg.WpaCfg.BridgeCfg.Enabled {
+		m.Command.StopBridgeDhcp()
+	} else {
+		m.Command.StopDnsmasq()
+	}
+
+	m.WpaCfg.StopAP()
+}
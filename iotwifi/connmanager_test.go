@@ -0,0 +1,200 @@
+package iotwifi
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAp counts AP starts and stops, failing the first fail starts.
+type fakeAp struct {
+	mu     sync.Mutex
+	fail   int
+	starts int
+	stops  int
+}
+
+func (ap *fakeAp) start() error {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	ap.starts++
+	if ap.fail > 0 {
+		ap.fail--
+		return errors.New("hostapd did not enable the AP")
+	}
+
+	return nil
+}
+
+func (ap *fakeAp) stop() {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	ap.stops++
+}
+
+func (ap *fakeAp) counts() (int, int) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return ap.starts, ap.stops
+}
+
+// testConnManager returns a ConnManager in mode whose AP is ap and
+// whose wpa_supplicant runs through runner.
+func testConnManager(t *testing.T, mode string, ap *fakeAp) (*ConnManager, chan ProcessExit) {
+	runner, exits := testRunner(t)
+
+	wpa := testWpaCfg(t)
+	wpa.WpaCfg.ConnectivityCfg = ConnectivityCfg{
+		Mode:              mode,
+		ApStopGrace:       60,
+		UplinkLossTimeout: 30,
+	}
+
+	m := NewConnManager(wpa.Log, wpa, &Command{Log: wpa.Log, Runner: runner, SetupCfg: wpa.WpaCfg})
+	m.startAp = ap.start
+	m.stopAp = ap.stop
+
+	return m, exits
+}
+
+func TestConnManagerCheck(t *testing.T) {
+	type step struct {
+		state string
+		at    int // seconds since the manager started monitoring
+		apUp  bool
+	}
+
+	for _, tc := range []struct {
+		name   string
+		apUp   bool
+		state  string
+		fail   int
+		steps  []step
+		starts int
+		stops  int
+	}{
+		{
+			name:  "AP stopped after the grace period",
+			apUp:  true,
+			state: "SCANNING",
+			steps: []step{
+				{"COMPLETED", 0, true},
+				{"COMPLETED", 59, true},
+				{"COMPLETED", 60, false},
+				{"COMPLETED", 120, false},
+			},
+			stops: 1,
+		},
+		{
+			name:  "grace period restarted by a disconnect",
+			apUp:  true,
+			state: "SCANNING",
+			steps: []step{
+				{"COMPLETED", 0, true},
+				{"SCANNING", 30, true},
+				{"COMPLETED", 40, true},
+				{"COMPLETED", 99, true},
+				{"COMPLETED", 100, false},
+			},
+			stops: 1,
+		},
+		{
+			name:  "AP restarted after uplink loss",
+			state: "COMPLETED",
+			steps: []step{
+				{"SCANNING", 0, false},
+				{"SCANNING", 29, false},
+				{"DISCONNECTED", 30, true},
+				{"SCANNING", 60, true},
+			},
+			starts: 1,
+		},
+		{
+			name:  "brief loss does not start the AP",
+			state: "COMPLETED",
+			steps: []step{
+				{"SCANNING", 0, false},
+				{"COMPLETED", 20, false},
+				{"SCANNING", 40, false},
+				{"SCANNING", 69, false},
+				{"SCANNING", 70, true},
+			},
+			starts: 1,
+		},
+		{
+			name:  "failed AP start retried",
+			state: "COMPLETED",
+			fail:  2,
+			steps: []step{
+				{"SCANNING", 0, false},
+				{"SCANNING", 30, false},
+				{"SCANNING", 32, false},
+				{"SCANNING", 34, true},
+				{"SCANNING", 36, true},
+			},
+			starts: 3,
+		},
+	} {
+		ap := &fakeAp{fail: tc.fail}
+		m, _ := testConnManager(t, ModeAuto, ap)
+
+		start := time.Now()
+		m.apUp = tc.apUp
+		m.state = tc.state
+		m.since = start
+
+		for _, s := range tc.steps {
+			m.check(s.state, start.Add(time.Duration(s.at)*time.Second))
+			if m.ApUp() != s.apUp {
+				t.Errorf("%s: %s at %ds: AP up %t, want %t", tc.name, s.state, s.at, m.ApUp(), s.apUp)
+			}
+		}
+
+		if starts, stops := ap.counts(); starts != tc.starts || stops != tc.stops {
+			t.Errorf("%s: %d starts and %d stops, want %d and %d", tc.name, starts, stops, tc.starts, tc.stops)
+		}
+	}
+}
+
+func TestConnManagerStart(t *testing.T) {
+	_, cleanup := fakeCommand(t, "wpa_supplicant", func(string) string { return "exit 0\n" })
+	defer cleanup()
+
+	for _, tc := range []struct {
+		mode    string
+		status  string
+		station bool
+		apUp    bool
+	}{
+		{ModeApOnly, "wpa_state=COMPLETED\n", false, true},
+		{ModeStationOnly, "wpa_state=SCANNING\n", true, false},
+		{ModeAuto, "wpa_state=COMPLETED\n", true, false},
+		{ModeAuto, "wpa_state=SCANNING\n", true, true},
+	} {
+		cleanupStatus := fakeWpaStatus(t, tc.status)
+
+		ap := &fakeAp{}
+		m, exits := testConnManager(t, tc.mode, ap)
+		m.Start()
+
+		if m.ApUp() != tc.apUp {
+			t.Errorf("%s with %q: AP up %t, want %t", tc.mode, tc.status, m.ApUp(), tc.apUp)
+		}
+
+		station := false
+		select {
+		case exit := <-exits:
+			station = exit.Process == "wpa_supplicant"
+		case <-time.After(500 * time.Millisecond):
+		}
+		if station != tc.station {
+			t.Errorf("%s with %q: wpa_supplicant started %t, want %t", tc.mode, tc.status, station, tc.station)
+		}
+
+		cleanupStatus()
+	}
+}
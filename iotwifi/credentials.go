@@ -0,0 +1,123 @@
+package iotwifi
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// CredentialsError describes a credential field wpa_supplicant would
+// not accept.
+type CredentialsError struct {
+	Field   string
+	Message string
+}
+
+// Error implements error.
+func (e *CredentialsError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// ValidateCredentials checks that the ssid is 1 to 32 bytes and that
+// the psk is empty for an open network, an 8 to 63 character printable
+// ASCII passphrase or a 64 digit hex key. SAE networks need a
+// passphrase.
+func ValidateCredentials(creds WpaCredentials) error {
+	if len(creds.Ssid) < 1 || len(creds.Ssid) > 32 {
+		return &CredentialsError{Field: "ssid", Message: "must be 1 to 32 bytes"}
+	}
+
+	if creds.Sae && (creds.Psk == "" || isHexPsk(creds.Psk)) {
+		return &CredentialsError{Field: "psk", Message: "must be a passphrase for SAE networks"}
+	}
+
+	if creds.Psk == "" || isHexPsk(creds.Psk) {
+		return nil
+	}
+
+	if len(creds.Psk) < 8 || len(creds.Psk) > 63 {
+		return &CredentialsError{Field: "psk", Message: "must be 8 to 63 characters or 64 hex digits"}
+	}
+
+	for i := 0; i < len(creds.Psk); i++ {
+		if creds.Psk[i] < 0x20 || creds.Psk[i] > 0x7e {
+			return &CredentialsError{Field: "psk", Message: "must only contain printable ASCII characters"}
+		}
+	}
+
+	return nil
+}
+
+// isHexPsk reports whether a psk is a raw 256 bit key in hex.
+func isHexPsk(psk string) bool {
+	if len(psk) != 64 {
+		return false
+	}
+
+	_, err := hex.DecodeString(psk)
+	return err == nil
+}
+
+// encodeSsid formats an ssid for set_network. Plain printable ASCII is
+// quoted, anything else is passed as hex so it reaches wpa_supplicant
+// byte for byte.
+func encodeSsid(ssid string) string {
+	for i := 0; i < len(ssid); i++ {
+		if ssid[i] < 0x20 || ssid[i] > 0x7e || ssid[i] == '"' || ssid[i] == '\\' {
+			return hex.EncodeToString([]byte(ssid))
+		}
+	}
+
+	return `"` + ssid + `"`
+}
+
+// encodePsk formats a psk for set_network. A hex key is passed as is,
+// a passphrase is quoted.
+func encodePsk(psk string) string {
+	if isHexPsk(psk) {
+		return strings.ToLower(psk)
+	}
+
+	return `"` + psk + `"`
+}
+
+// decodeSsid reverses the escaping wpa_supplicant applies to ssids in
+// its scan_results, list_networks and status output.
+func decodeSsid(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	decoded := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			decoded = append(decoded, s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			decoded = append(decoded, '\n')
+		case 'r':
+			decoded = append(decoded, '\r')
+		case 't':
+			decoded = append(decoded, '\t')
+		case 'e':
+			decoded = append(decoded, 0x1b)
+		case 'x':
+			if i+2 < len(s) {
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					decoded = append(decoded, byte(b))
+					i += 2
+					continue
+				}
+			}
+			decoded = append(decoded, '\\', 'x')
+		default:
+			decoded = append(decoded, s[i])
+		}
+	}
+
+	return string(decoded)
+}
@@ -0,0 +1,100 @@
+package iotwifi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeSsid(t *testing.T) {
+	for _, tc := range []struct {
+		ssid    string
+		encoded string
+	}{
+		{"home", `"home"`},
+		{"my home network", `"my home network"`},
+		{`say "hi"`, "7361792022686922"},
+		{`back\slash`, "6261636b5c736c617368"},
+		{"café", "636166c3a9"},
+		{"tab\there", "7461620968657265"},
+		{"", `""`},
+	} {
+		if got := encodeSsid(tc.ssid); got != tc.encoded {
+			t.Errorf("encodeSsid(%q) = %s, want %s", tc.ssid, got, tc.encoded)
+		}
+	}
+}
+
+func TestDecodeSsid(t *testing.T) {
+	for _, tc := range []struct {
+		escaped string
+		ssid    string
+	}{
+		{"home", "home"},
+		{`caf\xc3\xa9`, "café"},
+		{`say \"hi\"`, `say "hi"`},
+		{`back\\slash`, `back\slash`},
+		{`tab\there`, "tab\there"},
+		{`line\nbreak`, "line\nbreak"},
+		{`esc\e`, "esc\x1b"},
+		{`short\x4`, `short\x4`},
+		{`bad\xzz`, `bad\xzz`},
+		{`trailing\`, `trailing\`},
+	} {
+		if got := decodeSsid(tc.escaped); got != tc.ssid {
+			t.Errorf("decodeSsid(%q) = %q, want %q", tc.escaped, got, tc.ssid)
+		}
+	}
+}
+
+func TestEncodePsk(t *testing.T) {
+	key := strings.Repeat("AB", 32)
+
+	for _, tc := range []struct {
+		psk     string
+		encoded string
+	}{
+		{"password1", `"password1"`},
+		{key, strings.ToLower(key)},
+		{strings.Repeat("zz", 32), `"` + strings.Repeat("zz", 32) + `"`},
+	} {
+		if got := encodePsk(tc.psk); got != tc.encoded {
+			t.Errorf("encodePsk(%q) = %s, want %s", tc.psk, got, tc.encoded)
+		}
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		creds WpaCredentials
+		field string
+	}{
+		{"wpa2", WpaCredentials{Ssid: "home", Psk: "password1"}, ""},
+		{"open", WpaCredentials{Ssid: "cafe"}, ""},
+		{"hex key", WpaCredentials{Ssid: "home", Psk: strings.Repeat("0f", 32)}, ""},
+		{"sae", WpaCredentials{Ssid: "home", Psk: "password1", Sae: true}, ""},
+		{"32 byte ssid", WpaCredentials{Ssid: strings.Repeat("s", 32)}, ""},
+		{"empty ssid", WpaCredentials{Psk: "password1"}, "ssid"},
+		{"33 byte ssid", WpaCredentials{Ssid: strings.Repeat("s", 33)}, "ssid"},
+		{"short psk", WpaCredentials{Ssid: "home", Psk: "short"}, "psk"},
+		{"long psk", WpaCredentials{Ssid: "home", Psk: strings.Repeat("p", 64)}, "psk"},
+		{"control character", WpaCredentials{Ssid: "home", Psk: "pass\nword"}, "psk"},
+		{"sae without passphrase", WpaCredentials{Ssid: "home", Sae: true}, "psk"},
+		{"sae hex key", WpaCredentials{Ssid: "home", Psk: strings.Repeat("0f", 32), Sae: true}, "psk"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateCredentials(tc.creds)
+			if tc.field == "" {
+				if err != nil {
+					t.Errorf("error %v", err)
+				}
+				return
+			}
+
+			credsErr, ok := err.(*CredentialsError)
+			if !ok || credsErr.Field != tc.field {
+				t.Errorf("error %#v, want a %s CredentialsError", err, tc.field)
+			}
+		})
+	}
+}
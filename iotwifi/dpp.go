@@ -0,0 +1,187 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProvisionDpp is the Wi-Fi Easy Connect (DPP) provisioning method.
+const ProvisionDpp = "dpp"
+
+// dppTimeout bounds how long the station listens for a configurator.
+const dppTimeout = 10 * time.Minute
+
+// DppRequest starts DPP onboarding. The station listens for a
+// configurator on Channel, 2.4 GHz channel 1 to 13, 6 when zero.
+type DppRequest struct {
+	Channel int `json:"channel"`
+}
+
+// DppStatus is the DPP bootstrap URI, to be shown as a QR code, along
+// with the status of the onboarding run.
+type DppStatus struct {
+	Uri       string          `json:"uri"`
+	Channel   int             `json:"channel"`
+	Provision ProvisionStatus `json:"provision"`
+}
+
+// ValidateDppChannel checks that a DPP listen channel is a 2.4 GHz
+// channel.
+func ValidateDppChannel(channel int) error {
+	if channel < 1 || channel > 13 {
+		return errors.New("channel must be 1 to 13")
+	}
+
+	return nil
+}
+
+// Dpp returns the DPP bootstrap URI and onboarding status.
+func (wpa *WpaCfg) Dpp() DppStatus {
+	wpa.mu.Lock()
+	status := wpa.dpp
+	wpa.mu.Unlock()
+
+	if provision := wpa.Provision(); provision.Method == ProvisionDpp {
+		status.Provision = provision
+	} else {
+		status.Provision = ProvisionStatus{State: ProvisionIdle}
+	}
+
+	return status
+}
+
+// DppStart makes the station a DPP enrollee listening for a
+// configurator. A phone scanning the returned URI as a QR code sends
+// the network configuration, which wpa_supplicant applies, connects to
+// and which is then saved.
+func (wpa *WpaCfg) DppStart(req DppRequest) (DppStatus, error) {
+	if req.Channel == 0 {
+		req.Channel = 6
+	}
+	if err := ValidateDppChannel(req.Channel); err != nil {
+		return wpa.Dpp(), err
+	}
+
+	if err := wpa.startProvision(ProvisionDpp, dppTimeout); err != nil {
+		return wpa.Dpp(), err
+	}
+
+	if err := wpa.dppBootstrap(req.Channel); err != nil {
+		wpa.finishProvision(ProvisionFailed, err.Error())
+		return wpa.Dpp(), err
+	}
+
+	// apply received configuration objects as networks and connect
+	if _, err := wpa.dppCommand("set", "dpp_config_processing", "2"); err != nil {
+		wpa.finishProvision(ProvisionFailed, err.Error())
+		return wpa.Dpp(), err
+	}
+
+	freq := strconv.Itoa(2407 + 5*req.Channel)
+	if _, err := wpa.dppCommand("dpp_listen", freq); err != nil {
+		wpa.finishProvision(ProvisionFailed, err.Error())
+		return wpa.Dpp(), err
+	}
+
+	return wpa.Dpp(), nil
+}
+
+// DppStop cancels a pending DPP run.
+func (wpa *WpaCfg) DppStop() DppStatus {
+	if wpa.Provision().Method == ProvisionDpp {
+		wpa.finishProvision(ProvisionFailed, "Cancelled")
+	}
+
+	return wpa.Dpp()
+}
+
+// dppBootstrap generates the bootstrap key and URI for a channel, reusing
+// the current one when the channel is unchanged.
+func (wpa *WpaCfg) dppBootstrap(channel int) error {
+	wpa.mu.Lock()
+	id := wpa.dppId
+	current := wpa.dpp.Channel
+	wpa.mu.Unlock()
+
+	if id != "" && current == channel {
+		return nil
+	}
+
+	if id != "" {
+		wpa.dppCommand("dpp_bootstrap_remove", id)
+	}
+
+	args := []string{"dpp_bootstrap_gen", "type=qrcode", "chan=81/" + strconv.Itoa(channel)}
+	if mac, err := ioutil.ReadFile("/sys/class/net/wlan0/address"); err == nil {
+		args = append(args, "mac="+strings.Replace(strings.TrimSpace(string(mac)), ":", "", -1))
+	}
+
+	id, err := wpa.dppCommand(args...)
+	if err != nil {
+		return err
+	}
+
+	uri, err := wpa.dppCommand("dpp_bootstrap_get_uri", id)
+	if err != nil {
+		return err
+	}
+
+	wpa.mu.Lock()
+	wpa.dppId = id
+	wpa.dpp.Uri = uri
+	wpa.dpp.Channel = channel
+	wpa.mu.Unlock()
+
+	return nil
+}
+
+// dppCommand runs a wpa_cli DPP command and returns its output.
+func (wpa *WpaCfg) dppCommand(args ...string) (string, error) {
+	out, err := exec.Command("wpa_cli", append([]string{"-i", "wlan0"}, args...)...).Output()
+	if err != nil {
+		return "", err
+	}
+
+	result := strings.TrimSpace(string(out))
+	wpa.Log.Info("WPA %s got: %s", args[0], result)
+
+	if result == "FAIL" || strings.HasPrefix(result, "FAIL-") {
+		return "", errors.New("wpa_supplicant refused " + args[0] + ": " + result)
+	}
+
+	return result, nil
+}
+
+// dppStopListen stops listening for a configurator.
+func (wpa *WpaCfg) dppStopListen() {
+	if _, err := wpa.dppCommand("dpp_stop_listen"); err != nil {
+		wpa.Log.Error("WPA dpp_stop_listen failed: %s", err.Error())
+	}
+}
+
+// handleDppMessage follows the pending DPP run in wpa_supplicant
+// output. The received network is connected to by wpa_supplicant,
+// which completes the run.
+func (wpa *WpaCfg) handleDppMessage(line string) {
+	if wpa.Provision().Method != ProvisionDpp {
+		return
+	}
+
+	switch {
+	case strings.Contains(line, "DPP-CONFOBJ-SSID "):
+		ssid := strings.TrimSpace(line[strings.Index(line, "DPP-CONFOBJ-SSID ")+len("DPP-CONFOBJ-SSID "):])
+		wpa.Log.Info("DPP configuration received for %s", ssid)
+	case strings.Contains(line, "DPP-NETWORK-ID "):
+		wpa.receiveProvision("Configuration received")
+	case strings.Contains(line, "DPP-CONF-FAILED"):
+		wpa.finishProvision(ProvisionFailed, "Configuration failed")
+	case strings.Contains(line, "DPP-NOT-COMPATIBLE"):
+		wpa.finishProvision(ProvisionFailed, "Configurator is not compatible")
+	case strings.Contains(line, "DPP-AUTH-INIT-FAILED"), strings.Contains(line, "DPP-FAIL"):
+		wpa.finishProvision(ProvisionFailed, "Authentication failed")
+	}
+}
@@ -0,0 +1,135 @@
+package iotwifi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestValidateDppChannel(t *testing.T) {
+	for _, tc := range []struct {
+		channel int
+		valid   bool
+	}{
+		{1, true},
+		{6, true},
+		{13, true},
+		{0, false},
+		{14, false},
+		{36, false},
+		{-1, false},
+	} {
+		if err := ValidateDppChannel(tc.channel); (err == nil) != tc.valid {
+			t.Errorf("ValidateDppChannel(%d) = %v, want valid %t", tc.channel, err, tc.valid)
+		}
+	}
+}
+
+func TestHandleDppMessage(t *testing.T) {
+	_, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		method  string
+		line    string
+		state   string
+		message string
+	}{
+		{ProvisionDpp, "<3>DPP-NETWORK-ID 1", ProvisionPending, "Configuration received"},
+		{ProvisionDpp, "<3>DPP-CONF-FAILED", ProvisionFailed, "Configuration failed"},
+		{ProvisionDpp, "<3>DPP-NOT-COMPATIBLE capab=0", ProvisionFailed, "Configurator is not compatible"},
+		{ProvisionDpp, "<3>DPP-AUTH-INIT-FAILED peer=1 iter=5", ProvisionFailed, "Authentication failed"},
+		{ProvisionDpp, "<3>DPP-FAIL Configurator rejected configuration", ProvisionFailed, "Authentication failed"},
+		{ProvisionDpp, "<3>DPP-CONFOBJ-SSID home", ProvisionPending, ""},
+		{ProvisionDpp, "<3>DPP-RX src=aa:bb:cc:dd:ee:01 freq=2437 type=0", ProvisionPending, ""},
+		{ProvisionWpsPbc, "<3>DPP-NETWORK-ID 1", ProvisionPending, ""},
+	} {
+		wpa := testWpaCfg(t)
+		if err := wpa.startProvision(tc.method, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		wpa.handleDppMessage(tc.line)
+
+		if status := wpa.Provision(); status.State != tc.state || status.Message != tc.message {
+			t.Errorf("%s %q: %s %q, want %s %q", tc.method, tc.line, status.State, status.Message, tc.state, tc.message)
+		}
+	}
+}
+
+func TestDppConnect(t *testing.T) {
+	calls, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	wpa := testWpaCfg(t)
+	if err := wpa.startProvision(ProvisionDpp, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"<3>DPP-CONFOBJ-SSID home",
+		"<3>DPP-NETWORK-ID 1",
+		"<3>CTRL-EVENT-CONNECTED - Connection to aa:bb:cc:dd:ee:01 completed",
+	} {
+		wpa.HandleSupplicantMessage(CmdMessage{Id: "wpa_supplicant", Message: line})
+	}
+
+	if status := wpa.Provision(); status.State != ProvisionSuccess {
+		t.Fatalf("connected status %+v", status)
+	}
+
+	wpa.completeProvision(<-wpa.provisioned)
+
+	called, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range []string{"dpp_stop_listen", "save_config"} {
+		if !bytes.Contains(called, []byte(call)) {
+			t.Errorf("%q not called, wpa_cli calls:\n%s", call, called)
+		}
+	}
+}
+
+func TestDppStart(t *testing.T) {
+	calls, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	wpa := testWpaCfg(t)
+
+	if _, err := wpa.DppStart(DppRequest{Channel: 14}); err == nil {
+		t.Error("channel 14 accepted")
+	}
+
+	status, err := wpa.DppStart(DppRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Channel != 6 || status.Provision.State != ProvisionPending {
+		t.Errorf("status %+v", status)
+	}
+
+	if _, err := wpa.DppStart(DppRequest{}); err != ErrProvisionPending {
+		t.Errorf("second run: %v, want ErrProvisionPending", err)
+	}
+
+	called, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range []string{"dpp_bootstrap_gen type=qrcode chan=81/6", "set dpp_config_processing 2", "dpp_listen 2437"} {
+		if !bytes.Contains(called, []byte(call)) {
+			t.Errorf("%q not called, wpa_cli calls:\n%s", call, called)
+		}
+	}
+
+	if status := wpa.DppStop(); status.Provision.State != ProvisionFailed || status.Provision.Message != "Cancelled" {
+		t.Errorf("stopped status %+v", status.Provision)
+	}
+
+	wpa.completeProvision(<-wpa.provisioned)
+	if called, _ := ioutil.ReadFile(calls); !bytes.Contains(called, []byte("dpp_stop_listen")) {
+		t.Error("listening not stopped")
+	}
+}
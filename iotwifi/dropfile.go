@@ -0,0 +1,254 @@
+package iotwifi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// DropResult is written next to a provisioning file once it has been
+// applied.
+type DropResult struct {
+	File      string           `json:"file"`
+	AppliedAt time.Time        `json:"applied_at"`
+	Error     string           `json:"error,omitempty"`
+	Results   []DropConnection `json:"results"`
+}
+
+// DropConnection is the outcome of one network in a provisioning file.
+type DropConnection struct {
+	Ssid       string        `json:"ssid"`
+	Connection WpaConnection `json:"connection"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// DropFile watches for a provisioning file, such as one written to the
+// boot partition before the first power on, and applies it.
+type DropFile struct {
+	Log     bunyan.Logger
+	DropCfg DropCfg
+	WpaCfg  *WpaCfg
+}
+
+// NewDropFile produces a DropFile.
+func NewDropFile(log bunyan.Logger, wpa *WpaCfg) *DropFile {
+	return &DropFile{
+		Log:     log,
+		DropCfg: wpa.WpaCfg.DropCfg,
+		WpaCfg:  wpa,
+	}
+}
+
+// Run checks for the provisioning file until the process exits.
+func (d *DropFile) Run() {
+	for {
+		d.Check()
+		time.Sleep(time.Duration(d.DropCfg.Interval) * time.Second)
+	}
+}
+
+// Check applies the provisioning file if there is one. Its networks are
+// tried in order until one connects. The file is kept for another try
+// when wpa_supplicant can not be reached.
+func (d *DropFile) Check() {
+	data, err := ioutil.ReadFile(d.DropCfg.Path)
+	if err != nil {
+		return
+	}
+
+	// nothing is added until wpa_supplicant answers
+	if !d.WpaCfg.supplicantUp() {
+		return
+	}
+
+	d.Log.Info("Applying provisioning file %s", d.DropCfg.Path)
+
+	result := DropResult{
+		File:    d.DropCfg.Path,
+		Results: []DropConnection{},
+	}
+
+	networks, err := parseDropFile(data)
+	if err != nil {
+		result.Error = err.Error()
+		networks = nil
+	}
+
+	for _, creds := range networks {
+		connection, err := d.WpaCfg.ConnectNetwork(creds)
+		if err != nil {
+			if _, invalid := err.(*CredentialsError); !invalid {
+				d.Log.Error("Provisioning file %s not applied, retrying: %s", d.DropCfg.Path, err.Error())
+				return
+			}
+		}
+
+		dropConnection := DropConnection{Ssid: creds.Ssid, Connection: connection}
+		if err != nil {
+			dropConnection.Error = err.Error()
+		}
+		result.Results = append(result.Results, dropConnection)
+
+		if connection.State == "COMPLETED" {
+			break
+		}
+	}
+
+	result.AppliedAt = time.Now()
+	d.record(result)
+	d.dispose()
+}
+
+// record writes the outcome to the result file next to the
+// provisioning file.
+func (d *DropFile) record(result DropResult) {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err := ioutil.WriteFile(d.DropCfg.Path+".result", data, 0600); err != nil {
+		d.Log.Error("Could not record provisioning result: %s", err.Error())
+	}
+}
+
+// dispose renames the provisioning file when it is to be kept, otherwise
+// overwrites it with zeros before removing it so the passphrase does not
+// linger on disk.
+func (d *DropFile) dispose() {
+	if d.DropCfg.Keep {
+		if err := os.Rename(d.DropCfg.Path, d.DropCfg.Path+".applied"); err != nil {
+			d.Log.Error("Could not rename provisioning file: %s", err.Error())
+		}
+		return
+	}
+
+	file, err := os.OpenFile(d.DropCfg.Path, os.O_WRONLY, 0)
+	if err == nil {
+		info, err := file.Stat()
+		if err == nil {
+			file.Write(make([]byte, info.Size()))
+			file.Sync()
+		}
+		file.Close()
+	}
+
+	if err := os.Remove(d.DropCfg.Path); err != nil {
+		d.Log.Error("Could not remove provisioning file: %s", err.Error())
+	}
+}
+
+// parseDropFile reads the networks in a provisioning file, either JSON
+// credentials or wpa_supplicant.conf network blocks.
+func parseDropFile(data []byte) ([]WpaCredentials, error) {
+	trimmed := bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		var networks []WpaCredentials
+		if trimmed[0] == '{' {
+			var creds WpaCredentials
+			if err := json.Unmarshal(trimmed, &creds); err != nil {
+				return nil, err
+			}
+			networks = append(networks, creds)
+		} else if err := json.Unmarshal(trimmed, &networks); err != nil {
+			return nil, err
+		}
+
+		return networks, nil
+	}
+
+	return parseNetworkBlocks(string(data))
+}
+
+// parseNetworkBlocks reads the ssid, psk, scan_ssid and key_mgmt of each
+// network={...} block in a wpa_supplicant.conf fragment. Blocks without
+// a psk are open networks.
+func parseNetworkBlocks(conf string) ([]WpaCredentials, error) {
+	networks := []WpaCredentials{}
+
+	var creds *WpaCredentials
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "network={") {
+			creds = &WpaCredentials{}
+			continue
+		}
+
+		if creds == nil {
+			continue
+		}
+
+		if line == "}" {
+			networks = append(networks, *creds)
+			creds = nil
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		value, err := confValue(kv[0], kv[1])
+		if err != nil {
+			return networks, errors.New(kv[0] + ": " + err.Error())
+		}
+
+		switch kv[0] {
+		case "ssid":
+			creds.Ssid = value
+		case "psk":
+			creds.Psk = value
+		case "scan_ssid":
+			creds.Hidden = value == "1"
+		case "key_mgmt":
+			// WPA2 transition networks take the derived key
+			creds.Sae = strings.Contains(value, "SAE") && !strings.Contains(value, "WPA-PSK")
+		}
+	}
+
+	if creds != nil {
+		return networks, errors.New("unterminated network block")
+	}
+
+	if len(networks) == 0 {
+		return networks, errors.New("no networks found")
+	}
+
+	return networks, nil
+}
+
+// confValue decodes a wpa_supplicant.conf value. Quoted values are
+// strings and an unquoted ssid is hex. Anything else, such as a 64 digit
+// hex psk, is taken as is.
+func confValue(key string, value string) (string, error) {
+	if strings.HasPrefix(value, `"`) {
+		end := strings.LastIndex(value, `"`)
+		if end < 1 {
+			return "", errors.New("unterminated string")
+		}
+		return value[1:end], nil
+	}
+
+	if key == "ssid" {
+		decoded, err := hex.DecodeString(value)
+		if err != nil {
+			return "", errors.New("unquoted ssid is not hex")
+		}
+		return string(decoded), nil
+	}
+
+	return value, nil
+}
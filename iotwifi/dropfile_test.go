@@ -0,0 +1,146 @@
+package iotwifi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDropFile(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		networks []WpaCredentials
+		fails    bool
+	}{
+		{
+			"json object",
+			`{"ssid":"home","psk":"password1"}`,
+			[]WpaCredentials{{Ssid: "home", Psk: "password1"}},
+			false,
+		},
+		{
+			"json array",
+			`[{"ssid":"home","psk":"password1"},{"ssid":"cafe"}]`,
+			[]WpaCredentials{{Ssid: "home", Psk: "password1"}, {Ssid: "cafe"}},
+			false,
+		},
+		{
+			"network blocks",
+			"# comment\nnetwork={\n  ssid=\"home\"\n  psk=\"password1\"\n  scan_ssid=1\n}\nnetwork={\n  ssid=636166c3a9\n  key_mgmt=NONE\n}\n",
+			[]WpaCredentials{{Ssid: "home", Psk: "password1", Hidden: true}, {Ssid: "café"}},
+			false,
+		},
+		{
+			"sae block",
+			"network={\n ssid=\"home\"\n psk=\"password1\"\n key_mgmt=SAE\n}",
+			[]WpaCredentials{{Ssid: "home", Psk: "password1", Sae: true}},
+			false,
+		},
+		{
+			"transition block",
+			"network={\n ssid=\"home\"\n psk=\"password1\"\n key_mgmt=WPA-PSK SAE\n}",
+			[]WpaCredentials{{Ssid: "home", Psk: "password1"}},
+			false,
+		},
+		{"bad json", `{"ssid":`, nil, true},
+		{"unterminated block", "network={\n ssid=\"home\"\n", nil, true},
+		{"unquoted ssid not hex", "network={\n ssid=home\n}", nil, true},
+		{"no networks", "# empty\n", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			networks, err := parseDropFile([]byte(tc.data))
+			if (err != nil) != tc.fails {
+				t.Fatalf("err = %v, want failure %t", err, tc.fails)
+			}
+			if !tc.fails && !reflect.DeepEqual(networks, tc.networks) {
+				t.Errorf("networks = %+v, want %+v", networks, tc.networks)
+			}
+		})
+	}
+}
+
+// testDropFile returns a DropFile watching a file in a temporary
+// directory, which the returned func removes.
+func testDropFile(t *testing.T, data string) (*DropFile, func()) {
+	dir, cleanup := testDir(t)
+
+	path := filepath.Join(dir, "iotwifi.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	wpa := testWpaCfg(t)
+	wpa.WpaCfg.DropCfg = DropCfg{Path: path}
+
+	return NewDropFile(wpa.Log, wpa), cleanup
+}
+
+func TestDropFileSupplicantDown(t *testing.T) {
+	d, cleanup := testDropFile(t, `{"ssid":"home","psk":"password1"}`)
+	defer cleanup()
+
+	// no wpa_cli on the PATH
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	defer os.Setenv("PATH", path)
+
+	d.Check()
+
+	if _, err := os.Stat(d.DropCfg.Path); err != nil {
+		t.Errorf("provisioning file not kept: %s", err)
+	}
+	if _, err := os.Stat(d.DropCfg.Path + ".result"); err == nil {
+		t.Error("result recorded while wpa_supplicant was down")
+	}
+}
+
+func TestDropFileRetry(t *testing.T) {
+	calls, cleanupCli := fakeWpaCli(t)
+	defer cleanupCli()
+
+	d, cleanup := testDropFile(t, `{"ssid":"home","psk":"password1"}`)
+	defer cleanup()
+
+	// the key is refused, so the added network is removed again and the
+	// file kept for another try
+	_, cleanupCtrl := fakeWpaCtrl(t, d.WpaCfg, "FAIL")
+	d.Check()
+	cleanupCtrl()
+
+	called, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(called, []byte("remove_network 0")) {
+		t.Errorf("network not removed, wpa_cli calls:\n%s", called)
+	}
+	if _, err := os.Stat(d.DropCfg.Path); err != nil {
+		t.Fatalf("provisioning file not kept: %s", err)
+	}
+
+	_, cleanupCtrl = fakeWpaCtrl(t, d.WpaCfg, "OK")
+	defer cleanupCtrl()
+	d.Check()
+
+	if _, err := os.Stat(d.DropCfg.Path); !os.IsNotExist(err) {
+		t.Errorf("provisioning file not removed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(d.DropCfg.Path + ".result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := DropResult{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 1 || result.Results[0].Connection.State != "COMPLETED" {
+		t.Errorf("result %+v", result)
+	}
+}
@@ -0,0 +1,92 @@
+package iotwifi
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// Event types published on the EventBus.
+const (
+	EventConnectivity        = "connectivity"
+	EventStationConnected    = "station_connected"
+	EventStationDisconnected = "station_disconnected"
+	EventProcessExited       = "process_exited"
+	EventSignalWeak          = "signal_weak"
+	EventSignalRecovered     = "signal_recovered"
+	EventConnectAttempt      = "connect_attempt"
+	EventConnectResult       = "connect_result"
+	EventApClientJoined      = "ap_client_joined"
+	EventApClientLeft        = "ap_client_left"
+	EventConfigChanged       = "config_changed"
+	EventApiRequest          = "api_request"
+	EventApiLockout          = "api_lockout"
+	EventApChannelChanged    = "ap_channel_changed"
+)
+
+// Event describes a state change of the device network.
+type Event struct {
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Message string      `json:"message"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// ProcessExit is the payload of EventProcessExited.
+type ProcessExit struct {
+	Process string `json:"process"`
+	Error   string `json:"error,omitempty"`
+	Restart bool   `json:"restart"`
+}
+
+// ApiRequest is the payload of EventApiRequest.
+type ApiRequest struct {
+	Remote string `json:"remote"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// EventBus fans events out to subscribed handlers.
+type EventBus struct {
+	Log bunyan.Logger
+
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+// NewEventBus produces an EventBus.
+func NewEventBus(log bunyan.Logger) *EventBus {
+	return &EventBus{
+		Log: log,
+	}
+}
+
+// Subscribe registers a handler for all published events. Handlers are
+// called synchronously and must not block.
+func (b *EventBus) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+// Publish sends an event to every subscribed handler.
+func (b *EventBus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	staticFields := make(map[string]interface{})
+	staticFields["event"] = event.Type
+	b.Log.Info(staticFields, event.Message)
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
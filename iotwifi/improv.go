@@ -0,0 +1,322 @@
+package iotwifi
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// Improv Wi-Fi serial packet types.
+const (
+	improvCurrentState = 0x01
+	improvErrorState   = 0x02
+	improvRpcCommand   = 0x03
+	improvRpcResult    = 0x04
+)
+
+// Improv Wi-Fi states.
+const (
+	improvReady        = 0x02
+	improvProvisioning = 0x03
+	improvProvisioned  = 0x04
+)
+
+// Improv Wi-Fi errors.
+const (
+	improvNoError        = 0x00
+	improvInvalidRpc     = 0x01
+	improvUnknownRpc     = 0x02
+	improvUnableConnect  = 0x03
+	improvUnknownFailure = 0xff
+)
+
+// Improv Wi-Fi RPC commands.
+const (
+	improvSendWifi       = 0x01
+	improvRequestState   = 0x02
+	improvRequestInfo    = 0x03
+	improvRequestScanned = 0x04
+)
+
+// improvHeader starts every Improv Wi-Fi serial packet.
+const improvHeader = "IMPROV"
+
+// improvVersion is the Improv Wi-Fi serial protocol version spoken.
+const improvVersion = 0x01
+
+// Improv provisions the station over the Improv Wi-Fi serial protocol,
+// used by Home Assistant and ESP Web Tools, on a tty such as a USB
+// serial console.
+type Improv struct {
+	Log       bunyan.Logger
+	ImprovCfg ImprovCfg
+	WpaCfg    *WpaCfg
+
+	w     io.Writer
+	state byte
+}
+
+// NewImprov produces an Improv.
+func NewImprov(log bunyan.Logger, wpa *WpaCfg) *Improv {
+	return &Improv{
+		Log:       log,
+		ImprovCfg: wpa.WpaCfg.ImprovCfg,
+		WpaCfg:    wpa,
+	}
+}
+
+// Run opens the configured tty and serves Improv on it, reopening it
+// when it goes away.
+func (i *Improv) Run() {
+	for {
+		if err := i.runTty(); err != nil {
+			i.Log.Error("Improv on %s: %s", i.ImprovCfg.Tty, err.Error())
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// runTty configures the tty for raw serial and serves Improv on it.
+func (i *Improv) runTty() error {
+	baud := strconv.Itoa(i.ImprovCfg.Baud)
+	if out, err := exec.Command("stty", "-F", i.ImprovCfg.Tty, baud, "raw", "-echo").CombinedOutput(); err != nil {
+		return errors.New("stty: " + strings.TrimSpace(string(out)))
+	}
+
+	tty, err := os.OpenFile(i.ImprovCfg.Tty, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	i.Log.Info("Improv listening on %s at %s baud", i.ImprovCfg.Tty, baud)
+
+	return i.Serve(tty)
+}
+
+// Serve answers Improv packets read from rw until it fails. Bytes that
+// are not part of a packet, such as console output, are skipped.
+func (i *Improv) Serve(rw io.ReadWriter) error {
+	i.w = rw
+	i.state = improvReady
+	if status, err := i.WpaCfg.Status(); err == nil && status["wpa_state"] == "COMPLETED" {
+		i.state = improvProvisioned
+	}
+
+	r := bufio.NewReader(rw)
+	for {
+		packetType, data, err := readImprovPacket(r)
+		if err == errImprovChecksum {
+			i.sendError(improvInvalidRpc)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if packetType != improvRpcCommand {
+			continue
+		}
+
+		i.handleRpc(data)
+	}
+}
+
+// errImprovChecksum is returned for a packet with a bad checksum.
+var errImprovChecksum = errors.New("improv packet checksum mismatch")
+
+// readImprovPacket reads the next packet, skipping anything before its
+// header.
+func readImprovPacket(r *bufio.Reader) (byte, []byte, error) {
+	matched := 0
+	for matched < len(improvHeader) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch {
+		case b == improvHeader[matched]:
+			matched++
+		case b == improvHeader[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+	}
+
+	// version, type and length
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+
+	// data and checksum
+	body := make([]byte, int(head[2])+1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	sum := improvChecksum(append(append([]byte(improvHeader), head...), body[:len(body)-1]...))
+	if sum != body[len(body)-1] {
+		return 0, nil, errImprovChecksum
+	}
+
+	return head[1], body[:len(body)-1], nil
+}
+
+// handleRpc runs an RPC command packet.
+func (i *Improv) handleRpc(data []byte) {
+	if len(data) < 2 || int(data[1]) != len(data)-2 {
+		i.sendError(improvInvalidRpc)
+		return
+	}
+
+	command := data[0]
+	args := data[2:]
+
+	switch command {
+	case improvSendWifi:
+		i.connect(args)
+
+	case improvRequestState:
+		i.sendState(i.state)
+		if i.state == improvProvisioned {
+			i.sendResult(improvRequestState, i.urls()...)
+		}
+
+	case improvRequestInfo:
+		i.sendResult(improvRequestInfo, "iotwifi", "1", runtime.GOARCH, i.ImprovCfg.DeviceName)
+
+	case improvRequestScanned:
+		networks, err := i.WpaCfg.ScanNetworks()
+		if err != nil {
+			i.sendError(improvUnknownFailure)
+			return
+		}
+
+		for _, network := range networks {
+			if network.Hidden {
+				continue
+			}
+
+			auth := "NO"
+			if strings.Contains(network.Flags, "WPA") || strings.Contains(network.Flags, "WEP") {
+				auth = "YES"
+			}
+			i.sendResult(improvRequestScanned, network.Ssid, network.SignalLevel, auth)
+		}
+
+		// an empty result ends the list
+		i.sendResult(improvRequestScanned)
+
+	default:
+		i.sendError(improvUnknownRpc)
+	}
+}
+
+// connect applies credentials received over Improv with ConnectNetwork,
+// the same path as the HTTP connect endpoint.
+func (i *Improv) connect(args []byte) {
+	ssid, rest, ok := improvString(args)
+	if !ok {
+		i.sendError(improvInvalidRpc)
+		return
+	}
+
+	psk, _, ok := improvString(rest)
+	if !ok {
+		i.sendError(improvInvalidRpc)
+		return
+	}
+
+	i.sendError(improvNoError)
+	i.sendState(improvProvisioning)
+
+	connection, err := i.WpaCfg.ConnectNetwork(WpaCredentials{Ssid: ssid, Psk: psk})
+	if err != nil || connection.State != "COMPLETED" {
+		i.state = improvReady
+		i.sendError(improvUnableConnect)
+		i.sendState(improvReady)
+		return
+	}
+
+	i.state = improvProvisioned
+	i.sendState(improvProvisioned)
+	i.sendResult(improvSendWifi, i.urls()...)
+}
+
+// urls returns the redirect URL for a provisioned device, the
+// configured url with {ip} replaced by the station address.
+func (i *Improv) urls() []string {
+	if i.ImprovCfg.Url == "" {
+		return nil
+	}
+
+	ip := ""
+	if status, err := i.WpaCfg.Status(); err == nil {
+		ip = status["ip_address"]
+	}
+
+	return []string{strings.Replace(i.ImprovCfg.Url, "{ip}", ip, -1)}
+}
+
+// improvString reads a length prefixed string.
+func improvString(data []byte) (string, []byte, bool) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, false
+	}
+
+	end := 1 + int(data[0])
+	return string(data[1:end]), data[end:], true
+}
+
+// sendState sends a current state packet.
+func (i *Improv) sendState(state byte) {
+	i.send(improvCurrentState, []byte{state})
+}
+
+// sendError sends an error state packet.
+func (i *Improv) sendError(code byte) {
+	i.send(improvErrorState, []byte{code})
+}
+
+// sendResult sends an RPC result packet with length prefixed strings.
+func (i *Improv) sendResult(command byte, values ...string) {
+	payload := []byte{}
+	for _, value := range values {
+		payload = append(payload, byte(len(value)))
+		payload = append(payload, value...)
+	}
+
+	i.send(improvRpcResult, append([]byte{command, byte(len(payload))}, payload...))
+}
+
+// send writes a packet followed by a newline.
+func (i *Improv) send(packetType byte, data []byte) {
+	packet := append([]byte(improvHeader), improvVersion, packetType, byte(len(data)))
+	packet = append(packet, data...)
+	packet = append(packet, improvChecksum(packet), '\n')
+
+	if _, err := i.w.Write(packet); err != nil {
+		i.Log.Error("Improv write failed: %s", err.Error())
+	}
+}
+
+// improvChecksum is the sum of the packet bytes.
+func improvChecksum(packet []byte) byte {
+	var sum byte
+	for _, b := range packet {
+		sum += b
+	}
+
+	return sum
+}
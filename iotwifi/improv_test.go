@@ -0,0 +1,277 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// improvPacket builds a serial packet with its checksum.
+func improvPacket(packetType byte, data []byte) []byte {
+	packet := append([]byte(improvHeader), improvVersion, packetType, byte(len(data)))
+	packet = append(packet, data...)
+
+	return append(packet, improvChecksum(packet))
+}
+
+// badChecksum returns a copy of a packet with a wrong checksum.
+func badChecksum(packet []byte) []byte {
+	bad := append([]byte{}, packet...)
+	bad[len(bad)-1]++
+
+	return bad
+}
+
+// improvRpc builds an RPC command packet.
+func improvRpc(command byte, args ...string) []byte {
+	data := []byte{}
+	for _, arg := range args {
+		data = append(data, byte(len(arg)))
+		data = append(data, arg...)
+	}
+
+	return improvPacket(improvRpcCommand, append([]byte{command, byte(len(data))}, data...))
+}
+
+// improvResult is the data of an RPC result packet.
+func improvResult(command byte, values ...string) []byte {
+	payload := []byte{}
+	for _, value := range values {
+		payload = append(payload, byte(len(value)))
+		payload = append(payload, value...)
+	}
+
+	return append([]byte{command, byte(len(payload))}, payload...)
+}
+
+// testImprovSession is the host side of an Improv serial session.
+type testImprovSession struct {
+	t     *testing.T
+	in    *io.PipeWriter
+	out   *bufio.Reader
+	serve chan error
+}
+
+// startImprov serves Improv on a pipe.
+func startImprov(t *testing.T, improv *Improv) *testImprovSession {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	s := &testImprovSession{t: t, in: inW, out: bufio.NewReader(outR), serve: make(chan error, 1)}
+	go func() {
+		s.serve <- improv.Serve(struct {
+			io.Reader
+			io.Writer
+		}{inR, outW})
+		outW.Close()
+	}()
+
+	return s
+}
+
+// send writes raw bytes to the device.
+func (s *testImprovSession) send(data []byte) {
+	if _, err := s.in.Write(data); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// expect reads the next packet and checks it.
+func (s *testImprovSession) expect(packetType byte, data []byte) {
+	type packet struct {
+		packetType byte
+		data       []byte
+		err        error
+	}
+	read := make(chan packet, 1)
+	go func() {
+		packetType, data, err := readImprovPacket(s.out)
+		read <- packet{packetType, data, err}
+	}()
+
+	select {
+	case got := <-read:
+		if got.err != nil {
+			s.t.Fatalf("reading packet %x: %s", packetType, got.err)
+		}
+		if got.packetType != packetType || !bytes.Equal(got.data, data) {
+			s.t.Fatalf("packet %x % x, want %x % x", got.packetType, got.data, packetType, data)
+		}
+	case <-time.After(10 * time.Second):
+		s.t.Fatalf("no packet %x % x", packetType, data)
+	}
+}
+
+// close ends the session and checks that Serve returned.
+func (s *testImprovSession) close() {
+	s.in.Close()
+
+	select {
+	case err := <-s.serve:
+		if err != io.EOF {
+			s.t.Errorf("Serve returned %v, want EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		s.t.Error("Serve did not return at the end of input")
+	}
+}
+
+// testImprov returns an Improv on a WpaCfg using the fake wpa_cli and
+// a fake control socket, whose commands are sent on the returned channel.
+func testImprov(t *testing.T) (*Improv, chan string, func()) {
+	wpa := testWpaCfg(t)
+	wpa.WpaCfg.ImprovCfg = ImprovCfg{Url: "http://{ip}:8080/v1/status", DeviceName: "dev"}
+	commands, cleanup := fakeWpaCtrl(t, wpa, "OK")
+
+	return NewImprov(wpa.Log, wpa), commands, cleanup
+}
+
+func TestReadImprovPacket(t *testing.T) {
+	packet := improvPacket(improvRpcCommand, []byte{improvRequestState, 0x00})
+
+	// console output and a partial header before the packet are skipped
+	r := bufio.NewReader(bytes.NewReader(append([]byte("login: IMPRIMPROV"), packet[len("IMPROV"):]...)))
+	packetType, data, err := readImprovPacket(r)
+	if err != nil || packetType != improvRpcCommand || !bytes.Equal(data, []byte{improvRequestState, 0x00}) {
+		t.Errorf("readImprovPacket() = %x % x %v", packetType, data, err)
+	}
+
+	bad := badChecksum(packet)
+	if _, _, err := readImprovPacket(bufio.NewReader(bytes.NewReader(bad))); err != errImprovChecksum {
+		t.Errorf("bad checksum: %v", err)
+	}
+
+	if _, _, err := readImprovPacket(bufio.NewReader(bytes.NewReader(packet[:len(packet)-2]))); err == nil {
+		t.Error("short packet: no error")
+	}
+}
+
+func TestImprovRpcErrors(t *testing.T) {
+	_, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	improv, _, cleanupCtrl := testImprov(t)
+	defer cleanupCtrl()
+
+	s := startImprov(t, improv)
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		code   byte
+	}{
+		{"bad checksum", badChecksum(improvRpc(improvRequestState)), improvInvalidRpc},
+		{"bad rpc length", improvPacket(improvRpcCommand, []byte{improvRequestState, 0x05}), improvInvalidRpc},
+		{"unknown rpc", improvRpc(0x7f), improvUnknownRpc},
+		{"wifi settings without psk", improvRpc(improvSendWifi, "home"), improvInvalidRpc},
+	} {
+		s.send(tc.packet)
+		s.expect(improvErrorState, []byte{tc.code})
+	}
+
+	// packets other than RPC commands are ignored
+	s.send(improvPacket(improvCurrentState, []byte{improvReady}))
+	s.send(improvRpc(improvRequestInfo))
+	s.expect(improvRpcResult, improvResult(improvRequestInfo, "iotwifi", "1", runtime.GOARCH, "dev"))
+
+	s.close()
+}
+
+func TestImprovWifiSettings(t *testing.T) {
+	calls, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	improv, commands, cleanupCtrl := testImprov(t)
+	defer cleanupCtrl()
+
+	s := startImprov(t, improv)
+
+	s.send(improvRpc(improvRequestState))
+	s.expect(improvCurrentState, []byte{improvReady})
+
+	s.send(improvRpc(improvSendWifi, "home", "password1"))
+	s.expect(improvErrorState, []byte{improvNoError})
+	s.expect(improvCurrentState, []byte{improvProvisioning})
+	s.expect(improvCurrentState, []byte{improvProvisioned})
+	s.expect(improvRpcResult, improvResult(improvSendWifi, "http://192.168.1.20:8080/v1/status"))
+
+	s.send(improvRpc(improvRequestState))
+	s.expect(improvCurrentState, []byte{improvProvisioned})
+	s.expect(improvRpcResult, improvResult(improvRequestState, "http://192.168.1.20:8080/v1/status"))
+
+	s.close()
+
+	// the credentials went through ConnectNetwork
+	called, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(called, []byte("set_network 0 ssid "+encodeSsid("home"))) {
+		t.Errorf("ssid not set, wpa_cli calls:\n%s", called)
+	}
+
+	// the key went over the control socket, not the command line
+	if command := <-commands; command != "SET_NETWORK 0 psk "+DerivePsk("home", "password1") {
+		t.Errorf("control socket got %q", command)
+	}
+	if bytes.Contains(called, []byte(DerivePsk("home", "password1"))) {
+		t.Errorf("key passed to wpa_cli:\n%s", called)
+	}
+}
+
+func TestImprovUnableToConnect(t *testing.T) {
+	_, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	improv, _, cleanupCtrl := testImprov(t)
+	defer cleanupCtrl()
+
+	s := startImprov(t, improv)
+
+	// a passphrase too short for WPA2 is rejected by ConnectNetwork
+	s.send(improvRpc(improvSendWifi, "home", "short"))
+	s.expect(improvErrorState, []byte{improvNoError})
+	s.expect(improvCurrentState, []byte{improvProvisioning})
+	s.expect(improvErrorState, []byte{improvUnableConnect})
+	s.expect(improvCurrentState, []byte{improvReady})
+
+	s.send(improvRpc(improvRequestState))
+	s.expect(improvCurrentState, []byte{improvReady})
+
+	s.close()
+}
+
+func TestImprovScan(t *testing.T) {
+	_, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	improv, _, cleanupCtrl := testImprov(t)
+	defer cleanupCtrl()
+
+	s := startImprov(t, improv)
+
+	s.send(improvRpc(improvRequestScanned))
+	got := map[string][]byte{}
+	for range []string{"home", "cafe"} {
+		packetType, data, err := readImprovPacket(s.out)
+		if err != nil || packetType != improvRpcResult {
+			t.Fatalf("scan result %x % x %v", packetType, data, err)
+		}
+		ssid, _, _ := improvString(data[2:])
+		got[ssid] = data
+	}
+
+	if want := improvResult(improvRequestScanned, "home", "-40", "YES"); !bytes.Equal(got["home"], want) {
+		t.Errorf("home % x, want % x", got["home"], want)
+	}
+	if want := improvResult(improvRequestScanned, "cafe", "-70", "NO"); !bytes.Equal(got["cafe"], want) {
+		t.Errorf("cafe % x, want % x", got["cafe"], want)
+	}
+	s.expect(improvRpcResult, improvResult(improvRequestScanned))
+
+	s.close()
+}
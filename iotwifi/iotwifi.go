@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/bhoriuchi/go-bunyan/bunyan"
@@ -24,8 +25,20 @@ type CmdRunner struct {
 	Messages chan CmdMessage
 	Handlers map[string]func(CmdMessage)
 	Commands map[string]*exec.Cmd
+	Events   *EventBus
+
+	mu   sync.Mutex
+	done map[string]chan struct{}
 }
 
+// restartDelay is how long the CmdRunner waits before restarting
+// a command that failed, doubling up to maxRestartDelay while it
+// keeps failing.
+const (
+	restartDelay    = 5 * time.Second
+	maxRestartDelay = time.Minute
+)
+
 // CmdMessage structures command output.
 type CmdMessage struct {
 	Id      string
@@ -71,27 +84,25 @@ func loadCfg(cfgLocation string) (*SetupCfg, error) {
 	}
 
 	err := json.Unmarshal(jsonData, v)
+	v.setDefaults()
 
 	return v, err
 }
 
 // RunWifi starts AP and Station modes.
-func RunWifi(log bunyan.Logger, messages chan CmdMessage, cfgLocation string) {
+func RunWifi(log bunyan.Logger, messages chan CmdMessage, wpacfg *WpaCfg) {
 
 	log.Info("Loading IoT Wifi...")
 
-	cmdRunner := CmdRunner{
+	cmdRunner := &CmdRunner{
 		Log:      log,
 		Messages: messages,
 		Handlers: make(map[string]func(cmsg CmdMessage), 0),
 		Commands: make(map[string]*exec.Cmd, 0),
+		Events:   wpacfg.Events,
 	}
 
-	setupCfg, err := loadCfg(cfgLocation)
-	if err != nil {
-		log.Error("Could not load config: %s", err.Error())
-		return
-	}
+	setupCfg := wpacfg.WpaCfg
 
 	command := &Command{
 		Log:      log,
@@ -105,27 +116,52 @@ func RunWifi(log bunyan.Logger, messages chan CmdMessage, cfgLocation string) {
 		os.Exit(1)
 	})
 
-	wpacfg := NewWpaCfg(log, cfgLocation)
-	wpacfg.StartAP()
+	// publish station events from wpa_supplicant output
+	cmdRunner.HandleFunc("wpa_supplicant", wpacfg.HandleSupplicantMessage)
 
-	time.Sleep(10 * time.Second)
-
-	command.StartWpaSupplicant()
+	if err := wpacfg.ApplyCountry(); err != nil {
+		log.Error("Regulatory domain: %s", err.Error())
+	}
 
-	// Scan
-	time.Sleep(5 * time.Second)
-	wpacfg.ScanNetworks()
+	// the station and AP interfaces have to be on their PHYs before
+	// wpa_supplicant and hostapd start
+	if _, err := wpacfg.PlaceRadios(); err != nil {
+		log.Error("Radio placement: %s", err.Error())
+	}
 
-	command.StartDnsmasq()
+	manager := NewConnManager(log, wpacfg, command)
+	manager.Start()
 
 	// TODO: check to see if we are stuck in a scanning state before
 	// if in a scanning state set a timeout before resetting
-	go func() {
-		for {
-			wpacfg.ScanNetworks()
-			time.Sleep(30 * time.Second)
+	if setupCfg.ConnectivityCfg.Mode != ModeApOnly {
+		go wpacfg.Prober.Run()
+		go wpacfg.Link.Run()
+		go wpacfg.FollowStation()
+		go wpacfg.CompleteProvisions()
+		go NewDropFile(log, wpacfg).Run()
+
+		if setupCfg.ImprovCfg.Tty != "" {
+			go NewImprov(log, wpacfg).Run()
 		}
-	}()
+
+		go func() {
+			for {
+				wpacfg.ScanNetworks()
+				time.Sleep(30 * time.Second)
+			}
+		}()
+	}
+
+	if setupCfg.MqttCfg.Broker != "" {
+		go NewMqttClient(log, wpacfg, messages).Run()
+	}
+
+	if len(setupCfg.WebhookCfg.Hooks) > 0 {
+		webhooks := NewWebhooks(log, setupCfg.WebhookCfg)
+		wpacfg.Events.Subscribe(webhooks.Enqueue)
+		go webhooks.Run()
+	}
 
 	// staticFields for logger
 	staticFields := make(map[string]interface{})
@@ -153,25 +189,50 @@ func (c *CmdRunner) HandleFunc(cmdId string, handler func(cmdMessage CmdMessage)
 	c.Handlers[cmdId] = handler
 }
 
-// ProcessCmd processes an internal command.
+// ProcessCmd processes an internal command. A command that fails to
+// start or exits with an error is restarted until it is stopped with
+// StopCmd, one that exits cleanly is not.
 func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) {
 	c.Log.Debug("ProcessCmd got %s", id)
 
 	// add command to the commands map TODO close the readers
+	c.mu.Lock()
 	c.Commands[id] = cmd
+	c.mu.Unlock()
+
+	c.run(id, cmd, restartDelay)
+}
+
+// run starts a command registered by ProcessCmd and supervises it,
+// delay being the wait before restarting it.
+func (c *CmdRunner) run(id string, cmd *exec.Cmd, delay time.Duration) {
+	done := make(chan struct{})
+
+	c.mu.Lock()
+	if c.done == nil {
+		c.done = make(map[string]chan struct{}, 0)
+	}
+	c.done[id] = done
+	c.mu.Unlock()
+
+	var output sync.WaitGroup
+	output.Add(2)
 
 	cmdStdoutReader, err := cmd.StdoutPipe()
 	if err != nil {
-		panic(err)
+		c.startFailed(id, cmd, done, delay, err)
+		return
 	}
 
 	cmdStderrReader, err := cmd.StderrPipe()
 	if err != nil {
-		panic(err)
+		c.startFailed(id, cmd, done, delay, err)
+		return
 	}
 
 	stdOutScanner := bufio.NewScanner(cmdStdoutReader)
 	go func() {
+		defer output.Done()
 		for stdOutScanner.Scan() {
 			c.Messages <- CmdMessage{
 				Id:      id,
@@ -185,6 +246,7 @@ func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) {
 
 	stdErrScanner := bufio.NewScanner(cmdStderrReader)
 	go func() {
+		defer output.Done()
 		for stdErrScanner.Scan() {
 			c.Messages <- CmdMessage{
 				Id:      id,
@@ -196,9 +258,118 @@ func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) {
 		}
 	}()
 
-	err = cmd.Start()
+	// the pipes are closed when Start fails, which ends the scanners
+	if err := cmd.Start(); err != nil {
+		c.startFailed(id, cmd, done, delay, err)
+		return
+	}
+
+	go c.supervise(id, cmd, &output, done, delay)
+}
+
+// startFailed logs a command that could not be started and retries it.
+func (c *CmdRunner) startFailed(id string, cmd *exec.Cmd, done chan struct{}, delay time.Duration, err error) {
+	close(done)
 
+	c.Log.Error("Could not start %s: %s, retrying in %s", id, err.Error(), delay)
+	go c.restart(id, cmd, delay)
+}
+
+// supervise waits for a command to exit and restarts it unless it
+// exited cleanly or was stopped with StopCmd.
+func (c *CmdRunner) supervise(id string, cmd *exec.Cmd, output *sync.WaitGroup, done chan struct{}, delay time.Duration) {
+	started := time.Now()
+
+	output.Wait()
+	err := cmd.Wait()
+	close(done)
+
+	c.mu.Lock()
+	restart := c.Commands[id] == cmd && err != nil
+	if c.Commands[id] == cmd && err == nil {
+		delete(c.Commands, id)
+		delete(c.done, id)
+	}
+	c.mu.Unlock()
+
+	exit := ProcessExit{
+		Process: id,
+		Restart: restart,
+	}
 	if err != nil {
-		panic(err)
+		exit.Error = err.Error()
+	}
+
+	if c.Events != nil {
+		c.Events.Publish(Event{
+			Type:    EventProcessExited,
+			Message: "Process " + id + " exited",
+			Payload: exit,
+		})
 	}
+
+	if !restart {
+		return
+	}
+
+	// a command that ran for a while starts over with the short delay
+	if time.Since(started) > maxRestartDelay {
+		delay = restartDelay
+	}
+
+	c.Log.Error("Process %s exited: %s, restarting in %s", id, err.Error(), delay)
+	c.restart(id, cmd, delay)
+}
+
+// restart runs a copy of cmd after delay unless it was stopped in the
+// meantime, doubling the delay for the next restart.
+func (c *CmdRunner) restart(id string, cmd *exec.Cmd, delay time.Duration) {
+	time.Sleep(delay)
+
+	next := &exec.Cmd{
+		Path: cmd.Path,
+		Args: cmd.Args,
+		Env:  cmd.Env,
+		Dir:  cmd.Dir,
+	}
+
+	// stopped while waiting to restart
+	c.mu.Lock()
+	restart := c.Commands[id] == cmd
+	if restart {
+		c.Commands[id] = next
+	}
+	c.mu.Unlock()
+
+	if !restart {
+		return
+	}
+
+	delay *= 2
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+
+	c.run(id, next, delay)
+}
+
+// StopCmd kills a command started with ProcessCmd and waits for it
+// to exit. It must not be called from a handler, or from anything a
+// handler calls, since the exit is only seen once the command's output
+// has drained into Messages, which the handlers are run from.
+func (c *CmdRunner) StopCmd(id string) {
+	c.mu.Lock()
+	cmd, ok := c.Commands[id]
+	done := c.done[id]
+	delete(c.Commands, id)
+	delete(c.done, id)
+	c.mu.Unlock()
+
+	if !ok || cmd.Process == nil {
+		return
+	}
+
+	c.Log.Debug("StopCmd got %s", id)
+	cmd.Process.Kill()
+	<-done
 }
@@ -0,0 +1,231 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// testLogger returns a logger that discards its output.
+func testLogger(t *testing.T) bunyan.Logger {
+	log, err := bunyan.CreateLogger(bunyan.Config{
+		Name:   "iotwifi-test",
+		Stream: ioutil.Discard,
+		Level:  bunyan.LogLevelFatal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return log
+}
+
+// testDir creates a temporary directory, which the returned func
+// removes.
+func testDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "iotwifi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// fakeCommand writes a shell script called name to a temporary
+// directory put first on the PATH. It returns the directory and a func
+// restoring the PATH and removing the directory.
+func fakeCommand(t *testing.T, name string, script func(dir string) string) (string, func()) {
+	dir, cleanup := testDir(t)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script(dir)), 0755); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	return dir, func() {
+		os.Setenv("PATH", path)
+		cleanup()
+	}
+}
+
+// testWpaCfg returns a WpaCfg with an empty configuration whose
+// commands fail on a machine without wpa_supplicant.
+func testWpaCfg(t *testing.T) *WpaCfg {
+	log := testLogger(t)
+	events := NewEventBus(log)
+
+	return &WpaCfg{
+		Log:     log,
+		WpaCfg:  &SetupCfg{},
+		Events:  events,
+		Prober:  NewProber(log, ProbeCfg{}, events),
+		Metrics: NewMetrics(),
+
+		provisioned: make(chan ProvisionStatus, 4),
+	}
+}
+
+// fakeWpaCli puts a wpa_cli shell script on the PATH that answers
+// status with wpa_state=COMPLETED once enable_network ran, ping with
+// PONG and OK to anything else. The arguments of every call are
+// appended to the file whose path is returned. The returned func
+// restores the PATH.
+func fakeWpaCli(t *testing.T) (string, func()) {
+	dir, cleanup := fakeCommand(t, "wpa_cli", func(dir string) string {
+		return strings.Join([]string{
+			`echo "$@" >> ` + filepath.Join(dir, "calls"),
+			`case "$3" in`,
+			`add_network) echo 0;;`,
+			`ping) echo PONG;;`,
+			`enable_network) touch ` + filepath.Join(dir, "enabled") + `; echo OK;;`,
+			`status) if [ -f ` + filepath.Join(dir, "enabled") + ` ]; then printf 'wpa_state=COMPLETED\nip_address=192.168.1.20\n'; else printf 'wpa_state=SCANNING\n'; fi;;`,
+			`scan_results) printf 'bssid / frequency / signal level / flags / ssid\naa:bb:cc:dd:ee:01\t2412\t-40\t[WPA2-PSK-CCMP][ESS]\thome\naa:bb:cc:dd:ee:02\t2437\t-70\t[ESS]\tcafe\n';;`,
+			`*) echo OK;;`,
+			"esac",
+			"",
+		}, "\n")
+	})
+
+	return filepath.Join(dir, "calls"), cleanup
+}
+
+// fakeWpaCtrl serves a wpa_supplicant control socket for wlan0 in a
+// temporary ctrl_interface directory set on wpa. Every command is sent
+// on the returned channel and answered with reply.
+func fakeWpaCtrl(t *testing.T, wpa *WpaCfg, reply string) (chan string, func()) {
+	dir, cleanup := testDir(t)
+	wpa.WpaCfg.WpaSupplicantCfg.CtrlInterface = dir
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "wlan0"), Net: "unixgram"})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	commands := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			commands <- string(buf[:n])
+			conn.WriteToUnix([]byte(reply+"\n"), addr)
+		}
+	}()
+
+	return commands, func() {
+		conn.Close()
+		cleanup()
+	}
+}
+
+// testRunner returns a CmdRunner whose exit events are sent on exits.
+func testRunner(t *testing.T) (*CmdRunner, chan ProcessExit) {
+	log := testLogger(t)
+	events := NewEventBus(log)
+
+	exits := make(chan ProcessExit, 10)
+	events.Subscribe(func(event Event) {
+		if exit, ok := event.Payload.(ProcessExit); ok {
+			exits <- exit
+		}
+	})
+
+	messages := make(chan CmdMessage, 100)
+	go func() {
+		for range messages {
+		}
+	}()
+
+	return &CmdRunner{
+		Log:      log,
+		Messages: messages,
+		Handlers: make(map[string]func(CmdMessage), 0),
+		Commands: make(map[string]*exec.Cmd, 0),
+		Events:   events,
+	}, exits
+}
+
+func TestCmdRunnerCleanExit(t *testing.T) {
+	runner, exits := testRunner(t)
+
+	runner.ProcessCmd("true", exec.Command("true"))
+
+	select {
+	case exit := <-exits:
+		if exit.Restart || exit.Error != "" {
+			t.Fatalf("clean exit got %+v", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no exit event")
+	}
+
+	runner.mu.Lock()
+	_, ok := runner.Commands["true"]
+	runner.mu.Unlock()
+	if ok {
+		t.Error("cleanly exited command is still registered")
+	}
+}
+
+func TestCmdRunnerFailedExit(t *testing.T) {
+	runner, exits := testRunner(t)
+
+	runner.ProcessCmd("false", exec.Command("false"))
+
+	select {
+	case exit := <-exits:
+		if !exit.Restart || exit.Error == "" {
+			t.Fatalf("failed exit got %+v", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no exit event")
+	}
+
+	// stopping while the restart is pending cancels it
+	runner.StopCmd("false")
+
+	runner.mu.Lock()
+	_, ok := runner.Commands["false"]
+	runner.mu.Unlock()
+	if ok {
+		t.Error("stopped command is still registered")
+	}
+}
+
+func TestCmdRunnerStartFailure(t *testing.T) {
+	runner, _ := testRunner(t)
+
+	runner.ProcessCmd("missing", exec.Command("/nonexistent/iotwifi-test"))
+
+	runner.mu.Lock()
+	_, ok := runner.Commands["missing"]
+	runner.mu.Unlock()
+	if !ok {
+		t.Fatal("command that failed to start is not kept for a retry")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runner.StopCmd("missing")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopCmd blocked on a command that never started")
+	}
+}
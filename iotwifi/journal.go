@@ -0,0 +1,172 @@
+package iotwifi
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// JournalQuery filters journal entries. Zero values match everything.
+type JournalQuery struct {
+	Since time.Time
+	Until time.Time
+	Types []string
+	Limit int
+}
+
+// Journal persists events as JSON lines with secrets redacted. When the
+// file grows past the configured size it is rotated to a single backup.
+type Journal struct {
+	Log        bunyan.Logger
+	JournalCfg JournalCfg
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewJournal produces a Journal.
+func NewJournal(log bunyan.Logger, journalCfg JournalCfg) *Journal {
+	return &Journal{
+		Log:        log,
+		JournalCfg: journalCfg,
+	}
+}
+
+// Record appends an event to the journal.
+func (j *Journal) Record(event Event) {
+	if j.JournalCfg.Path == "" {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Payload = redact(event.Payload)
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		j.Log.Error("Journal could not encode event: %s", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		if err := j.open(); err != nil {
+			j.Log.Error("Journal could not open %s: %s", j.JournalCfg.Path, err.Error())
+			return
+		}
+	}
+
+	if j.size > 0 && j.size+int64(len(line)) > j.JournalCfg.MaxSize {
+		if err := j.rotate(); err != nil {
+			j.Log.Error("Journal could not rotate %s: %s", j.JournalCfg.Path, err.Error())
+			return
+		}
+	}
+
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		j.Log.Error("Journal could not write: %s", err.Error())
+	}
+}
+
+// Query returns the journal entries matching q, oldest first. When a
+// limit is set the most recent entries are returned.
+func (j *Journal) Query(q JournalQuery) ([]Event, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	types := make(map[string]bool, 0)
+	for _, t := range q.Types {
+		types[t] = true
+	}
+
+	events := []Event{}
+	for _, path := range []string{j.JournalCfg.Path + ".1", j.JournalCfg.Path} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return events, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+
+			if !q.Since.IsZero() && event.Time.Before(q.Since) {
+				continue
+			}
+			if !q.Until.IsZero() && event.Time.After(q.Until) {
+				continue
+			}
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+
+			events = append(events, event)
+		}
+		file.Close()
+
+		if err := scanner.Err(); err != nil {
+			return events, err
+		}
+	}
+
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+
+	return events, nil
+}
+
+// open opens the journal file for appending.
+func (j *Journal) open() error {
+	if err := os.MkdirAll(filepath.Dir(j.JournalCfg.Path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.JournalCfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	j.file = file
+	j.size = info.Size()
+
+	return nil
+}
+
+// rotate moves the current journal file to the backup and opens
+// a new one.
+func (j *Journal) rotate() error {
+	j.file.Close()
+	j.file = nil
+
+	if err := os.Rename(j.JournalCfg.Path, j.JournalCfg.Path+".1"); err != nil {
+		return err
+	}
+
+	return j.open()
+}
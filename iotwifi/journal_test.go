@@ -0,0 +1,155 @@
+package iotwifi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testJournal returns a Journal writing to a temporary directory, which
+// the returned func removes.
+func testJournal(t *testing.T, maxSize int64) (*Journal, func()) {
+	dir, cleanup := testDir(t)
+
+	journal := NewJournal(testLogger(t), JournalCfg{
+		Path:    filepath.Join(dir, "journal", "journal.jsonl"),
+		MaxSize: maxSize,
+	})
+
+	return journal, func() {
+		journal.mu.Lock()
+		if journal.file != nil {
+			journal.file.Close()
+		}
+		journal.mu.Unlock()
+		cleanup()
+	}
+}
+
+func TestJournalQuery(t *testing.T) {
+	journal, cleanup := testJournal(t, 1048576)
+	defer cleanup()
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	types := []string{EventConnectAttempt, EventConnectResult, EventSignalWeak, EventConnectAttempt, EventConnectResult}
+	for i, eventType := range types {
+		journal.Record(Event{
+			Type:    eventType,
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Message: eventType + " " + strconv.Itoa(i),
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		query    JournalQuery
+		messages []string
+	}{
+		{"all", JournalQuery{}, []string{"connect_attempt 0", "connect_result 1", "signal_weak 2", "connect_attempt 3", "connect_result 4"}},
+		{"since", JournalQuery{Since: start.Add(3 * time.Minute)}, []string{"connect_attempt 3", "connect_result 4"}},
+		{"until", JournalQuery{Until: start.Add(time.Minute)}, []string{"connect_attempt 0", "connect_result 1"}},
+		{"window", JournalQuery{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{"connect_result 1", "signal_weak 2", "connect_attempt 3"}},
+		{"types", JournalQuery{Types: []string{EventConnectResult, EventSignalWeak}}, []string{"connect_result 1", "signal_weak 2", "connect_result 4"}},
+		{"limit keeps the latest", JournalQuery{Limit: 2}, []string{"connect_attempt 3", "connect_result 4"}},
+		{"limit above count", JournalQuery{Limit: 10}, []string{"connect_attempt 0", "connect_result 1", "signal_weak 2", "connect_attempt 3", "connect_result 4"}},
+		{"types and limit", JournalQuery{Types: []string{EventConnectAttempt}, Limit: 1}, []string{"connect_attempt 3"}},
+		{"no match", JournalQuery{Types: []string{EventApiLockout}}, []string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := journal.Query(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := []string{}
+			for _, event := range events {
+				messages = append(messages, event.Message)
+			}
+			if !reflect.DeepEqual(messages, tc.messages) {
+				t.Errorf("messages %v, want %v", messages, tc.messages)
+			}
+		})
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	journal, cleanup := testJournal(t, 400)
+	defer cleanup()
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		journal.Record(Event{
+			Type:    EventConnectAttempt,
+			Time:    start.Add(time.Duration(i) * time.Second),
+			Message: "attempt",
+		})
+	}
+
+	path := journal.JournalCfg.Path
+	for _, file := range []string{path, path + ".1"} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > journal.JournalCfg.MaxSize {
+			t.Errorf("%s is %d bytes, over %d", file, info.Size(), journal.JournalCfg.MaxSize)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); err == nil {
+		t.Error("more than one backup kept")
+	}
+
+	// the query reads the backup then the current file, oldest first
+	events, err := journal.Query(JournalQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || len(events) >= 20 {
+		t.Fatalf("%d events after rotation", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i].Time.After(events[i-1].Time) {
+			t.Fatalf("events out of order at %d: %v after %v", i, events[i].Time, events[i-1].Time)
+		}
+	}
+	if last := events[len(events)-1].Time; !last.Equal(start.Add(19 * time.Second)) {
+		t.Errorf("latest event at %v", last)
+	}
+}
+
+func TestJournalRedacts(t *testing.T) {
+	journal, cleanup := testJournal(t, 1048576)
+	defer cleanup()
+
+	journal.Record(Event{
+		Type:    EventConnectAttempt,
+		Message: "Connecting to home",
+		Payload: WpaCredentials{Ssid: "home", Psk: "password1"},
+	})
+
+	data, err := ioutil.ReadFile(journal.JournalCfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("password1")) {
+		t.Errorf("journal holds the passphrase: %s", data)
+	}
+	if !bytes.Contains(data, []byte(`"ssid":"home"`)) {
+		t.Errorf("journal lost the ssid: %s", data)
+	}
+}
+
+func TestJournalDisabled(t *testing.T) {
+	journal := NewJournal(testLogger(t), JournalCfg{})
+	journal.Record(Event{Type: EventConnectAttempt})
+
+	events, err := journal.Query(JournalQuery{})
+	if err != nil || len(events) != 0 {
+		t.Errorf("Query() = %v, %v", events, err)
+	}
+}
@@ -0,0 +1,189 @@
+package iotwifi
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// Limiter errors, each returned with how long to wait before retrying.
+var (
+	ErrLockedOut   = errors.New("too many failed requests, locked out")
+	ErrRateLimited = errors.New("too many requests")
+	ErrBusy        = errors.New("too many requests in progress")
+)
+
+// limitIdle is how long an idle client is remembered.
+const limitIdle = 10 * time.Minute
+
+// Lockout is the payload of EventApiLockout.
+type Lockout struct {
+	Client   string    `json:"client"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// bucket is a token bucket refilled at rate tokens per second.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// fill adds the tokens earned since the last update.
+func (b *bucket) fill(now time.Time, rate float64, burst float64) {
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+	b.updated = now
+}
+
+// wait returns how long until a token is available.
+func (b *bucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// limitClient is the limiter state of one client address.
+type limitClient struct {
+	bucket      bucket
+	active      int
+	failures    int
+	lockouts    uint
+	lockedUntil time.Time
+	seen        time.Time
+}
+
+// Limiter rate limits, bounds the concurrency of and locks out clients
+// of the API routes that change device state.
+type Limiter struct {
+	Log      bunyan.Logger
+	LimitCfg LimitCfg
+	Events   *EventBus
+
+	mu      sync.Mutex
+	global  bucket
+	active  int
+	clients map[string]*limitClient
+}
+
+// NewLimiter produces a Limiter.
+func NewLimiter(log bunyan.Logger, limitCfg LimitCfg, events *EventBus) *Limiter {
+	return &Limiter{
+		Log:      log,
+		LimitCfg: limitCfg,
+		Events:   events,
+		clients:  make(map[string]*limitClient, 0),
+	}
+}
+
+// Acquire admits a request from client, which must be followed by
+// Release. A refused request gets an error and the time to wait.
+func (l *Limiter) Acquire(client string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &limitClient{}
+		l.clients[client] = c
+	}
+	c.seen = now
+
+	if now.Before(c.lockedUntil) {
+		return c.lockedUntil.Sub(now), ErrLockedOut
+	}
+
+	if c.active >= l.LimitCfg.ClientConcurrent || l.active >= l.LimitCfg.Concurrent {
+		return time.Second, ErrBusy
+	}
+
+	clientRate := float64(l.LimitCfg.ClientRate) / 60
+	globalRate := float64(l.LimitCfg.Rate) / 60
+	c.bucket.fill(now, clientRate, float64(l.LimitCfg.ClientBurst))
+	l.global.fill(now, globalRate, float64(l.LimitCfg.Burst))
+
+	if wait := c.bucket.wait(clientRate); wait > 0 {
+		return wait, ErrRateLimited
+	}
+	if wait := l.global.wait(globalRate); wait > 0 {
+		return wait, ErrRateLimited
+	}
+
+	c.bucket.tokens--
+	l.global.tokens--
+	c.active++
+	l.active++
+
+	return 0, nil
+}
+
+// Release ends a request admitted by Acquire. Failed requests count
+// towards a lockout, which doubles in length each time up to
+// max_lockout. A successful request clears the count.
+func (l *Limiter) Release(client string, failed bool) {
+	l.mu.Lock()
+
+	l.active--
+	c, ok := l.clients[client]
+	if !ok {
+		l.mu.Unlock()
+		return
+	}
+	c.active--
+
+	if !failed {
+		c.failures = 0
+		c.lockouts = 0
+		l.mu.Unlock()
+		return
+	}
+
+	c.failures++
+	if c.failures < l.LimitCfg.MaxFailures {
+		l.mu.Unlock()
+		return
+	}
+
+	limit := time.Duration(l.LimitCfg.MaxLockout) * time.Second
+	lockout := time.Duration(l.LimitCfg.Lockout) * time.Second
+	for i := uint(0); i < c.lockouts && lockout < limit; i++ {
+		lockout *= 2
+	}
+	if lockout > limit {
+		lockout = limit
+	}
+	c.lockedUntil = time.Now().Add(lockout)
+	c.lockouts++
+
+	event := Lockout{Client: client, Failures: c.failures, Until: c.lockedUntil}
+	c.failures = 0
+	l.mu.Unlock()
+
+	l.Log.Info("Locked out %s for %s after %d failed requests", client, lockout.String(), event.Failures)
+
+	l.Events.Publish(Event{
+		Type:    EventApiLockout,
+		Message: "Locked out " + client + " for " + lockout.String(),
+		Payload: event,
+	})
+}
+
+// prune forgets clients that are idle and not locked out.
+func (l *Limiter) prune(now time.Time) {
+	for client, c := range l.clients {
+		if c.active == 0 && now.After(c.lockedUntil) && now.Sub(c.seen) > limitIdle {
+			delete(l.clients, client)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package iotwifi
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// LinkSample is a single station link quality measurement.
+type LinkSample struct {
+	Time      time.Time `json:"time"`
+	Rssi      int       `json:"rssi"`
+	Noise     int       `json:"noise"`
+	LinkSpeed int       `json:"link_speed"`
+	Frequency int       `json:"frequency"`
+	TxRetries int64     `json:"tx_retries"`
+	TxFailed  int64     `json:"tx_failed"`
+}
+
+// LinkMonitor samples the station link into a ring buffer and
+// publishes events when the signal crosses the configured thresholds.
+type LinkMonitor struct {
+	Log     bunyan.Logger
+	LinkCfg LinkCfg
+	Events  *EventBus
+
+	mu      sync.Mutex
+	samples []LinkSample
+	next    int
+	full    bool
+	weak    bool
+}
+
+// NewLinkMonitor produces a LinkMonitor.
+func NewLinkMonitor(log bunyan.Logger, linkCfg LinkCfg, events *EventBus) *LinkMonitor {
+	return &LinkMonitor{
+		Log:     log,
+		LinkCfg: linkCfg,
+		Events:  events,
+		samples: make([]LinkSample, linkCfg.History),
+	}
+}
+
+// Run samples the station link on the configured interval.
+func (l *LinkMonitor) Run() {
+	interval := time.Duration(l.LinkCfg.Interval) * time.Second
+
+	for {
+		if sample, ok := l.Sample(); ok {
+			l.record(sample)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Sample measures the station link. It reports false when the
+// station is not associated.
+func (l *LinkMonitor) Sample() (LinkSample, bool) {
+	sample := LinkSample{Time: time.Now()}
+
+	pollOut, err := exec.Command("wpa_cli", "-i", "wlan0", "signal_poll").Output()
+	if err != nil || strings.TrimSpace(string(pollOut)) == "FAIL" {
+		return sample, false
+	}
+
+	poll := cfgMapper(pollOut)
+	sample.Rssi, _ = strconv.Atoi(poll["RSSI"])
+	sample.Noise, _ = strconv.Atoi(poll["NOISE"])
+	sample.LinkSpeed, _ = strconv.Atoi(poll["LINKSPEED"])
+	sample.Frequency, _ = strconv.Atoi(poll["FREQUENCY"])
+
+	// retries are only available from the station dump
+	dumpOut, err := exec.Command("iw", "dev", "wlan0", "station", "dump").Output()
+	if err == nil {
+		dump := stationDumpMapper(dumpOut)
+		sample.TxRetries, _ = strconv.ParseInt(dump["tx retries"], 10, 64)
+		sample.TxFailed, _ = strconv.ParseInt(dump["tx failed"], 10, 64)
+	}
+
+	return sample, true
+}
+
+// History returns the recorded samples since a point in time,
+// oldest first.
+func (l *LinkMonitor) History(since time.Time) []LinkSample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ordered := l.samples[:l.next]
+	if l.full {
+		ordered = append(append([]LinkSample{}, l.samples[l.next:]...), l.samples[:l.next]...)
+	}
+
+	history := []LinkSample{}
+	for _, sample := range ordered {
+		if sample.Time.After(since) {
+			history = append(history, sample)
+		}
+	}
+
+	return history
+}
+
+// record stores a sample and publishes threshold crossings.
+func (l *LinkMonitor) record(sample LinkSample) {
+	l.mu.Lock()
+	if len(l.samples) > 0 {
+		l.samples[l.next] = sample
+		l.next = (l.next + 1) % len(l.samples)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+
+	wasWeak := l.weak
+	switch {
+	case sample.Rssi < l.LinkCfg.RssiWeak:
+		l.weak = true
+	case sample.Rssi >= l.LinkCfg.RssiRecovered:
+		l.weak = false
+	}
+	weak := l.weak
+	l.mu.Unlock()
+
+	if weak && !wasWeak {
+		l.Events.Publish(Event{
+			Type:    EventSignalWeak,
+			Message: "Station signal below " + strconv.Itoa(l.LinkCfg.RssiWeak) + " dBm",
+			Payload: sample,
+		})
+	}
+
+	if !weak && wasWeak {
+		l.Events.Publish(Event{
+			Type:    EventSignalRecovered,
+			Message: "Station signal recovered above " + strconv.Itoa(l.LinkCfg.RssiRecovered) + " dBm",
+			Payload: sample,
+		})
+	}
+}
+
+// stationDumpMapper puts the "key: value" lines of an iw station dump
+// in a map, keeping only the first word of each value.
+func stationDumpMapper(data []byte) map[string]string {
+	dumpMap := make(map[string]string, 0)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		value := strings.Fields(kv[1])
+		if len(value) > 0 {
+			dumpMap[strings.TrimSpace(kv[0])] = value[0]
+		}
+	}
+
+	return dumpMap
+}
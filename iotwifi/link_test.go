@@ -0,0 +1,101 @@
+package iotwifi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testLinkMonitor returns a LinkMonitor with the default thresholds and
+// the types of the events it publishes.
+func testLinkMonitor(t *testing.T, history int) (*LinkMonitor, *[]string) {
+	log := testLogger(t)
+	events := NewEventBus(log)
+
+	published := []string{}
+	events.Subscribe(func(event Event) {
+		published = append(published, event.Type)
+	})
+
+	return NewLinkMonitor(log, LinkCfg{History: history, RssiWeak: -75, RssiRecovered: -70}, events), &published
+}
+
+func TestLinkHysteresis(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rssi   []int
+		events []string
+	}{
+		{"strong", []int{-50, -60, -74}, []string{}},
+		{"at weak threshold", []int{-75}, []string{}},
+		{"weak", []int{-60, -76}, []string{EventSignalWeak}},
+		{"weak once", []int{-76, -80, -90}, []string{EventSignalWeak}},
+		{"between thresholds stays weak", []int{-76, -72, -71, -74}, []string{EventSignalWeak}},
+		{"recovered", []int{-76, -70}, []string{EventSignalWeak, EventSignalRecovered}},
+		{"flapping at the weak threshold", []int{-76, -75, -76, -75}, []string{EventSignalWeak}},
+		{"weak again", []int{-80, -65, -72, -78}, []string{EventSignalWeak, EventSignalRecovered, EventSignalWeak}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			link, published := testLinkMonitor(t, 10)
+
+			for _, rssi := range tc.rssi {
+				link.record(LinkSample{Time: time.Now(), Rssi: rssi})
+			}
+
+			if !reflect.DeepEqual(*published, tc.events) {
+				t.Errorf("events %v, want %v", *published, tc.events)
+			}
+		})
+	}
+}
+
+func TestLinkHistory(t *testing.T) {
+	link, _ := testLinkMonitor(t, 3)
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		link.record(LinkSample{Time: start.Add(time.Duration(i) * time.Second), Rssi: -50 - i})
+	}
+
+	rssi := func(samples []LinkSample) []int {
+		values := []int{}
+		for _, sample := range samples {
+			values = append(values, sample.Rssi)
+		}
+		return values
+	}
+
+	// the ring buffer keeps the latest three, oldest first
+	if got := rssi(link.History(time.Time{})); !reflect.DeepEqual(got, []int{-52, -53, -54}) {
+		t.Errorf("history %v", got)
+	}
+	if got := rssi(link.History(start.Add(3 * time.Second))); !reflect.DeepEqual(got, []int{-54}) {
+		t.Errorf("history since %v", got)
+	}
+
+	// no samples are kept without a history, thresholds still apply
+	link, published := testLinkMonitor(t, 0)
+	link.record(LinkSample{Time: start, Rssi: -80})
+	if got := link.History(time.Time{}); len(got) != 0 {
+		t.Errorf("history %v without a buffer", got)
+	}
+	if !reflect.DeepEqual(*published, []string{EventSignalWeak}) {
+		t.Errorf("events %v", *published)
+	}
+}
+
+func TestStationDumpMapper(t *testing.T) {
+	dump := "Station aa:bb:cc:dd:ee:01 (on wlan0)\n\tinactive time:\t40 ms\n\ttx retries:\t12\n\ttx failed:\t3\n\tsignal:  \t-52 [-52] dBm\n"
+
+	// the station line splits on the first colon of the address
+	want := map[string]string{
+		"Station aa":    "bb:cc:dd:ee:01",
+		"inactive time": "40",
+		"tx retries":    "12",
+		"tx failed":     "3",
+		"signal":        "-52",
+	}
+	if got := stationDumpMapper([]byte(dump)); !reflect.DeepEqual(got, want) {
+		t.Errorf("stationDumpMapper() = %v, want %v", got, want)
+	}
+}
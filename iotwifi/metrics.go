@@ -0,0 +1,260 @@
+package iotwifi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric kinds understood by Metrics.
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+	MetricSummary = "summary"
+)
+
+// metricFamily holds every labeled sample of a metric.
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples map[string]float64 // keyed by rendered label set
+	counts  map[string]float64 // observation counts for summaries
+}
+
+// Metrics is a minimal registry rendered in the Prometheus
+// text exposition format.
+type Metrics struct {
+	mu         sync.Mutex
+	families   map[string]*metricFamily
+	collectors []func(m *Metrics)
+}
+
+// NewMetrics produces a Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		families: make(map[string]*metricFamily, 0),
+	}
+}
+
+// Describe registers a metric family of the given kind.
+func (m *Metrics) Describe(name string, kind string, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.families[name]; ok {
+		return
+	}
+
+	m.families[name] = &metricFamily{
+		name:    name,
+		kind:    kind,
+		help:    help,
+		samples: make(map[string]float64, 0),
+		counts:  make(map[string]float64, 0),
+	}
+}
+
+// Collect registers a function called before every scrape to refresh
+// gauges read from the system.
+func (m *Metrics) Collect(collector func(m *Metrics)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.collectors = append(m.collectors, collector)
+}
+
+// Add increments a counter. Labels are given as name, value pairs.
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	m.update(name, labels, func(f *metricFamily, key string) {
+		f.samples[key] += v
+	})
+}
+
+// Set sets a gauge. Labels are given as name, value pairs.
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	m.update(name, labels, func(f *metricFamily, key string) {
+		f.samples[key] = v
+	})
+}
+
+// Observe records an observation of a summary. Labels are given
+// as name, value pairs.
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	m.update(name, labels, func(f *metricFamily, key string) {
+		f.samples[key] += v
+		f.counts[key]++
+	})
+}
+
+// Reset removes every sample of a metric, used by collectors for
+// gauges whose label sets come and go.
+func (m *Metrics) Reset(name string) {
+	m.update(name, nil, func(f *metricFamily, key string) {
+		f.samples = make(map[string]float64, 0)
+		f.counts = make(map[string]float64, 0)
+	})
+}
+
+// update applies fn to a described metric family.
+func (m *Metrics) update(name string, labels []string, fn func(f *metricFamily, key string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		return
+	}
+
+	fn(f, renderLabels(labels))
+}
+
+// Write runs the collectors and writes all metrics to w.
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+
+	for _, collector := range collectors {
+		collector(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.samples))
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if f.kind == MetricSummary {
+				fmt.Fprintf(w, "%s_sum%s %s\n", f.name, key, formatFloat(f.samples[key]))
+				fmt.Fprintf(w, "%s_count%s %s\n", f.name, key, formatFloat(f.counts[key]))
+				continue
+			}
+			fmt.Fprintf(w, "%s%s %s\n", f.name, key, formatFloat(f.samples[key]))
+		}
+	}
+}
+
+// renderLabels renders name, value pairs as a Prometheus label set.
+func renderLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// registerMetrics describes the device metrics and wires them to the
+// event bus and system collectors.
+func registerMetrics(wpa *WpaCfg) {
+	m := wpa.Metrics
+
+	m.Describe("iotwifi_station_rssi_dbm", MetricGauge, "Signal strength of the station link.")
+	m.Describe("iotwifi_station_link_speed_mbps", MetricGauge, "Link speed of the station link.")
+	m.Describe("iotwifi_station_connected", MetricGauge, "1 when the station has completed association.")
+	m.Describe("iotwifi_station_state", MetricGauge, "Current wpa_supplicant state of the station.")
+	m.Describe("iotwifi_station_connects_total", MetricCounter, "Station connections, including reconnects.")
+	m.Describe("iotwifi_station_disconnects_total", MetricCounter, "Station disconnections.")
+	m.Describe("iotwifi_ap_clients", MetricGauge, "Clients associated with the AP.")
+	m.Describe("iotwifi_dhcp_leases", MetricGauge, "Active dnsmasq DHCP leases.")
+	m.Describe("iotwifi_process_restarts_total", MetricCounter, "Restarts of managed processes.")
+	m.Describe("iotwifi_scan_duration_seconds", MetricSummary, "Duration of network scans.")
+	m.Describe("iotwifi_http_requests_total", MetricCounter, "HTTP requests by route, method and status code.")
+	m.Describe("iotwifi_http_request_duration_seconds", MetricSummary, "HTTP request latency by route and method.")
+	m.Describe("iotwifi_http_limited_total", MetricCounter, "HTTP requests refused by the limiter by reason.")
+
+	wpa.Events.Subscribe(func(event Event) {
+		switch event.Type {
+		case EventStationConnected:
+			m.Add("iotwifi_station_connects_total", 1)
+		case EventStationDisconnected:
+			m.Add("iotwifi_station_disconnects_total", 1)
+		case EventProcessExited:
+			if exit, ok := event.Payload.(ProcessExit); ok && exit.Restart {
+				m.Add("iotwifi_process_restarts_total", 1, "process", exit.Process)
+			}
+		}
+	})
+
+	m.Collect(wpa.collectStationMetrics)
+	m.Collect(wpa.collectApMetrics)
+}
+
+// collectStationMetrics reads the station state and signal.
+func (wpa *WpaCfg) collectStationMetrics(m *Metrics) {
+	m.Reset("iotwifi_station_state")
+	m.Reset("iotwifi_station_rssi_dbm")
+	m.Reset("iotwifi_station_link_speed_mbps")
+	m.Set("iotwifi_station_connected", 0)
+
+	statusOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+	if err != nil {
+		return
+	}
+
+	state := cfgMapper(statusOut)["wpa_state"]
+	m.Set("iotwifi_station_state", 1, "state", state)
+	if state == "COMPLETED" {
+		m.Set("iotwifi_station_connected", 1)
+	}
+
+	pollOut, err := exec.Command("wpa_cli", "-i", "wlan0", "signal_poll").Output()
+	if err != nil {
+		return
+	}
+
+	poll := cfgMapper(pollOut)
+	if rssi, err := strconv.ParseFloat(poll["RSSI"], 64); err == nil {
+		m.Set("iotwifi_station_rssi_dbm", rssi)
+	}
+	if speed, err := strconv.ParseFloat(poll["LINKSPEED"], 64); err == nil {
+		m.Set("iotwifi_station_link_speed_mbps", speed)
+	}
+}
+
+// collectApMetrics counts AP clients and DHCP leases.
+func (wpa *WpaCfg) collectApMetrics(m *Metrics) {
+	m.Set("iotwifi_ap_clients", float64(wpa.ApClientCount()))
+
+	// one lease per line
+	leases := 0
+	leaseData, err := ioutil.ReadFile(wpa.WpaCfg.DnsmasqCfg.LeaseFile)
+	if err == nil {
+		for _, line := range strings.Split(string(leaseData), "\n") {
+			if strings.TrimSpace(line) != "" {
+				leases++
+			}
+		}
+	}
+	m.Set("iotwifi_dhcp_leases", float64(leases))
+}
@@ -0,0 +1,123 @@
+package iotwifi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := NewMetrics()
+	m.Describe("test_requests_total", MetricCounter, "Requests by route and code.")
+	m.Describe("test_connected", MetricGauge, "1 when connected.")
+	m.Describe("test_duration_seconds", MetricSummary, "Request latency.")
+	m.Describe("test_state", MetricGauge, "Current state.")
+
+	m.Add("test_requests_total", 1, "route", "/v1/status", "code", "200")
+	m.Add("test_requests_total", 2, "route", "/v1/status", "code", "200")
+	m.Add("test_requests_total", 1, "route", `/v1/"scan"`, "code", "503")
+	m.Set("test_connected", 1)
+	m.Observe("test_duration_seconds", 0.25, "route", "/v1/status")
+	m.Observe("test_duration_seconds", 0.5, "route", "/v1/status")
+	m.Add("test_undescribed_total", 1)
+
+	// collectors run before every write
+	state := "SCANNING"
+	m.Collect(func(m *Metrics) {
+		m.Reset("test_state")
+		m.Set("test_state", 1, "state", state)
+	})
+	m.Write(&bytes.Buffer{})
+	state = "COMPLETED"
+
+	out := &bytes.Buffer{}
+	m.Write(out)
+
+	want := strings.Join([]string{
+		"# HELP test_connected 1 when connected.",
+		"# TYPE test_connected gauge",
+		"test_connected 1",
+		"# HELP test_duration_seconds Request latency.",
+		"# TYPE test_duration_seconds summary",
+		`test_duration_seconds_sum{route="/v1/status"} 0.75`,
+		`test_duration_seconds_count{route="/v1/status"} 2`,
+		"# HELP test_requests_total Requests by route and code.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/v1/\"scan\"",code="503"} 1`,
+		`test_requests_total{route="/v1/status",code="200"} 3`,
+		"# HELP test_state Current state.",
+		"# TYPE test_state gauge",
+		`test_state{state="COMPLETED"} 1`,
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRenderLabels(t *testing.T) {
+	for _, tc := range []struct {
+		labels []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"route"}, ""},
+		{[]string{"process", "hostapd"}, `{process="hostapd"}`},
+		{[]string{"a", "1", "b", "2"}, `{a="1",b="2"}`},
+		{[]string{"path", `C:\tmp`}, `{path="C:\\tmp"}`},
+		{[]string{"a", "1", "b"}, `{a="1"}`},
+	} {
+		if got := renderLabels(tc.labels); got != tc.want {
+			t.Errorf("renderLabels(%q) = %s, want %s", tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{3, "3"},
+		{-67, "-67"},
+		{0.125, "0.125"},
+		{1e21, "1e+21"},
+	} {
+		if got := formatFloat(tc.v); got != tc.want {
+			t.Errorf("formatFloat(%v) = %s, want %s", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestRegisterMetricsEvents(t *testing.T) {
+	wpa := testWpaCfg(t)
+	registerMetrics(wpa)
+
+	for _, event := range []Event{
+		{Type: EventStationConnected},
+		{Type: EventStationConnected},
+		{Type: EventStationDisconnected},
+		{Type: EventProcessExited, Payload: ProcessExit{Process: "hostapd", Restart: true}},
+		{Type: EventProcessExited, Payload: ProcessExit{Process: "udhcpc"}},
+	} {
+		wpa.Events.Publish(event)
+	}
+
+	out := &bytes.Buffer{}
+	wpa.Metrics.Write(out)
+
+	for _, line := range []string{
+		"iotwifi_station_connects_total 2",
+		"iotwifi_station_disconnects_total 1",
+		`iotwifi_process_restarts_total{process="hostapd"} 1`,
+		"# TYPE iotwifi_scan_duration_seconds summary",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("no %q in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out.String(), `process="udhcpc"`) {
+		t.Errorf("clean exit counted as a restart:\n%s", out)
+	}
+}
@@ -0,0 +1,527 @@
+package iotwifi
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect   = 1
+	mqttConnack   = 2
+	mqttPublish   = 3
+	mqttSubscribe = 8
+	mqttSuback    = 9
+	mqttPingreq   = 12
+	mqttPingresp  = 13
+)
+
+// mqttMaxBackoff caps the delay between broker reconnects.
+const mqttMaxBackoff = 60 * time.Second
+
+// mqttCommandQueue is how many remote commands may wait to be run.
+const mqttCommandQueue = 10
+
+// MqttCommand is a remote command received on the command topic.
+type MqttCommand struct {
+	Id      string          `json:"id"`
+	Command string          `json:"command"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// MqttCommandResult is published on the command result topic and
+// mirrors the HTTP API return.
+type MqttCommandResult struct {
+	Id      string      `json:"id"`
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Payload interface{} `json:"payload"`
+}
+
+// MqttClient publishes device status and events to an MQTT broker and
+// runs commands received on the command topic.
+type MqttClient struct {
+	Log      bunyan.Logger
+	MqttCfg  MqttCfg
+	WpaCfg   *WpaCfg
+	Messages chan CmdMessage
+
+	mu       sync.Mutex
+	conn     net.Conn
+	events   chan Event
+	commands chan []byte
+}
+
+// NewMqttClient produces an MqttClient.
+func NewMqttClient(log bunyan.Logger, wpacfg *WpaCfg, messages chan CmdMessage) *MqttClient {
+	c := &MqttClient{
+		Log:      log,
+		MqttCfg:  wpacfg.WpaCfg.MqttCfg,
+		WpaCfg:   wpacfg,
+		Messages: messages,
+		events:   make(chan Event, 100),
+		commands: make(chan []byte, mqttCommandQueue),
+	}
+
+	// queue events for the session, dropping them when it falls behind
+	wpacfg.Events.Subscribe(func(event Event) {
+		select {
+		case c.events <- event:
+		default:
+		}
+	})
+
+	return c
+}
+
+// Run keeps a session with the broker open, reconnecting with backoff.
+func (c *MqttClient) Run() {
+	go c.runCommands()
+
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		err := c.session()
+		c.Log.Error("MQTT session ended: %s", err.Error())
+
+		if time.Since(start) > mqttMaxBackoff {
+			backoff = time.Second
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// topic returns a topic below the configured prefix.
+func (c *MqttClient) topic(name string) string {
+	return c.MqttCfg.TopicPrefix + "/" + name
+}
+
+// session connects, subscribes and publishes until the connection fails.
+func (c *MqttClient) session() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(mqttConnect<<4, c.connectPacket()); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packetType, body, err := readPacket(reader)
+	if err != nil {
+		return err
+	}
+	if packetType>>4 != mqttConnack || len(body) != 2 {
+		return errors.New("expected CONNACK")
+	}
+	if body[1] != 0 {
+		return errors.New("connection refused with code " + strconv.Itoa(int(body[1])))
+	}
+
+	c.Log.Info("MQTT connected to %s", c.MqttCfg.Broker)
+
+	// SUBSCRIBE packet id 1 to the command topic at QoS 0
+	subscribe := append([]byte{0, 1}, mqttString(c.topic("command"))...)
+	subscribe = append(subscribe, 0)
+	if err := c.write(mqttSubscribe<<4|0x02, subscribe); err != nil {
+		return err
+	}
+
+	c.publish(c.topic("online"), []byte("true"), true)
+	c.publishStatus()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.readLoop(reader)
+	}()
+
+	keepAlive := time.Duration(c.MqttCfg.KeepAlive) * time.Second
+	ping := time.NewTicker(keepAlive / 2)
+	defer ping.Stop()
+
+	status := time.NewTicker(time.Duration(c.MqttCfg.StatusInterval) * time.Second)
+	defer status.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+
+		case <-ping.C:
+			if err := c.write(mqttPingreq<<4, nil); err != nil {
+				return err
+			}
+
+		case <-status.C:
+			c.publishStatus()
+
+		case event := <-c.events:
+			c.publishEvent(event)
+		}
+	}
+}
+
+// dial opens a TCP or TLS connection to the broker.
+func (c *MqttClient) dial() (net.Conn, error) {
+	broker, err := url.Parse(c.MqttCfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	host := broker.Host
+	switch broker.Scheme {
+	case "ssl", "tls", "mqtts":
+		if broker.Port() == "" {
+			host = net.JoinHostPort(broker.Hostname(), "8883")
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", host, &tls.Config{
+			ServerName: broker.Hostname(),
+		})
+	}
+
+	if broker.Port() == "" {
+		host = net.JoinHostPort(broker.Hostname(), "1883")
+	}
+	return net.DialTimeout("tcp", host, 10*time.Second)
+}
+
+// connectPacket builds the CONNECT variable header and payload with a
+// retained last will marking the device offline.
+func (c *MqttClient) connectPacket() []byte {
+	// clean session, will retained at QoS 0
+	flags := byte(0x02 | 0x04 | 0x20)
+	if c.MqttCfg.Username != "" {
+		flags |= 0x80
+	}
+	if c.hasPassword() {
+		flags |= 0x40
+	}
+
+	packet := mqttString("MQTT")
+	packet = append(packet, 4, flags)
+	packet = append(packet, byte(c.MqttCfg.KeepAlive>>8), byte(c.MqttCfg.KeepAlive))
+	packet = append(packet, mqttString(c.MqttCfg.ClientId)...)
+	packet = append(packet, mqttString(c.topic("online"))...)
+	packet = append(packet, mqttString("false")...)
+
+	if c.MqttCfg.Username != "" {
+		packet = append(packet, mqttString(c.MqttCfg.Username)...)
+	}
+	if c.hasPassword() {
+		packet = append(packet, mqttString(c.MqttCfg.Password)...)
+	}
+
+	return packet
+}
+
+// hasPassword reports whether a password is sent, which MQTT 3.1.1
+// only allows along with a user name.
+func (c *MqttClient) hasPassword() bool {
+	return c.MqttCfg.Password != "" && c.MqttCfg.Username != ""
+}
+
+// readLoop handles packets from the broker until the connection fails.
+func (c *MqttClient) readLoop(reader *bufio.Reader) error {
+	keepAlive := time.Duration(c.MqttCfg.KeepAlive) * time.Second
+
+	for {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			return errors.New("connection closed")
+		}
+		conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+
+		packetType, body, err := readPacket(reader)
+		if err != nil {
+			return err
+		}
+
+		switch packetType >> 4 {
+		case mqttPublish:
+			topic, payload, err := parsePublish(packetType, body)
+			if err != nil {
+				return err
+			}
+			if topic == c.topic("command") {
+				c.queueCommand(payload)
+			}
+
+		case mqttSuback:
+			if len(body) == 3 && body[2] == 0x80 {
+				c.Log.Error("MQTT subscription to %s refused", c.topic("command"))
+			}
+
+		case mqttPingresp:
+		}
+	}
+}
+
+// queueCommand queues a remote command for runCommands, refusing it
+// when the queue is full.
+func (c *MqttClient) queueCommand(payload []byte) {
+	select {
+	case c.commands <- payload:
+	default:
+		var cmd MqttCommand
+		json.Unmarshal(payload, &cmd)
+
+		c.Log.Error("MQTT command queue is full, dropping command %s", cmd.Command)
+		c.publishResult(MqttCommandResult{Id: cmd.Id, Status: "FAIL", Message: "too many commands queued"})
+	}
+}
+
+// runCommands runs the queued remote commands one at a time.
+func (c *MqttClient) runCommands() {
+	for payload := range c.commands {
+		c.handleCommand(payload)
+	}
+}
+
+// handleCommand runs a remote command through the same code paths as
+// the HTTP API and publishes the result.
+func (c *MqttClient) handleCommand(payload []byte) {
+	var cmd MqttCommand
+	result := MqttCommandResult{Status: "OK"}
+
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		result.Status = "FAIL"
+		result.Message = err.Error()
+		c.publishResult(result)
+		return
+	}
+	result.Id = cmd.Id
+
+	c.WpaCfg.Events.Publish(Event{
+		Type:    EventApiRequest,
+		Message: "MQTT " + cmd.Command,
+		Payload: ApiRequest{Remote: "mqtt", Method: "MQTT", Path: cmd.Command},
+	})
+
+	switch cmd.Command {
+	case "scan":
+		networks, err := c.WpaCfg.ScanNetworks()
+		if err != nil {
+			result.Status = "FAIL"
+			result.Message = err.Error()
+			break
+		}
+		result.Message = "Networks"
+		result.Payload = networks
+
+	case "connect":
+		var creds WpaCredentials
+		if err := json.Unmarshal(cmd.Payload, &creds); err != nil {
+			result.Status = "FAIL"
+			result.Message = err.Error()
+			break
+		}
+
+		connection, err := c.WpaCfg.ConnectNetwork(creds)
+		if err != nil {
+			result.Status = "FAIL"
+			result.Message = err.Error()
+			break
+		}
+		result.Message = "Connection"
+		result.Payload = connection
+
+	case "restart":
+		result.Message = "Killing service."
+		c.publishResult(result)
+		c.Messages <- CmdMessage{Id: "kill"}
+		return
+
+	default:
+		result.Status = "FAIL"
+		result.Message = "Unknown command " + cmd.Command
+	}
+
+	c.publishResult(result)
+}
+
+// publishResult publishes a command result.
+func (c *MqttClient) publishResult(result MqttCommandResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		c.Log.Error("MQTT could not encode result: %s", err.Error())
+		return
+	}
+
+	c.publish(c.topic("command/result"), data, false)
+}
+
+// publishStatus publishes the retained status, connectivity and
+// client count topics.
+func (c *MqttClient) publishStatus() {
+	status, err := c.WpaCfg.StationStatus()
+	if err == nil {
+		if data, err := json.Marshal(status); err == nil {
+			c.publish(c.topic("status"), data, true)
+		}
+	}
+
+	if data, err := json.Marshal(c.WpaCfg.Prober.Last()); err == nil {
+		c.publish(c.topic("connectivity"), data, true)
+	}
+
+	c.publish(c.topic("clients"), []byte(strconv.Itoa(c.WpaCfg.ApClientCount())), true)
+}
+
+// publishEvent publishes an event with secrets redacted.
+func (c *MqttClient) publishEvent(event Event) {
+	event.Payload = redact(event.Payload)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		c.Log.Error("MQTT could not encode event: %s", err.Error())
+		return
+	}
+
+	c.publish(c.topic("events"), data, false)
+
+	if event.Type == EventConnectivity {
+		c.publishStatus()
+	}
+}
+
+// publish sends a QoS 0 message.
+func (c *MqttClient) publish(topic string, payload []byte, retain bool) {
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+
+	body := append(mqttString(topic), payload...)
+	if err := c.write(header, body); err != nil {
+		c.Log.Error("MQTT could not publish to %s: %s", topic, err.Error())
+	}
+}
+
+// write sends a packet with the given first header byte.
+func (c *MqttClient) write(header byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return errors.New("not connected")
+	}
+
+	packet := append([]byte{header}, mqttLength(len(body))...)
+	packet = append(packet, body...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+
+	return err
+}
+
+// readPacket reads one control packet returning its first header
+// byte and body.
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
+
+// parsePublish splits a PUBLISH body into topic and payload.
+func parsePublish(header byte, body []byte) (string, []byte, error) {
+	if len(body) < 2 {
+		return "", nil, errors.New("malformed PUBLISH")
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+topicLen {
+		return "", nil, errors.New("malformed PUBLISH")
+	}
+	topic := string(body[2 : 2+topicLen])
+	rest := body[2+topicLen:]
+
+	// skip the packet id of QoS 1 and 2 messages
+	if (header>>1)&0x03 > 0 {
+		if len(rest) < 2 {
+			return "", nil, errors.New("malformed PUBLISH")
+		}
+		rest = rest[2:]
+	}
+
+	return topic, rest, nil
+}
+
+// mqttString encodes a length prefixed UTF-8 string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttLength encodes the remaining length of a packet.
+func mqttLength(length int) []byte {
+	encoded := []byte{}
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		encoded = append(encoded, b)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
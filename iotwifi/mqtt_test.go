@@ -0,0 +1,311 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMqttLength(t *testing.T) {
+	for _, tc := range []struct {
+		length  int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	} {
+		if got := mqttLength(tc.length); !bytes.Equal(got, tc.encoded) {
+			t.Errorf("mqttLength(%d) = % x, want % x", tc.length, got, tc.encoded)
+		}
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	for _, length := range []int{0, 1, 127, 128, 300, 16384} {
+		body := bytes.Repeat([]byte{0xab}, length)
+		packet := append([]byte{mqttPublish << 4}, mqttLength(length)...)
+		packet = append(packet, body...)
+
+		header, got, err := readPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil {
+			t.Fatalf("length %d: %s", length, err)
+		}
+		if header != mqttPublish<<4 || !bytes.Equal(got, body) {
+			t.Errorf("length %d: got header %x and %d bytes", length, header, len(got))
+		}
+	}
+
+	for name, packet := range map[string][]byte{
+		"length over four bytes": {0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"short body":             {0x30, 0x05, 0x00, 0x01},
+		"no length":              {0x30},
+	} {
+		if _, _, err := readPacket(bufio.NewReader(bytes.NewReader(packet))); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestConnectPacket(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+		flags    byte
+		payload  []string
+	}{
+		{"anonymous", "", "", 0x26, []string{"dev", "iotwifi/dev/online", "false"}},
+		{"username", "user", "", 0xa6, []string{"dev", "iotwifi/dev/online", "false", "user"}},
+		{"username and password", "user", "secret", 0xe6, []string{"dev", "iotwifi/dev/online", "false", "user", "secret"}},
+		{"password only", "", "secret", 0x26, []string{"dev", "iotwifi/dev/online", "false"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &MqttClient{MqttCfg: MqttCfg{
+				ClientId:    "dev",
+				Username:    tc.username,
+				Password:    tc.password,
+				TopicPrefix: "iotwifi/dev",
+				KeepAlive:   300,
+			}}
+
+			want := append(mqttString("MQTT"), 4, tc.flags, 0x01, 0x2c)
+			for _, s := range tc.payload {
+				want = append(want, mqttString(s)...)
+			}
+
+			if got := c.connectPacket(); !bytes.Equal(got, want) {
+				t.Errorf("connectPacket() = % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	qos0 := append(mqttString("a/b"), "payload"...)
+	topic, payload, err := parsePublish(mqttPublish<<4, qos0)
+	if err != nil || topic != "a/b" || string(payload) != "payload" {
+		t.Errorf("QoS 0: %q %q %v", topic, payload, err)
+	}
+
+	qos1 := append(mqttString("a/b"), 0x00, 0x07)
+	qos1 = append(qos1, "payload"...)
+	topic, payload, err = parsePublish(mqttPublish<<4|0x02, qos1)
+	if err != nil || topic != "a/b" || string(payload) != "payload" {
+		t.Errorf("QoS 1: %q %q %v", topic, payload, err)
+	}
+
+	for name, tc := range map[string]struct {
+		header byte
+		body   []byte
+	}{
+		"empty":           {mqttPublish << 4, nil},
+		"short topic":     {mqttPublish << 4, []byte{0x00, 0x05, 'a'}},
+		"QoS 1 no packet": {mqttPublish<<4 | 0x02, mqttString("a/b")},
+	} {
+		if _, _, err := parsePublish(tc.header, tc.body); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// testBroker is the broker side of a loopback MQTT session.
+type testBroker struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// expect reads a packet and checks its first header byte.
+func (b *testBroker) expect(header byte) []byte {
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	got, body, err := readPacket(b.reader)
+	if err != nil {
+		b.t.Fatalf("reading packet %x: %s", header, err)
+	}
+	if got != header {
+		b.t.Fatalf("packet header = %x, want %x", got, header)
+	}
+
+	return body
+}
+
+// send writes a packet.
+func (b *testBroker) send(header byte, body []byte) {
+	packet := append([]byte{header}, mqttLength(len(body))...)
+	if _, err := b.conn.Write(append(packet, body...)); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// results reads publishes until n command results arrived.
+func (b *testBroker) results(n int) []MqttCommandResult {
+	results := []MqttCommandResult{}
+
+	for len(results) < n {
+		b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header, body, err := readPacket(b.reader)
+		if err != nil {
+			b.t.Fatalf("reading results: %s", err)
+		}
+		if header>>4 != mqttPublish {
+			continue
+		}
+
+		topic, payload, err := parsePublish(header, body)
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		if topic != "iotwifi/dev/command/result" {
+			continue
+		}
+
+		var result MqttCommandResult
+		if err := json.Unmarshal(payload, &result); err != nil {
+			b.t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func TestMqttSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	wpa := testWpaCfg(t)
+	wpa.WpaCfg.MqttCfg = MqttCfg{
+		Broker:         "tcp://" + ln.Addr().String(),
+		ClientId:       "dev",
+		Username:       "user",
+		Password:       "secret",
+		TopicPrefix:    "iotwifi/dev",
+		KeepAlive:      60,
+		StatusInterval: 60,
+	}
+
+	messages := make(chan CmdMessage, 1)
+	c := NewMqttClient(wpa.Log, wpa, messages)
+	go c.runCommands()
+
+	session := make(chan error, 1)
+	go func() {
+		session <- c.session()
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b := &testBroker{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	if body := b.expect(mqttConnect << 4); !bytes.Equal(body, c.connectPacket()) {
+		t.Fatalf("CONNECT = % x", body)
+	}
+	b.send(mqttConnack<<4, []byte{0x00, 0x00})
+
+	subscribe := append([]byte{0x00, 0x01}, mqttString("iotwifi/dev/command")...)
+	subscribe = append(subscribe, 0x00)
+	if body := b.expect(mqttSubscribe<<4 | 0x02); !bytes.Equal(body, subscribe) {
+		t.Fatalf("SUBSCRIBE = % x, want % x", body, subscribe)
+	}
+	b.send(mqttSuback<<4, []byte{0x00, 0x01, 0x00})
+
+	// commands are answered in the order they were sent
+	for _, command := range []string{
+		`{"id":"1","command":"reboot"}`,
+		`not json`,
+		`{"id":"3","command":"restart"}`,
+	} {
+		b.send(mqttPublish<<4, append(mqttString("iotwifi/dev/command"), command...))
+	}
+
+	results := b.results(3)
+	for i, want := range []MqttCommandResult{
+		{Id: "1", Status: "FAIL", Message: "Unknown command reboot"},
+		{Id: "", Status: "FAIL"},
+		{Id: "3", Status: "OK", Message: "Killing service."},
+	} {
+		got := results[i]
+		if got.Id != want.Id || got.Status != want.Status || (want.Message != "" && got.Message != want.Message) {
+			t.Errorf("result %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.Id != "kill" {
+			t.Errorf("restart sent %q, want kill", msg.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("restart did not send kill")
+	}
+
+	conn.Close()
+	select {
+	case err := <-session:
+		if err == nil {
+			t.Error("session ended without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("session did not end when the broker closed the connection")
+	}
+}
+
+func TestMqttConnectionRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	wpa := testWpaCfg(t)
+	wpa.WpaCfg.MqttCfg = MqttCfg{
+		Broker:      "tcp://" + ln.Addr().String(),
+		ClientId:    "dev",
+		TopicPrefix: "iotwifi/dev",
+		KeepAlive:   60,
+	}
+	c := NewMqttClient(wpa.Log, wpa, make(chan CmdMessage, 1))
+
+	session := make(chan error, 1)
+	go func() {
+		session <- c.session()
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b := &testBroker{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	b.expect(mqttConnect << 4)
+
+	// 5: not authorized
+	b.send(mqttConnack<<4, []byte{0x00, 0x05})
+
+	select {
+	case err := <-session:
+		if err == nil || err.Error() != "connection refused with code 5" {
+			t.Errorf("session error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("session did not end on a refused connection")
+	}
+}
@@ -0,0 +1,236 @@
+package iotwifi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// Connectivity states reported by the Prober.
+const (
+	ConnUnknown = "unknown"
+	ConnOnline  = "online"
+	ConnLimited = "limited"
+	ConnCaptive = "captive"
+	ConnOffline = "offline"
+)
+
+// ProbeCheck is the outcome of a single reachability check.
+type ProbeCheck struct {
+	Name      string `json:"name"`
+	Target    string `json:"target"`
+	Ok        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Connectivity is the result of a reachability probe.
+type Connectivity struct {
+	State     string       `json:"state"`
+	LatencyMs int64        `json:"latency_ms"`
+	CheckedAt time.Time    `json:"checked_at"`
+	Checks    []ProbeCheck `json:"checks"`
+}
+
+// Prober periodically checks whether the configured internet
+// targets are reachable.
+type Prober struct {
+	Log      bunyan.Logger
+	ProbeCfg ProbeCfg
+	Events   *EventBus
+
+	mu      sync.Mutex
+	last    Connectivity
+	trigger chan struct{}
+}
+
+// NewProber produces a Prober.
+func NewProber(log bunyan.Logger, probeCfg ProbeCfg, events *EventBus) *Prober {
+	return &Prober{
+		Log:      log,
+		ProbeCfg: probeCfg,
+		Events:   events,
+		last:     Connectivity{State: ConnUnknown, Checks: []ProbeCheck{}},
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// Enabled reports whether any reachability check is configured.
+func (p *Prober) Enabled() bool {
+	return p.ProbeCfg.HttpUrl != "" || p.ProbeCfg.DnsHost != "" || p.ProbeCfg.TcpTarget != ""
+}
+
+// Run probes on the configured interval and whenever Trigger is called.
+func (p *Prober) Run() {
+	if !p.Enabled() {
+		p.Log.Info("No connectivity checks configured, prober disabled.")
+		return
+	}
+
+	interval := time.Duration(p.ProbeCfg.Interval) * time.Second
+	for {
+		p.Probe()
+
+		select {
+		case <-time.After(interval):
+		case <-p.trigger:
+		}
+	}
+}
+
+// Trigger requests a probe outside of the regular interval.
+func (p *Prober) Trigger() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Last returns the most recent probe result.
+func (p *Prober) Last() Connectivity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.last
+}
+
+// Probe runs all configured checks, records the result and publishes
+// a connectivity event when the state changes.
+func (p *Prober) Probe() Connectivity {
+	timeout := time.Duration(p.ProbeCfg.Timeout) * time.Second
+	conn := Connectivity{
+		CheckedAt: time.Now(),
+		Checks:    []ProbeCheck{},
+	}
+
+	captive := false
+
+	if p.ProbeCfg.DnsHost != "" {
+		conn.Checks = append(conn.Checks, p.checkDns(p.ProbeCfg.DnsHost, timeout))
+	}
+
+	if p.ProbeCfg.TcpTarget != "" {
+		conn.Checks = append(conn.Checks, p.checkTcp(p.ProbeCfg.TcpTarget, timeout))
+	}
+
+	if p.ProbeCfg.HttpUrl != "" {
+		var check ProbeCheck
+		check, captive = p.checkHttp(p.ProbeCfg.HttpUrl, timeout)
+		conn.Checks = append(conn.Checks, check)
+	}
+
+	passed := 0
+	for _, check := range conn.Checks {
+		if check.Ok {
+			passed++
+			if check.LatencyMs > conn.LatencyMs {
+				conn.LatencyMs = check.LatencyMs
+			}
+		}
+	}
+
+	switch {
+	case captive:
+		conn.State = ConnCaptive
+	case passed == len(conn.Checks):
+		conn.State = ConnOnline
+	case passed > 0:
+		conn.State = ConnLimited
+	default:
+		conn.State = ConnOffline
+	}
+
+	p.mu.Lock()
+	previous := p.last.State
+	p.last = conn
+	p.mu.Unlock()
+
+	if conn.State != previous {
+		p.Events.Publish(Event{
+			Type:    EventConnectivity,
+			Message: "Connectivity " + previous + " -> " + conn.State,
+			Payload: conn,
+		})
+	}
+
+	return conn
+}
+
+// checkDns resolves host.
+func (p *Prober) checkDns(host string, timeout time.Duration) ProbeCheck {
+	check := ProbeCheck{Name: "dns", Target: host}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := (&net.Resolver{}).LookupHost(ctx, host)
+	check.LatencyMs = msSince(start)
+
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	check.Ok = true
+	return check
+}
+
+// checkTcp opens and closes a TCP connection to target.
+func (p *Prober) checkTcp(target string, timeout time.Duration) ProbeCheck {
+	check := ProbeCheck{Name: "tcp", Target: target}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	check.LatencyMs = msSince(start)
+
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	conn.Close()
+
+	check.Ok = true
+	return check
+}
+
+// checkHttp requests url without following redirects. A redirect or a
+// success other than the expected status indicates a captive portal,
+// any other status a failing target.
+func (p *Prober) checkHttp(url string, timeout time.Duration) (ProbeCheck, bool) {
+	check := ProbeCheck{Name: "http", Target: url}
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	res, err := client.Get(url)
+	check.LatencyMs = msSince(start)
+
+	if err != nil {
+		check.Error = err.Error()
+		return check, false
+	}
+	res.Body.Close()
+
+	if res.StatusCode != p.ProbeCfg.HttpStatus {
+		check.Error = "unexpected status " + res.Status
+		return check, res.StatusCode >= 200 && res.StatusCode < 400
+	}
+
+	check.Ok = true
+	return check, false
+}
+
+// msSince returns the milliseconds elapsed since start.
+func msSince(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
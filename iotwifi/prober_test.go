@@ -0,0 +1,139 @@
+package iotwifi
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// closedTarget returns the address of a local TCP port nothing listens
+// on.
+func closedTarget(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := listener.Addr().String()
+	listener.Close()
+
+	return target
+}
+
+func TestProberStates(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	open := listener.Addr().String()
+	closed := closedTarget(t)
+
+	servers := []*httptest.Server{}
+	defer func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}()
+	status := func(code int) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if code == http.StatusFound {
+				http.Redirect(w, r, "http://portal.example/login", code)
+				return
+			}
+			w.WriteHeader(code)
+		}))
+		servers = append(servers, srv)
+		return srv.URL
+	}
+	noContent := status(http.StatusNoContent)
+	redirect := status(http.StatusFound)
+	ok := status(http.StatusOK)
+	unavailable := status(http.StatusServiceUnavailable)
+	notFound := status(http.StatusNotFound)
+	down := "http://" + closed + "/generate_204"
+
+	for _, tc := range []struct {
+		name   string
+		cfg    ProbeCfg
+		state  string
+		checks []bool
+	}{
+		{"online", ProbeCfg{DnsHost: "localhost", TcpTarget: open, HttpUrl: noContent}, ConnOnline, []bool{true, true, true}},
+		{"tcp only", ProbeCfg{TcpTarget: open}, ConnOnline, []bool{true}},
+		{"limited", ProbeCfg{TcpTarget: closed, HttpUrl: noContent}, ConnLimited, []bool{false, true}},
+		{"offline", ProbeCfg{TcpTarget: closed, HttpUrl: down}, ConnOffline, []bool{false, false}},
+		{"captive redirect", ProbeCfg{TcpTarget: open, HttpUrl: redirect}, ConnCaptive, []bool{true, false}},
+		{"captive page", ProbeCfg{HttpUrl: ok}, ConnCaptive, []bool{false}},
+		{"server error", ProbeCfg{TcpTarget: open, HttpUrl: unavailable}, ConnLimited, []bool{true, false}},
+		{"not found", ProbeCfg{HttpUrl: notFound}, ConnOffline, []bool{false}},
+		{"expected status", ProbeCfg{HttpUrl: ok, HttpStatus: http.StatusOK}, ConnOnline, []bool{true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			if cfg.HttpStatus == 0 {
+				cfg.HttpStatus = http.StatusNoContent
+			}
+			cfg.Timeout = 2
+
+			log := testLogger(t)
+			prober := NewProber(log, cfg, NewEventBus(log))
+
+			conn := prober.Probe()
+			if conn.State != tc.state {
+				t.Errorf("state %s, want %s: %+v", conn.State, tc.state, conn.Checks)
+			}
+
+			checks := []bool{}
+			for _, check := range conn.Checks {
+				checks = append(checks, check.Ok)
+			}
+			if !reflect.DeepEqual(checks, tc.checks) {
+				t.Errorf("checks %v, want %v", checks, tc.checks)
+			}
+
+			if last := prober.Last(); last.State != conn.State {
+				t.Errorf("Last() = %s, want %s", last.State, conn.State)
+			}
+		})
+	}
+}
+
+func TestProberEvents(t *testing.T) {
+	log := testLogger(t)
+	events := NewEventBus(log)
+
+	published := []string{}
+	events.Subscribe(func(event Event) {
+		if event.Type == EventConnectivity {
+			published = append(published, event.Message)
+		}
+	})
+
+	prober := NewProber(log, ProbeCfg{TcpTarget: closedTarget(t), Timeout: 2}, events)
+	if prober.Last().State != ConnUnknown {
+		t.Errorf("initial state %s", prober.Last().State)
+	}
+
+	// only changes are published
+	prober.Probe()
+	prober.Probe()
+
+	if want := []string{"Connectivity unknown -> offline"}; !reflect.DeepEqual(published, want) {
+		t.Errorf("events %v, want %v", published, want)
+	}
+
+	if (&Prober{}).Enabled() {
+		t.Error("prober without checks enabled")
+	}
+}
@@ -0,0 +1,179 @@
+package iotwifi
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Provisioning states.
+const (
+	ProvisionIdle    = "idle"
+	ProvisionPending = "pending"
+	ProvisionSuccess = "success"
+	ProvisionFailed  = "failed"
+)
+
+// ProvisionStatus tracks a provisioning run that wpa_supplicant
+// completes on its own, such as WPS or DPP, reporting the outcome in
+// its output. A run succeeds once the station associates with the
+// network it received. Runs publish the same connect_attempt and
+// connect_result events as ConnectNetwork.
+type ProvisionStatus struct {
+	Method     string    `json:"method"`
+	State      string    `json:"state"`
+	Pin        string    `json:"pin,omitempty"`
+	Message    string    `json:"message"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// ErrProvisionPending is returned when a provisioning run is started
+// while another is pending.
+var ErrProvisionPending = errors.New("a provisioning run is already pending")
+
+// Provision returns the status of the last provisioning run.
+func (wpa *WpaCfg) Provision() ProvisionStatus {
+	wpa.mu.Lock()
+	defer wpa.mu.Unlock()
+
+	if wpa.provision.State == "" {
+		return ProvisionStatus{State: ProvisionIdle}
+	}
+
+	return wpa.provision
+}
+
+// startProvision marks a provisioning run as pending. The run fails
+// if wpa_supplicant has not reported an outcome within timeout.
+func (wpa *WpaCfg) startProvision(method string, timeout time.Duration) error {
+	wpa.mu.Lock()
+	if wpa.provision.State == ProvisionPending {
+		wpa.mu.Unlock()
+		return ErrProvisionPending
+	}
+	started := time.Now()
+	wpa.provision = ProvisionStatus{
+		Method:    method,
+		State:     ProvisionPending,
+		StartedAt: started,
+	}
+	wpa.received = false
+	wpa.mu.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		wpa.mu.Lock()
+		stale := !wpa.provision.StartedAt.Equal(started)
+		wpa.mu.Unlock()
+
+		if !stale {
+			wpa.finishProvision(ProvisionFailed, "No outcome reported within "+timeout.String())
+		}
+	})
+
+	wpa.Events.Publish(Event{
+		Type:    EventConnectAttempt,
+		Message: "Provisioning with " + method,
+		Payload: map[string]string{"method": method},
+	})
+
+	return nil
+}
+
+// receiveProvision records that wpa_supplicant received the network of
+// the pending provisioning run. The run stays pending until the station
+// associates with it.
+func (wpa *WpaCfg) receiveProvision(message string) {
+	wpa.mu.Lock()
+	defer wpa.mu.Unlock()
+
+	if wpa.provision.State != ProvisionPending {
+		return
+	}
+	wpa.provision.Message = message
+	wpa.received = true
+}
+
+// connectProvision completes the pending provisioning run when the
+// station associates after receiving its network.
+func (wpa *WpaCfg) connectProvision() {
+	wpa.mu.Lock()
+	received := wpa.provision.State == ProvisionPending && wpa.received
+	wpa.mu.Unlock()
+
+	if received {
+		wpa.finishProvision(ProvisionSuccess, "Connected to the received network")
+	}
+}
+
+// finishProvision records the outcome of the pending provisioning run
+// and hands it to CompleteProvisions, so it is safe to call from the
+// wpa_supplicant message handler.
+func (wpa *WpaCfg) finishProvision(state string, message string) {
+	wpa.mu.Lock()
+	if wpa.provision.State != ProvisionPending {
+		wpa.mu.Unlock()
+		return
+	}
+	wpa.provision.State = state
+	wpa.provision.Message = message
+	wpa.provision.FinishedAt = time.Now()
+	status := wpa.provision
+	wpa.mu.Unlock()
+
+	select {
+	case wpa.provisioned <- status:
+	default:
+		wpa.Log.Error("Provisioning with %s %s, dropped while completions are backed up", status.Method, state)
+	}
+}
+
+// CompleteProvisions stops DPP listening, publishes the outcome and
+// saves the received network of finished provisioning runs, one run at
+// a time, until the process exits.
+func (wpa *WpaCfg) CompleteProvisions() {
+	for status := range wpa.provisioned {
+		wpa.completeProvision(status)
+	}
+}
+
+// completeProvision publishes the outcome of a finished provisioning
+// run. On success the received network is saved.
+func (wpa *WpaCfg) completeProvision(status ProvisionStatus) {
+	if status.Method == ProvisionDpp {
+		wpa.dppStopListen()
+	}
+
+	wpa.Events.Publish(Event{
+		Type:    EventConnectResult,
+		Message: "Provisioning with " + status.Method + " " + status.State + ": " + status.Message,
+		Payload: status,
+	})
+
+	if status.State != ProvisionSuccess {
+		return
+	}
+
+	saveOut, err := exec.Command("wpa_cli", "-i", "wlan0", "save_config").Output()
+	if err != nil {
+		wpa.Log.Error("WPA save after %s failed: %s", status.Method, err.Error())
+		return
+	}
+	wpa.Log.Info("WPA save got: %s", strings.TrimSpace(string(saveOut)))
+
+	wpa.Events.Publish(Event{
+		Type:    EventConfigChanged,
+		Message: "Saved network provisioned with " + status.Method + " to " + wpa.WpaCfg.WpaSupplicantCfg.CfgFile,
+		Payload: map[string]string{"method": status.Method, "file": wpa.WpaCfg.WpaSupplicantCfg.CfgFile},
+	})
+
+	wpa.Prober.Trigger()
+}
+
+// setProvisionPin records the pin of the pending provisioning run.
+func (wpa *WpaCfg) setProvisionPin(pin string) {
+	wpa.mu.Lock()
+	wpa.provision.Pin = pin
+	wpa.mu.Unlock()
+}
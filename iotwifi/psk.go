@@ -0,0 +1,283 @@
+package iotwifi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pskRounds is the PBKDF2 iteration count IEEE 802.11 uses to derive a
+// PSK from a passphrase.
+const pskRounds = 4096
+
+// DerivePsk derives the 256 bit WPA2-Personal key for a passphrase,
+// PBKDF2-SHA1 salted with the ssid, as 64 hex digits. wpa_supplicant and
+// hostapd accept the result in place of the passphrase.
+func DerivePsk(ssid string, passphrase string) string {
+	return hex.EncodeToString(pbkdf2Sha1([]byte(passphrase), []byte(ssid), pskRounds, 32))
+}
+
+// pbkdf2Sha1 implements PBKDF2 from RFC 2898 with HMAC-SHA1.
+func pbkdf2Sha1(password []byte, salt []byte, rounds int, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+
+	key := make([]byte, 0, keyLen+sha1.Size)
+	block := make([]byte, 4)
+	for i := uint32(1); len(key) < keyLen; i++ {
+		binary.BigEndian.PutUint32(block, i)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(block)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for n := 1; n < rounds; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+// apPsk returns the AP key, wpa_psk when set and otherwise derived from
+// wpa_passphrase.
+func (wpa *WpaCfg) apPsk() string {
+	cfg := wpa.WpaCfg.HostApdCfg
+	if cfg.WpaPsk != "" {
+		return strings.ToLower(cfg.WpaPsk)
+	}
+
+	if cfg.WpaPassphrase == "" {
+		return ""
+	}
+
+	return DerivePsk(cfg.Ssid, cfg.WpaPassphrase)
+}
+
+// SAE (WPA3-Personal) runs its handshake on the passphrase itself, so
+// it can not be replaced by a derived key. SAE networks are saved with
+// mem_only_psk, which keeps the passphrase out of wpa_supplicant.conf,
+// and the passphrase is kept encrypted in the secrets file instead.
+// wpa_supplicant asks for it with a CTRL-REQ-PSK_PASSPHRASE request when
+// it next needs the network.
+
+// rPskRequest matches a passphrase request for a mem_only_psk network.
+var rPskRequest = regexp.MustCompile(`CTRL-REQ-PSK_PASSPHRASE-(\d+):.* for SSID (.*)$`)
+
+// sealedPrefix marks a passphrase encrypted with the secrets key.
+// Passphrases without it were saved in plaintext by older versions and
+// are encrypted when the secrets file is next written.
+const sealedPrefix = "aes-gcm:"
+
+// secretsKey reads the AES-256 key of the secrets file, creating it when
+// missing.
+func (wpa *WpaCfg) secretsKey() ([]byte, error) {
+	path := wpa.WpaCfg.WpaSupplicantCfg.SecretsKeyFile
+
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, errors.New(path + " is not a 32 byte key")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, key, 0600); err != nil {
+		return nil, err
+	}
+
+	return key, os.Rename(tmp, path)
+}
+
+// sealSecret encrypts a passphrase, prefixing the random nonce.
+func sealSecret(key []byte, passphrase string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(passphrase), nil)), nil
+}
+
+// openSecret decrypts a passphrase sealed with sealSecret. Plaintext
+// passphrases are returned as is.
+func openSecret(key []byte, value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed passphrase is too short")
+	}
+
+	passphrase, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(passphrase), nil
+}
+
+// loadSecrets reads and decrypts the SAE passphrases, keyed by ssid.
+func (wpa *WpaCfg) loadSecrets() (map[string]string, error) {
+	secrets := make(map[string]string, 0)
+
+	data, err := ioutil.ReadFile(wpa.WpaCfg.WpaSupplicantCfg.SecretsFile)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return secrets, err
+	}
+
+	sealed := make(map[string]string, 0)
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return secrets, err
+	}
+
+	key, err := wpa.secretsKey()
+	if err != nil {
+		return secrets, err
+	}
+
+	for ssid, value := range sealed {
+		passphrase, err := openSecret(key, value)
+		if err != nil {
+			return secrets, errors.New("passphrase of " + ssid + ": " + err.Error())
+		}
+		secrets[ssid] = passphrase
+	}
+
+	return secrets, nil
+}
+
+// storeSecret saves the SAE passphrase of an ssid. The secrets file is
+// only readable by its owner, has every passphrase encrypted and is
+// replaced in one rename.
+func (wpa *WpaCfg) storeSecret(ssid string, passphrase string) error {
+	wpa.mu.Lock()
+	defer wpa.mu.Unlock()
+
+	secrets, err := wpa.loadSecrets()
+	if err != nil {
+		return err
+	}
+	secrets[ssid] = passphrase
+
+	key, err := wpa.secretsKey()
+	if err != nil {
+		return err
+	}
+
+	sealed := make(map[string]string, len(secrets))
+	for ssid, passphrase := range secrets {
+		if sealed[ssid], err = sealSecret(key, passphrase); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+
+	path := wpa.WpaCfg.WpaSupplicantCfg.SecretsFile
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// handlePskRequest answers a passphrase request for a saved SAE network
+// from the secrets file.
+func (wpa *WpaCfg) handlePskRequest(line string) {
+	ms := rPskRequest.FindStringSubmatch(line)
+	if len(ms) < 3 {
+		return
+	}
+	id, ssid := ms[1], decodeSsid(strings.TrimSpace(ms[2]))
+
+	wpa.mu.Lock()
+	secrets, err := wpa.loadSecrets()
+	wpa.mu.Unlock()
+	if err != nil {
+		wpa.Log.Error("Could not read secrets file: %s", err.Error())
+		return
+	}
+
+	passphrase, ok := secrets[ssid]
+	if !ok {
+		wpa.Log.Info("WPA no stored passphrase for network %s", id)
+		return
+	}
+
+	out, err := wpa.wpaCtrl("CTRL-RSP-PSK_PASSPHRASE-" + id + ":" + passphrase)
+	if err != nil {
+		wpa.Log.Error("WPA psk_passphrase failed: %s", err.Error())
+		return
+	}
+	wpa.Log.Info("WPA psk_passphrase got: %s", out)
+}
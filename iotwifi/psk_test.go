@@ -0,0 +1,179 @@
+package iotwifi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDerivePsk(t *testing.T) {
+	// IEEE 802.11 Annex J test vectors
+	for _, tc := range []struct {
+		ssid       string
+		passphrase string
+		psk        string
+	}{
+		{"IEEE", "password", "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e"},
+		{"ThisIsASSID", "ThisIsAPassword", "0dc0d6eb90555ed6419756b9a15ec3e3209b63df707dd508d14581f8982721af"},
+	} {
+		if got := DerivePsk(tc.ssid, tc.passphrase); got != tc.psk {
+			t.Errorf("DerivePsk(%q, %q) = %s, want %s", tc.ssid, tc.passphrase, got, tc.psk)
+		}
+	}
+}
+
+func TestSealSecret(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	sealed, err := sealSecret(key, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains([]byte(sealed), []byte("correct horse")) {
+		t.Fatalf("sealed passphrase %s holds the plaintext", sealed)
+	}
+
+	if got, err := openSecret(key, sealed); err != nil || got != "correct horse" {
+		t.Errorf("openSecret() = %q, %v", got, err)
+	}
+
+	if _, err := openSecret(bytes.Repeat([]byte{0x43}, 32), sealed); err == nil {
+		t.Error("opened with the wrong key")
+	}
+
+	if got, err := openSecret(key, "plaintext passphrase"); err != nil || got != "plaintext passphrase" {
+		t.Errorf("legacy passphrase = %q, %v", got, err)
+	}
+}
+
+// testSecretsWpaCfg returns a WpaCfg whose secrets files are in dir.
+func testSecretsWpaCfg(t *testing.T, dir string) *WpaCfg {
+	wpa := testWpaCfg(t)
+	wpa.WpaCfg.WpaSupplicantCfg.SecretsFile = filepath.Join(dir, "secrets.json")
+	wpa.WpaCfg.WpaSupplicantCfg.SecretsKeyFile = filepath.Join(dir, "key", "secrets.key")
+
+	return wpa
+}
+
+func TestStoreSecret(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	wpa := testSecretsWpaCfg(t, dir)
+
+	// a file saved in plaintext by an older version
+	if err := ioutil.WriteFile(wpa.WpaCfg.WpaSupplicantCfg.SecretsFile, []byte(`{"old":"old passphrase"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wpa.storeSecret("home", "new passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(wpa.WpaCfg.WpaSupplicantCfg.SecretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("passphrase")) {
+		t.Errorf("secrets file holds plaintext: %s", data)
+	}
+
+	sealed := map[string]string{}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != 2 {
+		t.Errorf("secrets file has %d entries, want 2", len(sealed))
+	}
+
+	for _, path := range []string{wpa.WpaCfg.WpaSupplicantCfg.SecretsFile, wpa.WpaCfg.WpaSupplicantCfg.SecretsKeyFile} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: %v %v, want mode 0600", path, info, err)
+		}
+	}
+
+	// a restart reads them back with the saved key
+	secrets, err := testSecretsWpaCfg(t, dir).loadSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets["old"] != "old passphrase" || secrets["home"] != "new passphrase" {
+		t.Errorf("loadSecrets() = %v", secrets)
+	}
+}
+
+func TestHandlePskRequest(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	wpa := testSecretsWpaCfg(t, dir)
+	commands, cleanup := fakeWpaCtrl(t, wpa, "OK")
+	defer cleanup()
+
+	if err := wpa.storeSecret("home", "sae passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	wpa.handlePskRequest("<3>CTRL-REQ-PSK_PASSPHRASE-2:PSK passphrase for SSID home")
+	wpa.handlePskRequest("<3>CTRL-REQ-PSK_PASSPHRASE-3:PSK passphrase for SSID unknown")
+
+	select {
+	case command := <-commands:
+		if command != "CTRL-RSP-PSK_PASSPHRASE-2:sae passphrase" {
+			t.Errorf("control socket got %q", command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("passphrase not sent")
+	}
+
+	select {
+	case command := <-commands:
+		t.Errorf("unknown ssid answered with %q", command)
+	default:
+	}
+}
+
+func TestHandlePskRequestAsync(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	wpa := testSecretsWpaCfg(t, dir)
+	if err := wpa.storeSecret("home", "sae passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a control socket that never answers
+	wpa.WpaCfg.WpaSupplicantCfg.CtrlInterface = dir
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "wlan0"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		wpa.HandleSupplicantMessage(CmdMessage{Id: "wpa_supplicant", Message: "<3>CTRL-REQ-PSK_PASSPHRASE-2:PSK passphrase for SSID home"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("message handler waited for the control socket")
+	}
+}
+
+func TestWpaCtrlFail(t *testing.T) {
+	wpa := testWpaCfg(t)
+	_, cleanup := fakeWpaCtrl(t, wpa, "FAIL")
+	defer cleanup()
+
+	if _, err := wpa.wpaCtrl("SET_NETWORK 0 psk 00"); err == nil {
+		t.Error("FAIL reply returned no error")
+	}
+}
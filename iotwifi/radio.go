@@ -0,0 +1,549 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RadioAuto lets PlaceRadios pick a PHY.
+const RadioAuto = "auto"
+
+// Radio describes a wireless PHY and what it can do, as reported by
+// iw list.
+type Radio struct {
+	Phy          string             `json:"phy"`
+	Interfaces   []string           `json:"interfaces"`
+	Modes        []string           `json:"modes"`
+	Bands        []RadioBand        `json:"bands"`
+	Combinations []RadioCombination `json:"combinations"`
+	ApStation    bool               `json:"ap_station"`
+}
+
+// RadioBand is a frequency band supported by a Radio.
+type RadioBand struct {
+	Band     string         `json:"band"`
+	Channels []RadioChannel `json:"channels"`
+}
+
+// RadioChannel is a channel of a RadioBand.
+type RadioChannel struct {
+	Channel   int     `json:"channel"`
+	Frequency int     `json:"frequency"`
+	MaxPower  float64 `json:"max_power"`
+	Disabled  bool    `json:"disabled"`
+	NoIr      bool    `json:"no_ir"`
+	Radar     bool    `json:"radar"`
+}
+
+// RadioCombination is a valid combination of interfaces on a Radio.
+// Each limit caps the interfaces of its types, Total caps all of them
+// and Channels is how many channels they may use at once.
+type RadioCombination struct {
+	Limits   []RadioLimit `json:"limits"`
+	Total    int          `json:"total"`
+	Channels int          `json:"channels"`
+}
+
+// RadioLimit caps the number of interfaces of some types.
+type RadioLimit struct {
+	Types []string `json:"types"`
+	Max   int      `json:"max"`
+}
+
+// RadioPlacement is the PHY the station and the AP run on. Shared is
+// set when both run on one PHY, which ties the AP to the station's
+// channel.
+type RadioPlacement struct {
+	StationPhy string `json:"station_phy"`
+	ApPhy      string `json:"ap_phy"`
+	Shared     bool   `json:"shared"`
+}
+
+// RadioStatus is the payload of the radios endpoint.
+type RadioStatus struct {
+	Radios    []Radio        `json:"radios"`
+	Placement RadioPlacement `json:"placement"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// Supports reports whether the radio has an interface mode, such as
+// managed or AP.
+func (r Radio) Supports(mode string) bool {
+	for _, m := range r.Modes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Concurrent reports whether one of the radio's interface combinations
+// allows an interface of each mode at the same time.
+func (r Radio) Concurrent(modes ...string) bool {
+	for _, combination := range r.Combinations {
+		if combination.allows(modes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows reports whether the combination fits an interface of each
+// mode.
+func (c RadioCombination) allows(modes []string) bool {
+	if c.Total < len(modes) {
+		return false
+	}
+
+	used := make([]int, len(c.Limits))
+	for _, mode := range modes {
+		placed := false
+		for i, limit := range c.Limits {
+			if used[i] < limit.Max && containsString(limit.Types, mode) {
+				used[i]++
+				placed = true
+				break
+			}
+		}
+
+		if !placed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ListRadios reads the capabilities of every wireless PHY.
+func ListRadios() ([]Radio, error) {
+	out, err := exec.Command("iw", "list").Output()
+	if err != nil {
+		return nil, errors.New("iw list failed: " + err.Error())
+	}
+
+	radios := parseIwList(string(out))
+
+	interfaces := phyInterfaces()
+	for i := range radios {
+		radios[i].Interfaces = interfaces[radios[i].Phy]
+		if radios[i].Interfaces == nil {
+			radios[i].Interfaces = []string{}
+		}
+	}
+
+	return radios, nil
+}
+
+// phyInterfaces maps each PHY to its network interfaces.
+func phyInterfaces() map[string][]string {
+	interfaces := make(map[string][]string, 0)
+
+	paths, _ := filepath.Glob("/sys/class/net/*/phy80211/name")
+	for _, path := range paths {
+		phy, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		name := strings.TrimSpace(string(phy))
+		iface := filepath.Base(filepath.Dir(filepath.Dir(path)))
+		interfaces[name] = append(interfaces[name], iface)
+	}
+
+	for _, ifaces := range interfaces {
+		sort.Strings(ifaces)
+	}
+
+	return interfaces
+}
+
+// interfacePhy returns the PHY of a network interface, empty when the
+// interface does not exist.
+func interfacePhy(iface string) string {
+	phy, err := ioutil.ReadFile("/sys/class/net/" + iface + "/phy80211/name")
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(phy))
+}
+
+var (
+	rIwFrequency = regexp.MustCompile(`^\*\s+(\d+)(?:\.\d+)?\s+MHz\s+\[(\d+)\](.*)$`)
+	rIwPower     = regexp.MustCompile(`\(([\d.]+) dBm\)`)
+	rIwLimit     = regexp.MustCompile(`#\{\s*([^}]*?)\s*\}\s*<=\s*(\d+)`)
+	rIwTotal     = regexp.MustCompile(`total\s*<=\s*(\d+)`)
+	rIwChannels  = regexp.MustCompile(`#channels\s*<=\s*(\d+)`)
+)
+
+// parseIwList reads the PHYs in iw list output. Sections are told apart
+// by their tab indentation.
+func parseIwList(out string) []Radio {
+	radios := []Radio{}
+
+	var radio *Radio
+	var band *RadioBand
+	section := ""
+	combination := ""
+
+	flushCombination := func() {
+		if radio != nil && combination != "" {
+			radio.Combinations = append(radio.Combinations, parseCombination(combination))
+		}
+		combination = ""
+	}
+
+	flushRadio := func() {
+		flushCombination()
+		if radio == nil {
+			return
+		}
+		if band != nil {
+			radio.Bands = append(radio.Bands, *band)
+			band = nil
+		}
+		radio.ApStation = radio.Concurrent("managed", "AP")
+		radios = append(radios, *radio)
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+
+		if depth == 0 {
+			flushRadio()
+			radio = nil
+			if strings.HasPrefix(text, "Wiphy ") {
+				radio = &Radio{
+					Phy:          strings.TrimSpace(strings.TrimPrefix(text, "Wiphy ")),
+					Modes:        []string{},
+					Bands:        []RadioBand{},
+					Combinations: []RadioCombination{},
+				}
+			}
+			section = ""
+			continue
+		}
+
+		if radio == nil {
+			continue
+		}
+
+		if depth == 1 {
+			flushCombination()
+			if band != nil {
+				radio.Bands = append(radio.Bands, *band)
+				band = nil
+			}
+
+			section = text
+			if strings.HasPrefix(text, "Band ") {
+				band = &RadioBand{Channels: []RadioChannel{}}
+			}
+			continue
+		}
+
+		switch {
+		case section == "Supported interface modes:":
+			if strings.HasPrefix(text, "* ") {
+				radio.Modes = append(radio.Modes, strings.TrimSpace(text[2:]))
+			}
+
+		case band != nil:
+			ms := rIwFrequency.FindStringSubmatch(text)
+			if len(ms) < 4 {
+				continue
+			}
+
+			channel := RadioChannel{
+				Disabled: strings.Contains(ms[3], "disabled"),
+				NoIr:     strings.Contains(ms[3], "no IR"),
+				Radar:    strings.Contains(ms[3], "radar detection"),
+			}
+			channel.Frequency, _ = strconv.Atoi(ms[1])
+			channel.Channel, _ = strconv.Atoi(ms[2])
+			if power := rIwPower.FindStringSubmatch(ms[3]); len(power) > 1 {
+				channel.MaxPower, _ = strconv.ParseFloat(power[1], 64)
+			}
+
+			if band.Band == "" {
+				band.Band = frequencyBand(channel.Frequency)
+			}
+			band.Channels = append(band.Channels, channel)
+
+		case section == "valid interface combinations:":
+			// a combination starts with "* " and may wrap onto more lines
+			if strings.HasPrefix(text, "* ") {
+				flushCombination()
+				combination = text[2:]
+			} else if combination != "" {
+				combination += " " + text
+			}
+		}
+	}
+	flushRadio()
+
+	return radios
+}
+
+// parseCombination reads an iw interface combination such as
+// "#{ managed } <= 1, #{ AP } <= 1, total <= 2, #channels <= 1".
+func parseCombination(text string) RadioCombination {
+	combination := RadioCombination{Limits: []RadioLimit{}}
+
+	for _, ms := range rIwLimit.FindAllStringSubmatch(text, -1) {
+		limit := RadioLimit{Types: []string{}}
+		for _, t := range strings.Split(ms[1], ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				limit.Types = append(limit.Types, t)
+			}
+		}
+		limit.Max, _ = strconv.Atoi(ms[2])
+		combination.Limits = append(combination.Limits, limit)
+	}
+
+	if ms := rIwTotal.FindStringSubmatch(text); len(ms) > 1 {
+		combination.Total, _ = strconv.Atoi(ms[1])
+	}
+	if ms := rIwChannels.FindStringSubmatch(text); len(ms) > 1 {
+		combination.Channels, _ = strconv.Atoi(ms[1])
+	}
+
+	return combination
+}
+
+// frequencyBand names the band of a frequency in MHz.
+func frequencyBand(mhz int) string {
+	switch {
+	case mhz < 3000:
+		return "2.4GHz"
+	case mhz < 5925:
+		return "5GHz"
+	case mhz < 7200:
+		return "6GHz"
+	}
+
+	return "60GHz"
+}
+
+// placeRadios picks the PHYs for the station and the AP. current is the
+// PHY the station interface is on, empty when there is none. A second
+// radio able to run an AP is preferred for the AP, otherwise the AP
+// shares the station's PHY when its interface combinations allow it.
+// needStation is false in ap-only mode, where there is no station and
+// the AP takes the first PHY with AP mode.
+func placeRadios(radios []Radio, cfg RadioCfg, current string, needStation bool) (RadioPlacement, error) {
+	placement := RadioPlacement{}
+
+	byPhy := make(map[string]Radio, len(radios))
+	for _, radio := range radios {
+		byPhy[radio.Phy] = radio
+	}
+
+	if !needStation {
+		return placeAp(radios, byPhy, cfg)
+	}
+
+	switch {
+	case cfg.StationPhy != RadioAuto:
+		radio, ok := byPhy[cfg.StationPhy]
+		if !ok {
+			return placement, errors.New("station_phy " + cfg.StationPhy + " does not exist")
+		}
+		if !radio.Supports("managed") {
+			return placement, errors.New("station_phy " + cfg.StationPhy + " does not support station (managed) mode")
+		}
+		placement.StationPhy = cfg.StationPhy
+	case current != "":
+		placement.StationPhy = current
+	default:
+		for _, radio := range radios {
+			if radio.Supports("managed") {
+				placement.StationPhy = radio.Phy
+				break
+			}
+		}
+		if placement.StationPhy == "" {
+			return placement, errors.New("no radio supports station (managed) mode")
+		}
+	}
+
+	station := byPhy[placement.StationPhy]
+	canShare := station.Concurrent("managed", "AP")
+
+	if cfg.ApPhy != RadioAuto {
+		radio, ok := byPhy[cfg.ApPhy]
+		if !ok {
+			return placement, errors.New("ap_phy " + cfg.ApPhy + " does not exist")
+		}
+		if !radio.Supports("AP") {
+			return placement, errors.New("ap_phy " + cfg.ApPhy + " does not support AP mode")
+		}
+		if cfg.ApPhy == placement.StationPhy && !canShare {
+			return placement, errors.New("ap_phy " + cfg.ApPhy + " can not run an AP alongside the station, none of its interface combinations allow managed and AP at once")
+		}
+		placement.ApPhy = cfg.ApPhy
+	} else {
+		for _, radio := range radios {
+			if radio.Phy != placement.StationPhy && radio.Supports("AP") {
+				placement.ApPhy = radio.Phy
+				break
+			}
+		}
+
+		if placement.ApPhy == "" && station.Supports("AP") && canShare {
+			placement.ApPhy = placement.StationPhy
+		}
+
+		if placement.ApPhy == "" {
+			return placement, errors.New("no radio can host the AP: " + placement.StationPhy + " can not run an AP alongside the station and there is no second radio with AP mode")
+		}
+	}
+
+	placement.Shared = placement.ApPhy == placement.StationPhy
+
+	return placement, nil
+}
+
+// placeAp picks the PHY for the AP when there is no station.
+func placeAp(radios []Radio, byPhy map[string]Radio, cfg RadioCfg) (RadioPlacement, error) {
+	placement := RadioPlacement{}
+
+	if cfg.ApPhy != RadioAuto {
+		radio, ok := byPhy[cfg.ApPhy]
+		if !ok {
+			return placement, errors.New("ap_phy " + cfg.ApPhy + " does not exist")
+		}
+		if !radio.Supports("AP") {
+			return placement, errors.New("ap_phy " + cfg.ApPhy + " does not support AP mode")
+		}
+		placement.ApPhy = cfg.ApPhy
+
+		return placement, nil
+	}
+
+	for _, radio := range radios {
+		if radio.Supports("AP") {
+			placement.ApPhy = radio.Phy
+			return placement, nil
+		}
+	}
+
+	return placement, errors.New("no radio supports AP mode")
+}
+
+// PlaceRadios reads the radios and picks the PHYs for the station and
+// the AP, adding the station interface to its PHY when it is missing or
+// on another one. In ap-only mode wlan0 is left alone. It has to run
+// before wpa_supplicant and hostapd are started.
+func (wpa *WpaCfg) PlaceRadios() (RadioPlacement, error) {
+	current := interfacePhy("wlan0")
+
+	// without iw nothing can be placed or moved, so the interfaces stay
+	// where they always were and the AP goes on phy0 as it did before
+	// radios were placed
+	radios, err := ListRadios()
+	if err != nil {
+		wpa.Log.Warn("Radios not placed, the AP goes on phy0: %s", err.Error())
+		return wpa.setPlacement(RadioPlacement{StationPhy: current, ApPhy: "phy0", Shared: current == "phy0"}, nil)
+	}
+
+	needStation := wpa.WpaCfg.ConnectivityCfg.Mode != ModeApOnly
+
+	placement, err := placeRadios(radios, wpa.WpaCfg.RadioCfg, current, needStation)
+	if err != nil {
+		return wpa.setPlacement(placement, err)
+	}
+
+	if !needStation {
+		wpa.Log.Info("Radios placed, AP on %s", placement.ApPhy)
+		return wpa.setPlacement(placement, nil)
+	}
+
+	if current != placement.StationPhy {
+		if current != "" {
+			if out, err := exec.Command("iw", "dev", "wlan0", "del").CombinedOutput(); err != nil {
+				return wpa.setPlacement(placement, errors.New("could not remove wlan0 from "+current+": "+strings.TrimSpace(string(out)+" "+err.Error())))
+			}
+		}
+
+		if out, err := exec.Command("iw", "phy", placement.StationPhy, "interface", "add", "wlan0", "type", "managed").CombinedOutput(); err != nil {
+			return wpa.setPlacement(placement, errors.New("could not add wlan0 to "+placement.StationPhy+": "+strings.TrimSpace(string(out))))
+		}
+	}
+
+	wpa.Log.Info("Radios placed, station on %s and AP on %s", placement.StationPhy, placement.ApPhy)
+
+	return wpa.setPlacement(placement, nil)
+}
+
+// setPlacement records the outcome of PlaceRadios.
+func (wpa *WpaCfg) setPlacement(placement RadioPlacement, err error) (RadioPlacement, error) {
+	wpa.mu.Lock()
+	wpa.placement = placement
+	wpa.placementErr = err
+	wpa.mu.Unlock()
+
+	return placement, err
+}
+
+// apPhy returns the PHY to add the AP interface to, phy0 when radios
+// have not been placed.
+func (wpa *WpaCfg) apPhy() (string, error) {
+	wpa.mu.Lock()
+	defer wpa.mu.Unlock()
+
+	if wpa.placement.ApPhy != "" {
+		return wpa.placement.ApPhy, nil
+	}
+
+	if wpa.placementErr != nil {
+		return "", wpa.placementErr
+	}
+
+	return "phy0", nil
+}
+
+// Radios returns the radios along with where the station and AP were
+// placed.
+func (wpa *WpaCfg) Radios() RadioStatus {
+	status := RadioStatus{Radios: []Radio{}}
+
+	radios, err := ListRadios()
+	if err == nil {
+		status.Radios = radios
+	}
+
+	wpa.mu.Lock()
+	status.Placement = wpa.placement
+	if wpa.placementErr != nil {
+		status.Error = wpa.placementErr.Error()
+	} else if err != nil {
+		status.Error = err.Error()
+	}
+	wpa.mu.Unlock()
+
+	return status
+}
+
+// containsString reports whether a slice holds s.
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
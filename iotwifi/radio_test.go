@@ -0,0 +1,168 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testRadios parses recorded iw list output from testdata.
+func testRadios(t *testing.T, name string) []Radio {
+	out, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parseIwList(string(out))
+}
+
+func TestParseIwList(t *testing.T) {
+	radios := testRadios(t, "iw-list-brcmfmac.txt")
+	if len(radios) != 1 {
+		t.Fatalf("%d radios, want 1", len(radios))
+	}
+	radio := radios[0]
+
+	if radio.Phy != "phy0" {
+		t.Errorf("phy %q", radio.Phy)
+	}
+	if want := []string{"IBSS", "managed", "AP", "P2P-client", "P2P-GO", "P2P-device"}; !reflect.DeepEqual(radio.Modes, want) {
+		t.Errorf("modes %v, want %v", radio.Modes, want)
+	}
+	if !radio.ApStation {
+		t.Error("managed and AP combination not found")
+	}
+
+	if len(radio.Bands) != 2 || radio.Bands[0].Band != "2.4GHz" || radio.Bands[1].Band != "5GHz" {
+		t.Fatalf("bands %+v", radio.Bands)
+	}
+	if n := len(radio.Bands[0].Channels); n != 14 {
+		t.Errorf("%d 2.4 GHz channels, want 14", n)
+	}
+
+	for _, tc := range []struct {
+		band    int
+		index   int
+		channel RadioChannel
+	}{
+		{0, 0, RadioChannel{Channel: 1, Frequency: 2412, MaxPower: 20}},
+		{0, 11, RadioChannel{Channel: 12, Frequency: 2467, MaxPower: 20, NoIr: true}},
+		{0, 13, RadioChannel{Channel: 14, Frequency: 2484, Disabled: true}},
+		{1, 3, RadioChannel{Channel: 52, Frequency: 5260, MaxPower: 20, NoIr: true, Radar: true}},
+	} {
+		if got := radio.Bands[tc.band].Channels[tc.index]; got != tc.channel {
+			t.Errorf("channel %+v, want %+v", got, tc.channel)
+		}
+	}
+
+	want := []RadioCombination{
+		{
+			Limits: []RadioLimit{
+				{Types: []string{"managed"}, Max: 1},
+				{Types: []string{"P2P-device"}, Max: 1},
+				{Types: []string{"P2P-client", "P2P-GO"}, Max: 1},
+			},
+			Total:    3,
+			Channels: 2,
+		},
+		{
+			Limits: []RadioLimit{
+				{Types: []string{"managed"}, Max: 1},
+				{Types: []string{"AP"}, Max: 1},
+				{Types: []string{"P2P-client"}, Max: 1},
+				{Types: []string{"P2P-device"}, Max: 1},
+			},
+			Total:    4,
+			Channels: 1,
+		},
+	}
+	if !reflect.DeepEqual(radio.Combinations, want) {
+		t.Errorf("combinations %+v, want %+v", radio.Combinations, want)
+	}
+}
+
+func TestParseIwListRadios(t *testing.T) {
+	for _, tc := range []struct {
+		file      string
+		phys      []string
+		apStation []bool
+		modes     [][]string
+	}{
+		{
+			"iw-list-dual.txt",
+			[]string{"phy0", "phy1"},
+			[]bool{true, true},
+			[][]string{
+				{"IBSS", "managed", "AP", "P2P-client", "P2P-GO", "P2P-device"},
+				{"IBSS", "managed", "AP", "AP/VLAN", "WDS", "monitor", "mesh point"},
+			},
+		},
+		{
+			"iw-list-ap-only.txt",
+			[]string{"phy0", "phy1"},
+			[]bool{false, false},
+			[][]string{
+				{"IBSS", "managed", "AP", "P2P-client", "P2P-GO", "P2P-device"},
+				{"AP", "monitor"},
+			},
+		},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			radios := testRadios(t, tc.file)
+			if len(radios) != len(tc.phys) {
+				t.Fatalf("%d radios, want %d", len(radios), len(tc.phys))
+			}
+
+			for i, radio := range radios {
+				if radio.Phy != tc.phys[i] || radio.ApStation != tc.apStation[i] || !reflect.DeepEqual(radio.Modes, tc.modes[i]) {
+					t.Errorf("radio %d: %s ap_station %t modes %v", i, radio.Phy, radio.ApStation, radio.Modes)
+				}
+			}
+		})
+	}
+}
+
+func TestPlaceRadios(t *testing.T) {
+	auto := RadioCfg{StationPhy: RadioAuto, ApPhy: RadioAuto}
+
+	for _, tc := range []struct {
+		name        string
+		file        string
+		cfg         RadioCfg
+		current     string
+		needStation bool
+		placement   RadioPlacement
+		fails       bool
+	}{
+		{"single brcmfmac", "iw-list-brcmfmac.txt", auto, "phy0", true, RadioPlacement{"phy0", "phy0", true}, false},
+		{"single brcmfmac without wlan0", "iw-list-brcmfmac.txt", auto, "", true, RadioPlacement{"phy0", "phy0", true}, false},
+		{"single brcmfmac ap-only", "iw-list-brcmfmac.txt", auto, "phy0", false, RadioPlacement{"", "phy0", false}, false},
+		{"dual radio", "iw-list-dual.txt", auto, "phy0", true, RadioPlacement{"phy0", "phy1", false}, false},
+		{"dual radio station on phy1", "iw-list-dual.txt", auto, "phy1", true, RadioPlacement{"phy1", "phy0", false}, false},
+		{"dual radio shared ap_phy", "iw-list-dual.txt", RadioCfg{StationPhy: RadioAuto, ApPhy: "phy0"}, "phy0", true, RadioPlacement{"phy0", "phy0", true}, false},
+		{"dual radio station_phy", "iw-list-dual.txt", RadioCfg{StationPhy: "phy1", ApPhy: RadioAuto}, "phy0", true, RadioPlacement{"phy1", "phy0", false}, false},
+		{"ap-only radio", "iw-list-ap-only.txt", auto, "phy0", true, RadioPlacement{"phy0", "phy1", false}, false},
+		{"ap-only radio ap_phy shared", "iw-list-ap-only.txt", RadioCfg{StationPhy: RadioAuto, ApPhy: "phy0"}, "phy0", true, RadioPlacement{}, true},
+		{"ap-only radio as station", "iw-list-ap-only.txt", RadioCfg{StationPhy: "phy1", ApPhy: RadioAuto}, "phy0", true, RadioPlacement{}, true},
+		{"ap-only radio ap-only mode", "iw-list-ap-only.txt", RadioCfg{StationPhy: RadioAuto, ApPhy: "phy1"}, "phy0", false, RadioPlacement{"", "phy1", false}, false},
+		{"missing station_phy", "iw-list-brcmfmac.txt", RadioCfg{StationPhy: "phy3", ApPhy: RadioAuto}, "phy0", true, RadioPlacement{}, true},
+		{"missing ap_phy", "iw-list-brcmfmac.txt", RadioCfg{StationPhy: RadioAuto, ApPhy: "phy3"}, "phy0", false, RadioPlacement{}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			placement, err := placeRadios(testRadios(t, tc.file), tc.cfg, tc.current, tc.needStation)
+			if (err != nil) != tc.fails {
+				t.Fatalf("err = %v, want failure %t", err, tc.fails)
+			}
+			if !tc.fails && placement != tc.placement {
+				t.Errorf("placement %+v, want %+v", placement, tc.placement)
+			}
+		})
+	}
+
+	// a lone radio without managed and AP at once can not host both
+	radios := testRadios(t, "iw-list-ap-only.txt")[:1]
+	if _, err := placeRadios(radios, auto, "phy0", true); err == nil {
+		t.Error("lone radio without concurrency: no error")
+	}
+}
@@ -0,0 +1,139 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secret values.
+const Redacted = "[REDACTED]"
+
+// secretFields are the field names whose values are always redacted.
+var secretFields = []string{
+	"psk",
+	"passphrase",
+	"wpa_passphrase",
+	"wpa_psk",
+	"sae_password",
+	"password",
+	"network_key",
+	"secret",
+	"token",
+}
+
+// secretPatterns match secrets inside free text such as log messages
+// and wpa_supplicant, hostapd or wpa_cli output. Only the first and
+// second groups are kept.
+var secretPatterns = []*regexp.Regexp{
+	// psk=..., wpa_passphrase=..., password: "..." and psk:|...|
+	regexp.MustCompile(`(?i)(\b(?:wpa_passphrase|wpa_psk|sae_password|psk|passphrase|password|network_key|secret|token)\s*[=:]\s*)(?:"[^"]*"|\|[^|]*\||[^\s,;]+)`),
+	// set_network 0 psk "..." from wpa_cli and the control interface
+	regexp.MustCompile(`(?i)(\bset_network\s+\d+\s+(?:psk|sae_password|password|wep_key[0-3])\s+)(?:"[^"]*"|\S+)`),
+	// CTRL-RSP-PSK_PASSPHRASE-1:... answers, the value runs to the end
+	// of the line
+	regexp.MustCompile(`(\bCTRL-RSP-[A-Z0-9_]+-\d+:).*`),
+	// DPP-CONFOBJ-PASS and DPP-CONFOBJ-PSK carry the received key in hex
+	regexp.MustCompile(`(\bDPP-CONFOBJ-(?:PASS|PSK)\s+)\S+`),
+	// key hexdumps from wpa_supplicant and hostapd debug output
+	regexp.MustCompile(`(?i)(\b(?:psk|pmk|ptk|gtk|igtk|kck|kek|tk|passphrase|password)\b[^\n]*?hexdump(?:_ascii)?\(len=\d+\):).*`),
+	// bearer tokens
+	regexp.MustCompile(`(?i)(\bbearer\s+)\S+`),
+	// passwords in urls
+	regexp.MustCompile(`(://[^/\s:@]+:)[^@\s/]+(@)`),
+}
+
+// isSecretField reports whether a field name holds a secret.
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, field := range secretFields {
+		if name == field || strings.HasSuffix(name, "_"+field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redact returns a JSON compatible copy of v with the values of
+// secret fields replaced.
+func redact(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil
+	}
+
+	return redactValue(generic)
+}
+
+// redactValue walks decoded JSON replacing secret fields.
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			if isSecretField(k) {
+				value[k] = Redacted
+				continue
+			}
+			value[k] = redactValue(field)
+		}
+		return value
+
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(item)
+		}
+		return value
+
+	case string:
+		return redactText(value)
+	}
+
+	return v
+}
+
+// redactText replaces secrets matched by secretPatterns.
+func redactText(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+Redacted+"${2}")
+	}
+
+	return s
+}
+
+// redactWriter redacts bunyan records before they are written.
+type redactWriter struct {
+	w io.Writer
+}
+
+// NewRedactWriter wraps the stream a bunyan logger writes to so secret
+// fields and anything matching secretPatterns are replaced before a
+// record leaves the process.
+func NewRedactWriter(w io.Writer) io.Writer {
+	return &redactWriter{w: w}
+}
+
+// Write implements io.Writer. bunyan writes one JSON record per call,
+// anything else is redacted as text.
+func (r *redactWriter) Write(p []byte) (int, error) {
+	out := []byte(redactText(string(p)))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(p, &record); err == nil {
+		if data, err := json.Marshal(redactValue(record)); err == nil {
+			out = append(data, '\n')
+		}
+	}
+
+	if _, err := r.w.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,288 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RegDomain is a regulatory domain as reported by iw reg get. Scope is
+// global for the domain the kernel applies or the PHY, such as phy#0,
+// of a self-managed radio.
+type RegDomain struct {
+	Scope     string    `json:"scope"`
+	Country   string    `json:"country"`
+	DfsRegion string    `json:"dfs_region"`
+	Rules     []RegRule `json:"rules"`
+}
+
+// RegRule is a frequency range allowed in a RegDomain, with its limits
+// and flags such as NO-IR, DFS or NO-OUTDOOR.
+type RegRule struct {
+	StartMhz     float64  `json:"start_mhz"`
+	EndMhz       float64  `json:"end_mhz"`
+	BandwidthMhz float64  `json:"bandwidth_mhz"`
+	MaxEirpDbm   float64  `json:"max_eirp_dbm"`
+	Flags        []string `json:"flags"`
+}
+
+// RegulatoryStatus is the payload of the regulatory endpoint.
+type RegulatoryStatus struct {
+	Country        string      `json:"country"`
+	Domains        []RegDomain `json:"domains"`
+	ApChannel      string      `json:"ap_channel"`
+	ApChannelError string      `json:"ap_channel_error,omitempty"`
+	Error          string      `json:"error,omitempty"`
+}
+
+var (
+	rCountry = regexp.MustCompile(`^[A-Z]{2}$`)
+	rRegRule = regexp.MustCompile(`^\(([\d.]+) - ([\d.]+) @ ([\d.]+)\), \(([^,]+), ([\d.]+)\)(.*)$`)
+)
+
+// ValidateCountry checks that a country is an ISO 3166-1 alpha-2 code
+// or 00, the world domain.
+func ValidateCountry(country string) error {
+	if country != "00" && !rCountry.MatchString(country) {
+		return errors.New("country must be a two letter ISO 3166-1 code or 00")
+	}
+
+	return nil
+}
+
+// ApplyCountry sets the configured country for the kernel and in the
+// wpa_supplicant config. hostapd gets it in its generated config. It
+// has to run before wpa_supplicant and hostapd are started.
+func (wpa *WpaCfg) ApplyCountry() error {
+	country := wpa.WpaCfg.RegulatoryCfg.Country
+	if country == "" {
+		wpa.Log.Info("No country configured, the radios stay in the world regulatory domain")
+		return nil
+	}
+
+	if err := ValidateCountry(country); err != nil {
+		return err
+	}
+
+	if cfgFile := wpa.WpaCfg.WpaSupplicantCfg.CfgFile; cfgFile != "" {
+		if err := setConfCountry(cfgFile, country); err != nil {
+			wpa.Log.Error("Could not set the country in %s: %s", cfgFile, err.Error())
+		}
+	}
+
+	if out, err := exec.Command("iw", "reg", "set", country).CombinedOutput(); err != nil {
+		return errors.New("iw reg set " + country + " failed: " + strings.TrimSpace(string(out)+" "+err.Error()))
+	}
+
+	wpa.Log.Info("Regulatory domain set to %s", country)
+
+	return nil
+}
+
+// setConfCountry sets the global country parameter of a
+// wpa_supplicant.conf, adding it ahead of the network blocks.
+func setConfCountry(path string, country string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "country=") {
+			lines[i] = "country=" + country
+			found = true
+		}
+	}
+
+	if !found {
+		lines = append([]string{"country=" + country}, lines...)
+	}
+
+	conf := strings.Join(lines, "\n")
+	if conf == string(data) {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte(conf), 0600)
+}
+
+// RegDomains reads the regulatory domains in effect.
+func RegDomains() ([]RegDomain, error) {
+	out, err := exec.Command("iw", "reg", "get").Output()
+	if err != nil {
+		return nil, errors.New("iw reg get failed: " + err.Error())
+	}
+
+	return parseIwReg(string(out)), nil
+}
+
+// parseIwReg reads iw reg get output, a scope line such as global or
+// phy#0 followed by a country line and its rules.
+func parseIwReg(out string) []RegDomain {
+	domains := []RegDomain{}
+
+	var domain *RegDomain
+	scope := "global"
+	for _, line := range strings.Split(out, "\n") {
+		text := strings.TrimSpace(line)
+
+		switch {
+		case text == "":
+			continue
+
+		case strings.HasPrefix(text, "country "):
+			if domain != nil {
+				domains = append(domains, *domain)
+			}
+
+			fields := strings.SplitN(strings.TrimPrefix(text, "country "), ":", 2)
+			domain = &RegDomain{Scope: scope, Country: strings.TrimSpace(fields[0]), Rules: []RegRule{}}
+			if len(fields) > 1 {
+				domain.DfsRegion = strings.TrimPrefix(strings.TrimSpace(fields[1]), "DFS-")
+			}
+
+		case strings.HasPrefix(text, "("):
+			if domain == nil {
+				continue
+			}
+
+			ms := rRegRule.FindStringSubmatch(text)
+			if len(ms) < 7 {
+				continue
+			}
+
+			rule := RegRule{Flags: []string{}}
+			rule.StartMhz, _ = strconv.ParseFloat(ms[1], 64)
+			rule.EndMhz, _ = strconv.ParseFloat(ms[2], 64)
+			rule.BandwidthMhz, _ = strconv.ParseFloat(ms[3], 64)
+			rule.MaxEirpDbm, _ = strconv.ParseFloat(ms[5], 64)
+
+			// after the power come an optional (<n> ms) DFS CAC time and
+			// the flags
+			for _, field := range strings.Split(ms[6], ",") {
+				field = strings.TrimSpace(field)
+				if field == "" || strings.HasPrefix(field, "(") {
+					continue
+				}
+				rule.Flags = append(rule.Flags, field)
+			}
+
+			domain.Rules = append(domain.Rules, rule)
+
+		default:
+			if domain != nil {
+				domains = append(domains, *domain)
+				domain = nil
+			}
+			scope = strings.TrimSpace(strings.TrimSuffix(text, "(self-managed)"))
+		}
+	}
+
+	if domain != nil {
+		domains = append(domains, *domain)
+	}
+
+	return domains
+}
+
+// channelFrequency returns the center frequency of a 2.4 GHz channel,
+// the band hostapd runs the AP in.
+func channelFrequency(channel int) (float64, error) {
+	switch {
+	case channel >= 1 && channel <= 13:
+		return float64(2407 + 5*channel), nil
+	case channel == 14:
+		return 2484, nil
+	}
+
+	return 0, errors.New("channel must be 1 to 14")
+}
+
+// ValidateApChannel checks that a 20 MHz AP channel is inside a rule of
+// domain that allows initiating radiation.
+func ValidateApChannel(domain RegDomain, channel string) error {
+	ch, err := strconv.Atoi(channel)
+	if err != nil {
+		return errors.New("channel " + channel + " is not a number")
+	}
+
+	center, err := channelFrequency(ch)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range domain.Rules {
+		if center-10 < rule.StartMhz || center+10 > rule.EndMhz {
+			continue
+		}
+
+		for _, flag := range rule.Flags {
+			if flag == "NO-IR" || flag == "PASSIVE-SCAN" || flag == "NO-IBSS" {
+				return errors.New("channel " + channel + " may not be used by an AP in " + domain.Country + " (" + flag + ")")
+			}
+		}
+
+		return nil
+	}
+
+	return errors.New("channel " + channel + " is not allowed in " + domain.Country)
+}
+
+// globalDomain returns the global regulatory domain.
+func globalDomain(domains []RegDomain) (RegDomain, bool) {
+	for _, domain := range domains {
+		if domain.Scope == "global" {
+			return domain, true
+		}
+	}
+
+	return RegDomain{}, false
+}
+
+// checkApChannel validates an AP channel against the regulatory domain
+// in effect. It passes when the domain can not be read.
+func (wpa *WpaCfg) checkApChannel(channel string) error {
+	domains, err := RegDomains()
+	if err != nil {
+		return nil
+	}
+
+	domain, ok := globalDomain(domains)
+	if !ok {
+		return nil
+	}
+
+	return ValidateApChannel(domain, channel)
+}
+
+// Regulatory returns the configured country, the regulatory domains in
+// effect and whether the AP channel is allowed.
+func (wpa *WpaCfg) Regulatory() RegulatoryStatus {
+	status := RegulatoryStatus{
+		Country:   wpa.WpaCfg.RegulatoryCfg.Country,
+		Domains:   []RegDomain{},
+		ApChannel: wpa.apChannel(),
+	}
+
+	domains, err := RegDomains()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Domains = domains
+
+	// auto only picks allowed channels
+	if domain, ok := globalDomain(domains); ok && status.ApChannel != ApChannelAuto {
+		if err := ValidateApChannel(domain, status.ApChannel); err != nil {
+			status.ApChannelError = err.Error()
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,170 @@
+package iotwifi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// StationStatus is the typed status of the station interface. Fields
+// that existed in the raw wpa_cli status keep their original names.
+type StationStatus struct {
+	State        string            `json:"wpa_state"`
+	Ssid         string            `json:"ssid"`
+	Bssid        string            `json:"bssid"`
+	Frequency    int               `json:"frequency"`
+	Channel      int               `json:"channel"`
+	KeyMgmt      string            `json:"key_mgmt"`
+	Address      string            `json:"address"`
+	IpAddress    string            `json:"ip_address"`
+	Ipv4         []string          `json:"ipv4"`
+	Ipv6         []string          `json:"ipv6"`
+	Gateway      string            `json:"gateway"`
+	Dns          []string          `json:"dns"`
+	LinkSpeed    int               `json:"link_speed"`
+	Connectivity Connectivity      `json:"connectivity"`
+	Raw          map[string]string `json:"raw"`
+}
+
+// StationStatus returns the typed station status, the raw wpa_cli
+// status is kept in Raw.
+func (wpa *WpaCfg) StationStatus() (StationStatus, error) {
+	status := StationStatus{
+		Ipv4: []string{},
+		Ipv6: []string{},
+		Dns:  []string{},
+	}
+
+	raw, err := wpa.Status()
+	if err != nil {
+		return status, err
+	}
+
+	status.Raw = raw
+	status.State = raw["wpa_state"]
+	status.Ssid = decodeSsid(raw["ssid"])
+	status.Bssid = raw["bssid"]
+	status.KeyMgmt = raw["key_mgmt"]
+	status.Address = raw["address"]
+	status.IpAddress = raw["ip_address"]
+	status.Frequency, _ = strconv.Atoi(raw["freq"])
+	status.Channel = frequencyToChannel(status.Frequency)
+
+	status.Ipv4, status.Ipv6 = interfaceAddrs("wlan0")
+	status.Gateway = defaultGateway("/proc/net/route", "wlan0")
+	status.Dns = nameservers("/etc/resolv.conf")
+
+	pollOut, err := exec.Command("wpa_cli", "-i", "wlan0", "signal_poll").Output()
+	if err == nil {
+		status.LinkSpeed, _ = strconv.Atoi(cfgMapper(pollOut)["LINKSPEED"])
+	}
+
+	status.Connectivity = wpa.Prober.Last()
+
+	return status, nil
+}
+
+// frequencyToChannel converts a frequency in MHz to a channel number.
+func frequencyToChannel(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return (freq - 2407) / 5
+	case freq >= 5955 && freq <= 7115:
+		return (freq - 5950) / 5
+	case freq >= 5000 && freq < 5955:
+		return (freq - 5000) / 5
+	}
+
+	return 0
+}
+
+// interfaceAddrs returns the IPv4 and IPv6 addresses of an interface.
+func interfaceAddrs(name string) ([]string, []string) {
+	ipv4 := []string{}
+	ipv6 := []string{}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ipv4, ipv6
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ipv4, ipv6
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil {
+			ipv4 = append(ipv4, ipNet.String())
+		} else {
+			ipv6 = append(ipv6, ipNet.String())
+		}
+	}
+
+	return ipv4, ipv6
+}
+
+// defaultGateway reads the default IPv4 gateway of an interface
+// from a kernel routing table such as /proc/net/route.
+func defaultGateway(routes string, name string) string {
+	file, err := os.Open(routes)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != name || fields[1] != "00000000" {
+			continue
+		}
+
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+
+		// the kernel writes the address in host byte order
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+
+		return ip.String()
+	}
+
+	return ""
+}
+
+// nameservers returns the nameservers listed in a resolv.conf file.
+func nameservers(resolvConf string) []string {
+	servers := []string{}
+
+	file, err := os.Open(resolvConf)
+	if err != nil {
+		return servers
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+
+	return servers
+}
@@ -0,0 +1,112 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testFile writes data to a file in a temporary directory and returns
+// its path along with a func removing it.
+func testFile(t *testing.T, name string, data string) (string, func()) {
+	dir, cleanup := testDir(t)
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return path, cleanup
+}
+
+func TestDefaultGateway(t *testing.T) {
+	// tables as written by a little-endian kernel
+	header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+	for _, tc := range []struct {
+		name    string
+		routes  string
+		gateway string
+	}{
+		{
+			"wlan0 default",
+			header +
+				"wlan0\t00000000\t0101A8C0\t0003\t0\t0\t303\t00000000\t0\t0\t0\n" +
+				"wlan0\t0001A8C0\t00000000\t0001\t0\t0\t303\t00FFFFFF\t0\t0\t0\n",
+			"192.168.1.1",
+		},
+		{
+			"other interfaces first",
+			header +
+				"eth0\t00000000\t0100000A\t0003\t0\t0\t202\t00000000\t0\t0\t0\n" +
+				"uap0\t001BA8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+				"wlan0\t00000000\tFE01A8C0\t0003\t0\t0\t303\t00000000\t0\t0\t0\n",
+			"192.168.1.254",
+		},
+		{
+			"no default route",
+			header + "wlan0\t0001A8C0\t00000000\t0001\t0\t0\t303\t00FFFFFF\t0\t0\t0\n",
+			"",
+		},
+		{
+			"default on another interface",
+			header + "eth0\t00000000\t0100000A\t0003\t0\t0\t202\t00000000\t0\t0\t0\n",
+			"",
+		},
+		{
+			"malformed gateway",
+			header + "wlan0\t00000000\tZZ01A8C0\t0003\t0\t0\t303\t00000000\t0\t0\t0\n",
+			"",
+		},
+		{"empty", header, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			routes, cleanup := testFile(t, "route", tc.routes)
+			defer cleanup()
+
+			if got := defaultGateway(routes, "wlan0"); got != tc.gateway {
+				t.Errorf("defaultGateway() = %q, want %q", got, tc.gateway)
+			}
+		})
+	}
+
+	if got := defaultGateway("/nonexistent/route", "wlan0"); got != "" {
+		t.Errorf("missing routing table: %q", got)
+	}
+}
+
+func TestNameservers(t *testing.T) {
+	resolvConf, cleanup := testFile(t, "resolv.conf", "# generated\nsearch lan\nnameserver 192.168.1.1\nnameserver  fd00::1\nnameserver\n")
+	defer cleanup()
+
+	if got := nameservers(resolvConf); !reflect.DeepEqual(got, []string{"192.168.1.1", "fd00::1"}) {
+		t.Errorf("nameservers() = %v", got)
+	}
+	if got := nameservers("/nonexistent/resolv.conf"); len(got) != 0 {
+		t.Errorf("missing resolv.conf: %v", got)
+	}
+}
+
+func TestFrequencyToChannel(t *testing.T) {
+	for _, tc := range []struct {
+		freq    int
+		channel int
+	}{
+		{2412, 1},
+		{2437, 6},
+		{2472, 13},
+		{2484, 14},
+		{5180, 36},
+		{5825, 165},
+		{5955, 1},
+		{6115, 33},
+		{0, 0},
+		{900, 0},
+	} {
+		if got := frequencyToChannel(tc.freq); got != tc.channel {
+			t.Errorf("frequencyToChannel(%d) = %d, want %d", tc.freq, got, tc.channel)
+		}
+	}
+}
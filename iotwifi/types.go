@@ -1,10 +1,224 @@
 package iotwifi
 
+import (
+	"os"
+	"strings"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
 // SetupCfg is the main configuration structure.
 type SetupCfg struct {
 	DnsmasqCfg       DnsmasqCfg       `json:"dnsmasq_cfg"`
 	HostApdCfg       HostApdCfg       `json:"host_apd_cfg"`
 	WpaSupplicantCfg WpaSupplicantCfg `json:"wpa_supplicant_cfg"`
+	BridgeCfg        BridgeCfg        `json:"bridge_cfg"`
+	ConnectivityCfg  ConnectivityCfg  `json:"connectivity_cfg"`
+	ProbeCfg         ProbeCfg         `json:"probe_cfg"`
+	LinkCfg          LinkCfg          `json:"link_cfg"`
+	JournalCfg       JournalCfg       `json:"journal_cfg"`
+	MqttCfg          MqttCfg          `json:"mqtt_cfg"`
+	WebhookCfg       WebhookCfg       `json:"webhook_cfg"`
+	DropCfg          DropCfg          `json:"drop_cfg"`
+	ImprovCfg        ImprovCfg        `json:"improv_cfg"`
+	LimitCfg         LimitCfg         `json:"limit_cfg"`
+	RadioCfg         RadioCfg         `json:"radio_cfg"`
+	RegulatoryCfg    RegulatoryCfg    `json:"regulatory_cfg"`
+}
+
+// setDefaults fills in optional configuration left empty.
+func (s *SetupCfg) setDefaults() {
+	if s.DnsmasqCfg.LeaseFile == "" {
+		s.DnsmasqCfg.LeaseFile = "/var/lib/misc/dnsmasq.leases"
+	}
+
+	if s.WpaSupplicantCfg.SecretsFile == "" {
+		s.WpaSupplicantCfg.SecretsFile = "/etc/wpa_supplicant/iotwifi-secrets.json"
+	}
+
+	if s.WpaSupplicantCfg.SecretsKeyFile == "" {
+		s.WpaSupplicantCfg.SecretsKeyFile = "/var/lib/iotwifi/secrets.key"
+	}
+
+	if s.WpaSupplicantCfg.CtrlInterface == "" {
+		s.WpaSupplicantCfg.CtrlInterface = "/var/run/wpa_supplicant"
+	}
+
+	if s.BridgeCfg.Name == "" {
+		s.BridgeCfg.Name = "br0"
+	}
+
+	if s.BridgeCfg.Interface == "" {
+		s.BridgeCfg.Interface = "eth0"
+	}
+
+	if s.ConnectivityCfg.Mode == "" {
+		s.ConnectivityCfg.Mode = ModeDual
+	}
+
+	if s.ConnectivityCfg.ConnectWindow == 0 {
+		s.ConnectivityCfg.ConnectWindow = 30
+	}
+
+	if s.ConnectivityCfg.ApStopGrace == 0 {
+		s.ConnectivityCfg.ApStopGrace = 60
+	}
+
+	if s.ConnectivityCfg.UplinkLossTimeout == 0 {
+		s.ConnectivityCfg.UplinkLossTimeout = 30
+	}
+
+	if s.ProbeCfg.HttpStatus == 0 {
+		s.ProbeCfg.HttpStatus = 204
+	}
+
+	if s.ProbeCfg.Interval == 0 {
+		s.ProbeCfg.Interval = 60
+	}
+
+	if s.ProbeCfg.Timeout == 0 {
+		s.ProbeCfg.Timeout = 5
+	}
+
+	if s.LinkCfg.Interval == 0 {
+		s.LinkCfg.Interval = 10
+	}
+
+	if s.LinkCfg.History == 0 {
+		s.LinkCfg.History = 360
+	}
+
+	if s.LinkCfg.RssiWeak == 0 {
+		s.LinkCfg.RssiWeak = -75
+	}
+
+	if s.LinkCfg.RssiRecovered == 0 {
+		s.LinkCfg.RssiRecovered = -70
+	}
+
+	if s.JournalCfg.Path == "" {
+		s.JournalCfg.Path = "/var/lib/iotwifi/journal.jsonl"
+	}
+
+	if s.JournalCfg.MaxSize == 0 {
+		s.JournalCfg.MaxSize = 1048576
+	}
+
+	if s.MqttCfg.ClientId == "" {
+		s.MqttCfg.ClientId, _ = os.Hostname()
+	}
+
+	if s.MqttCfg.TopicPrefix == "" {
+		s.MqttCfg.TopicPrefix = "iotwifi/" + s.MqttCfg.ClientId
+	}
+
+	if s.MqttCfg.KeepAlive == 0 {
+		s.MqttCfg.KeepAlive = 60
+	}
+
+	if s.MqttCfg.StatusInterval == 0 {
+		s.MqttCfg.StatusInterval = 60
+	}
+
+	if s.WebhookCfg.Outbox == "" {
+		s.WebhookCfg.Outbox = "/var/lib/iotwifi/outbox"
+	}
+
+	if s.WebhookCfg.MaxAttempts == 0 {
+		s.WebhookCfg.MaxAttempts = 20
+	}
+
+	if s.WebhookCfg.MaxQueued == 0 {
+		s.WebhookCfg.MaxQueued = 500
+	}
+
+	if s.WebhookCfg.Timeout == 0 {
+		s.WebhookCfg.Timeout = 10
+	}
+
+	if s.DropCfg.Path == "" {
+		s.DropCfg.Path = "/boot/iotwifi.json"
+	}
+
+	if s.DropCfg.Interval == 0 {
+		s.DropCfg.Interval = 5
+	}
+
+	if s.LimitCfg.ClientRate == 0 {
+		s.LimitCfg.ClientRate = 6
+	}
+
+	if s.LimitCfg.ClientBurst == 0 {
+		s.LimitCfg.ClientBurst = 3
+	}
+
+	if s.LimitCfg.Rate == 0 {
+		s.LimitCfg.Rate = 30
+	}
+
+	if s.LimitCfg.Burst == 0 {
+		s.LimitCfg.Burst = 10
+	}
+
+	if s.LimitCfg.ClientConcurrent == 0 {
+		s.LimitCfg.ClientConcurrent = 1
+	}
+
+	if s.LimitCfg.Concurrent == 0 {
+		s.LimitCfg.Concurrent = 2
+	}
+
+	if s.LimitCfg.MaxFailures == 0 {
+		s.LimitCfg.MaxFailures = 5
+	}
+
+	if s.LimitCfg.Lockout == 0 {
+		s.LimitCfg.Lockout = 60
+	}
+
+	if s.LimitCfg.MaxLockout == 0 {
+		s.LimitCfg.MaxLockout = 3600
+	}
+
+	s.RegulatoryCfg.Country = strings.ToUpper(s.RegulatoryCfg.Country)
+
+	if s.RadioCfg.StationPhy == "" {
+		s.RadioCfg.StationPhy = RadioAuto
+	}
+
+	if s.RadioCfg.ApPhy == "" {
+		s.RadioCfg.ApPhy = RadioAuto
+	}
+
+	if s.ImprovCfg.Baud == 0 {
+		s.ImprovCfg.Baud = 115200
+	}
+
+	if s.ImprovCfg.DeviceName == "" {
+		s.ImprovCfg.DeviceName, _ = os.Hostname()
+	}
+}
+
+// validate drops configuration that can not be used, logging why.
+func (s *SetupCfg) validate(log bunyan.Logger) {
+	// MQTT 3.1.1 does not allow a password without a user name
+	if s.MqttCfg.Password != "" && s.MqttCfg.Username == "" {
+		log.Error("mqtt_cfg has a password but no username, connecting without credentials")
+		s.MqttCfg.Password = ""
+	}
+
+	// the sample ring buffer is sized by history
+	if s.LinkCfg.History < 0 {
+		log.Error("link_cfg history %d is negative, keeping 360 samples", s.LinkCfg.History)
+		s.LinkCfg.History = 360
+	}
+
+	if country := s.RegulatoryCfg.Country; country != "" {
+		if err := ValidateCountry(country); err != nil {
+			log.Error("regulatory_cfg country %s ignored, staying in the world regulatory domain: %s", country, err.Error())
+			s.RegulatoryCfg.Country = ""
+		}
+	}
 }
 
 // DnsmasqCfg configures dnsmasq and is used by SetupCfg.
@@ -12,17 +226,160 @@ type DnsmasqCfg struct {
 	Address     string `json:"address"`      // --address=/#/192.168.27.1",
 	DhcpRange   string `json:"dhcp_range"`   // "--dhcp-range=192.168.27.100,192.168.27.150,1h",
 	VendorClass string `json:"vendor_class"` // "--dhcp-vendorclass=set:device,IoT",
+	LeaseFile   string `json:"lease_file"`   // "--dhcp-leasefile=/var/lib/misc/dnsmasq.leases",
 }
 
 // HostApdCfg configures hostapd and is used by SetupCfg.
 type HostApdCfg struct {
 	Ssid          string `json:"ssid"`           // ssid=iotwifi2
-	WpaPassphrase string `json:"wpa_passphrase"` // wpa_passphrase=iotwifipass
-	Channel       string `json:"channel"`        //  channel=6
+	WpaPassphrase string `json:"wpa_passphrase"` // wpa_passphrase=iotwifipass, hostapd is given the derived wpa_psk
+	WpaPsk        string `json:"wpa_psk"`        // 64 hex digits, used in place of wpa_passphrase
+	Channel       string `json:"channel"`        //  channel=6, or auto to pick the least congested channel
 	Ip            string `json:"ip"`             // 192.168.27.1
+	Wps           bool   `json:"wps"`            // false, lets clients join with WPS
 }
 
-// WpaSupplicantCfg configures wpa_supplicant and is used by SetupCfg
+// WpaSupplicantCfg configures wpa_supplicant and is used by SetupCfg.
+// The passphrases of SAE networks are kept in secrets_file, encrypted
+// with the key in secrets_key_file, rather than in cfg_file.
 type WpaSupplicantCfg struct {
-	CfgFile string `json:"cfg_file"` // /etc/wpa_supplicant/wpa_supplicant.conf
+	CfgFile        string `json:"cfg_file"`         // /etc/wpa_supplicant/wpa_supplicant.conf
+	SecretsFile    string `json:"secrets_file"`     // /etc/wpa_supplicant/iotwifi-secrets.json
+	SecretsKeyFile string `json:"secrets_key_file"` // /var/lib/iotwifi/secrets.key, created when missing
+	CtrlInterface  string `json:"ctrl_interface"`   // /var/run/wpa_supplicant
+}
+
+// BridgeCfg configures bridge mode and is used by SetupCfg. When enabled
+// uap0 is enslaved to a bridge with a wired interface, AP clients get
+// their addresses from the upstream LAN and dnsmasq is not started.
+type BridgeCfg struct {
+	Enabled   bool   `json:"enabled"`   // false
+	Name      string `json:"name"`      // br0
+	Interface string `json:"interface"` // eth0
+}
+
+// ConnectivityCfg configures how the AP and station are managed and is
+// used by SetupCfg. Durations are in seconds.
+type ConnectivityCfg struct {
+	Mode              string `json:"mode"`                // dual, ap-only, station-only or auto
+	ConnectWindow     int    `json:"connect_window"`      // 30
+	ApStopGrace       int    `json:"ap_stop_grace"`       // 60
+	UplinkLossTimeout int    `json:"uplink_loss_timeout"` // 30
+}
+
+// ProbeCfg configures internet reachability checks and is used by
+// SetupCfg. Only the checks with a target set are run, durations are
+// in seconds.
+type ProbeCfg struct {
+	HttpUrl    string `json:"http_url"`    // http://connectivitycheck.gstatic.com/generate_204
+	HttpStatus int    `json:"http_status"` // 204
+	DnsHost    string `json:"dns_host"`    // example.com
+	TcpTarget  string `json:"tcp_target"`  // 8.8.8.8:53
+	Interval   int    `json:"interval"`    // 60
+	Timeout    int    `json:"timeout"`     // 5
+}
+
+// LinkCfg configures station link quality sampling and is used by
+// SetupCfg. A weak signal event fires when the RSSI drops below
+// rssi_weak and a recovered event once it is back at rssi_recovered.
+type LinkCfg struct {
+	Interval      int `json:"interval"`       // 10 seconds between samples
+	History       int `json:"history"`        // 360 samples kept
+	RssiWeak      int `json:"rssi_weak"`      // -75 dBm
+	RssiRecovered int `json:"rssi_recovered"` // -70 dBm
+}
+
+// JournalCfg configures the persistent event journal and is used by
+// SetupCfg. The journal is rotated to path.1 once it reaches max_size.
+type JournalCfg struct {
+	Path    string `json:"path"`     // /var/lib/iotwifi/journal.jsonl
+	MaxSize int64  `json:"max_size"` // 1048576 bytes
+}
+
+// MqttCfg configures the optional MQTT client and is used by SetupCfg.
+// The client is only started when a broker is set. Status, connectivity
+// and client count are retained below topic_prefix, events are streamed
+// to topic_prefix/events and commands are read from topic_prefix/command.
+type MqttCfg struct {
+	Broker         string `json:"broker"`          // tcp://localhost:1883 or ssl://broker:8883
+	ClientId       string `json:"client_id"`       // hostname
+	Username       string `json:"username"`        //
+	Password       string `json:"password"`        //
+	TopicPrefix    string `json:"topic_prefix"`    // iotwifi/<client_id>
+	KeepAlive      int    `json:"keep_alive"`      // 60 seconds
+	StatusInterval int    `json:"status_interval"` // 60 seconds
+}
+
+// WebhookCfg configures outbound webhooks and is used by SetupCfg.
+// Pending deliveries are kept in the outbox directory and retried with
+// exponential backoff up to max_attempts times.
+type WebhookCfg struct {
+	Outbox      string           `json:"outbox"`       // /var/lib/iotwifi/outbox
+	MaxAttempts int              `json:"max_attempts"` // 20
+	MaxQueued   int              `json:"max_queued"`   // 500
+	Timeout     int              `json:"timeout"`      // 10 seconds
+	Hooks       []WebhookHookCfg `json:"hooks"`
+}
+
+// WebhookHookCfg configures a single webhook and is used by WebhookCfg.
+type WebhookHookCfg struct {
+	Url    string   `json:"url"`    // https://example.com/hooks/iotwifi
+	Secret string   `json:"secret"` // HMAC-SHA256 key for X-Iotwifi-Signature
+	Events []string `json:"events"` // event types to send, all when empty
+}
+
+// DropCfg configures drop-file provisioning and is used by SetupCfg.
+// A file at path holding JSON credentials or wpa_supplicant.conf network
+// blocks is applied with ConnectNetwork and the outcome written to
+// path.result. The file is then overwritten and deleted, or renamed to
+// path.applied when keep is set.
+type DropCfg struct {
+	Path     string `json:"path"`     // /boot/iotwifi.json
+	Interval int    `json:"interval"` // 5 seconds
+	Keep     bool   `json:"keep"`     // false
+}
+
+// ImprovCfg configures Improv Wi-Fi serial provisioning and is used by
+// SetupCfg. Improv is only served when a tty is set. Once connected the
+// url, with {ip} replaced by the station address, is sent to the client.
+type ImprovCfg struct {
+	Tty        string `json:"tty"`         // /dev/ttyGS0
+	Baud       int    `json:"baud"`        // 115200
+	Url        string `json:"url"`         // http://{ip}:8080/v1/status
+	DeviceName string `json:"device_name"` // hostname
+}
+
+// LimitCfg configures the limiter on API routes that change device
+// state and is used by SetupCfg. Rates are requests per minute, per
+// client address and across all clients. After max_failures failed
+// requests in a row a client is locked out for lockout seconds, doubled
+// on each further lockout up to max_lockout. The unix socket is not
+// limited.
+type LimitCfg struct {
+	Disabled         bool `json:"disabled"`          // false
+	ClientRate       int  `json:"client_rate"`       // 6
+	ClientBurst      int  `json:"client_burst"`      // 3
+	Rate             int  `json:"rate"`              // 30
+	Burst            int  `json:"burst"`             // 10
+	ClientConcurrent int  `json:"client_concurrent"` // 1
+	Concurrent       int  `json:"concurrent"`        // 2
+	MaxFailures      int  `json:"max_failures"`      // 5
+	Lockout          int  `json:"lockout"`           // 60 seconds
+	MaxLockout       int  `json:"max_lockout"`       // 3600 seconds
+}
+
+// RadioCfg configures which PHY runs the station and the AP and is used
+// by SetupCfg. With auto the AP gets a second radio when there is one
+// and otherwise shares the station's PHY if it supports both at once.
+type RadioCfg struct {
+	StationPhy string `json:"station_phy"` // auto, or a PHY such as phy0
+	ApPhy      string `json:"ap_phy"`      // auto, or a PHY such as phy1
+}
+
+// RegulatoryCfg configures the regulatory domain and is used by
+// SetupCfg. The country is set with iw reg set and in the hostapd and
+// wpa_supplicant configs, the radios stay in the world domain 00, with
+// its restricted channels and power, when it is empty.
+type RegulatoryCfg struct {
+	Country string `json:"country"` // ISO 3166-1 alpha-2, such as US or DE
 }
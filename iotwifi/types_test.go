@@ -0,0 +1,82 @@
+package iotwifi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetupCfgValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   SetupCfg
+		check func(cfg SetupCfg) bool
+	}{
+		{
+			"mqtt password without username",
+			SetupCfg{MqttCfg: MqttCfg{Password: "secret"}},
+			func(cfg SetupCfg) bool { return cfg.MqttCfg.Password == "" },
+		},
+		{
+			"mqtt username and password",
+			SetupCfg{MqttCfg: MqttCfg{Username: "user", Password: "secret"}},
+			func(cfg SetupCfg) bool { return cfg.MqttCfg.Password == "secret" },
+		},
+		{
+			"negative link history",
+			SetupCfg{LinkCfg: LinkCfg{History: -1}},
+			func(cfg SetupCfg) bool { return cfg.LinkCfg.History == 360 },
+		},
+		{
+			"link history",
+			SetupCfg{LinkCfg: LinkCfg{History: 60}},
+			func(cfg SetupCfg) bool { return cfg.LinkCfg.History == 60 },
+		},
+		{
+			"country",
+			SetupCfg{RegulatoryCfg: RegulatoryCfg{Country: "de"}},
+			func(cfg SetupCfg) bool { return cfg.RegulatoryCfg.Country == "DE" },
+		},
+		{
+			"world domain",
+			SetupCfg{RegulatoryCfg: RegulatoryCfg{Country: "00"}},
+			func(cfg SetupCfg) bool { return cfg.RegulatoryCfg.Country == "00" },
+		},
+		{
+			"invalid country",
+			SetupCfg{RegulatoryCfg: RegulatoryCfg{Country: "Germany"}},
+			func(cfg SetupCfg) bool { return cfg.RegulatoryCfg.Country == "" },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.setDefaults()
+			cfg.validate(testLogger(t))
+
+			if !tc.check(cfg) {
+				t.Errorf("validated config %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestHostapdCfgCountry(t *testing.T) {
+	for _, tc := range []struct {
+		country string
+		want    bool
+	}{
+		{"", false},
+		{"DE", true},
+		{"GERMANY", false},
+	} {
+		wpa := testWpaCfg(t)
+		wpa.WpaCfg.RegulatoryCfg.Country = tc.country
+
+		cfg := wpa.hostapdCfg("6")
+		if got := strings.Contains(cfg, "\ncountry_code="+tc.country+"\n"); got != tc.want {
+			t.Errorf("country %q: country_code in config = %t, want %t:\n%s", tc.country, got, tc.want, cfg)
+		}
+		if strings.Contains(cfg, "country_code") != tc.want {
+			t.Errorf("country %q: config\n%s", tc.country, cfg)
+		}
+	}
+}
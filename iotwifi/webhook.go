@@ -0,0 +1,338 @@
+package iotwifi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+)
+
+// webhookMaxBackoff caps the delay between delivery attempts.
+const webhookMaxBackoff = time.Hour
+
+// WebhookPayload is the JSON body posted to webhooks.
+type WebhookPayload struct {
+	Device string `json:"device"`
+	Event  Event  `json:"event"`
+}
+
+// webhookDelivery is a pending webhook request kept in the outbox. Hook
+// is the index of the hook in WebhookCfg, the secret is not saved.
+type webhookDelivery struct {
+	Id       string          `json:"id"`
+	Hook     int             `json:"hook"`
+	Url      string          `json:"url"`
+	Type     string          `json:"type"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+}
+
+// Webhooks posts signed events to the configured URLs. Deliveries are
+// kept in an outbox directory until they succeed so they survive an
+// uplink outage or restart.
+type Webhooks struct {
+	Log        bunyan.Logger
+	WebhookCfg WebhookCfg
+
+	mu      sync.Mutex
+	pending []*webhookDelivery
+	wake    chan struct{}
+	device  string
+}
+
+// NewWebhooks produces Webhooks and loads the outbox.
+func NewWebhooks(log bunyan.Logger, webhookCfg WebhookCfg) *Webhooks {
+	device, _ := os.Hostname()
+
+	w := &Webhooks{
+		Log:        log,
+		WebhookCfg: webhookCfg,
+		wake:       make(chan struct{}, 1),
+		device:     device,
+	}
+	w.load()
+
+	return w
+}
+
+// Enqueue adds a delivery of event to every hook whose filter matches.
+func (w *Webhooks) Enqueue(event Event) {
+	event.Payload = redact(event.Payload)
+
+	body, err := json.Marshal(WebhookPayload{Device: w.device, Event: event})
+	if err != nil {
+		w.Log.Error("Webhook could not encode event: %s", err.Error())
+		return
+	}
+
+	for i, hook := range w.WebhookCfg.Hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+
+		delivery := &webhookDelivery{
+			Id:   newDeliveryId(),
+			Hook: i,
+			Url:  hook.Url,
+			Type: event.Type,
+			Body: body,
+			Next: time.Now(),
+		}
+
+		w.mu.Lock()
+		w.pending = append(w.pending, delivery)
+		if len(w.pending) > w.WebhookCfg.MaxQueued {
+			w.Log.Error("Webhook outbox full, dropping %s", w.pending[0].Id)
+			w.remove(w.pending[0])
+			w.pending = w.pending[1:]
+		}
+		w.save(delivery)
+		w.mu.Unlock()
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due webhooks until the process exits.
+func (w *Webhooks) Run() {
+	for {
+		for _, delivery := range w.due() {
+			w.deliver(delivery)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-w.wake:
+		}
+	}
+}
+
+// due returns the deliveries whose next attempt has come.
+func (w *Webhooks) due() []*webhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	due := []*webhookDelivery{}
+	for _, delivery := range w.pending {
+		if !delivery.Next.After(now) {
+			due = append(due, delivery)
+		}
+	}
+
+	return due
+}
+
+// deliver attempts one delivery and reschedules it with exponential
+// backoff on failure.
+func (w *Webhooks) deliver(delivery *webhookDelivery) {
+	err := w.post(delivery)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err == nil {
+		w.drop(delivery)
+		return
+	}
+
+	// dropped from a full outbox while it was being posted
+	if !w.isPending(delivery) {
+		return
+	}
+
+	delivery.Attempts++
+	if delivery.Attempts >= w.WebhookCfg.MaxAttempts {
+		w.Log.Error("Webhook %s to %s failed %d times, dropping: %s", delivery.Type, delivery.Url, delivery.Attempts, err.Error())
+		w.drop(delivery)
+		return
+	}
+
+	backoff := time.Duration(1<<uint(delivery.Attempts)) * time.Second
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	delivery.Next = time.Now().Add(backoff)
+
+	w.Log.Warn("Webhook %s to %s failed, retrying in %s: %s", delivery.Type, delivery.Url, backoff, err.Error())
+	w.save(delivery)
+}
+
+// post sends a delivery signed with the hook secret. The signature is
+// an HMAC-SHA256 of the timestamp, a dot and the body.
+func (w *Webhooks) post(delivery *webhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.Url, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Iotwifi-Event", delivery.Type)
+	req.Header.Set("X-Iotwifi-Delivery", delivery.Id)
+	req.Header.Set("X-Iotwifi-Timestamp", timestamp)
+
+	if secret := w.secret(delivery); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(delivery.Body)
+		req.Header.Set("X-Iotwifi-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: time.Duration(w.WebhookCfg.Timeout) * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("unexpected status " + res.Status)
+	}
+
+	return nil
+}
+
+// secret returns the secret of the hook a delivery is for. A delivery
+// saved before the hooks were reconfigured falls back to the first hook
+// with its url.
+func (w *Webhooks) secret(delivery *webhookDelivery) string {
+	hooks := w.WebhookCfg.Hooks
+	if delivery.Hook >= 0 && delivery.Hook < len(hooks) && hooks[delivery.Hook].Url == delivery.Url {
+		return hooks[delivery.Hook].Secret
+	}
+
+	for _, hook := range hooks {
+		if hook.Url == delivery.Url {
+			return hook.Secret
+		}
+	}
+
+	return ""
+}
+
+// isPending reports whether a delivery is still in the outbox.
+func (w *Webhooks) isPending(delivery *webhookDelivery) bool {
+	for _, pending := range w.pending {
+		if pending == delivery {
+			return true
+		}
+	}
+
+	return false
+}
+
+// drop removes a delivery from the outbox.
+func (w *Webhooks) drop(delivery *webhookDelivery) {
+	for i, pending := range w.pending {
+		if pending == delivery {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			break
+		}
+	}
+
+	w.remove(delivery)
+}
+
+// load reads pending deliveries from the outbox directory.
+func (w *Webhooks) load() {
+	files, err := ioutil.ReadDir(w.WebhookCfg.Outbox)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(w.WebhookCfg.Outbox, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		delivery := &webhookDelivery{}
+		if err := json.Unmarshal(data, delivery); err != nil {
+			w.Log.Error("Webhook outbox entry %s unreadable: %s", file.Name(), err.Error())
+			continue
+		}
+		w.pending = append(w.pending, delivery)
+	}
+
+	sort.Slice(w.pending, func(i, j int) bool {
+		return w.pending[i].Id < w.pending[j].Id
+	})
+}
+
+// save writes a delivery to the outbox directory.
+func (w *Webhooks) save(delivery *webhookDelivery) {
+	if w.WebhookCfg.Outbox == "" {
+		return
+	}
+
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(w.WebhookCfg.Outbox, 0700); err != nil {
+		w.Log.Error("Webhook could not create outbox: %s", err.Error())
+		return
+	}
+
+	path := filepath.Join(w.WebhookCfg.Outbox, delivery.Id+".json")
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		w.Log.Error("Webhook could not save delivery: %s", err.Error())
+		return
+	}
+	os.Rename(path+".tmp", path)
+}
+
+// remove deletes a delivery from the outbox directory.
+func (w *Webhooks) remove(delivery *webhookDelivery) {
+	if w.WebhookCfg.Outbox == "" {
+		return
+	}
+
+	os.Remove(filepath.Join(w.WebhookCfg.Outbox, delivery.Id+".json"))
+}
+
+// wants reports whether the hook subscribes to an event type.
+func (h WebhookHookCfg) wants(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+
+	for _, t := range h.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newDeliveryId returns a time ordered unique delivery id.
+func newDeliveryId() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + hex.EncodeToString(random)
+}
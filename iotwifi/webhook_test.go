@@ -0,0 +1,169 @@
+package iotwifi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testWebhooks returns Webhooks with an outbox in a temporary directory.
+func testWebhooks(t *testing.T, hooks []WebhookHookCfg, maxQueued int) (*Webhooks, func()) {
+	outbox, cleanup := testDir(t)
+
+	w := NewWebhooks(testLogger(t), WebhookCfg{
+		Outbox:      outbox,
+		MaxAttempts: 3,
+		MaxQueued:   maxQueued,
+		Timeout:     5,
+		Hooks:       hooks,
+	})
+
+	return w, cleanup
+}
+
+// outboxIds returns the delivery ids saved in the outbox directory.
+func outboxIds(t *testing.T, w *Webhooks) []string {
+	files, err := ioutil.ReadDir(w.WebhookCfg.Outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, file := range files {
+		ids = append(ids, file.Name()[:len(file.Name())-len(filepath.Ext(file.Name()))])
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func TestWebhookWants(t *testing.T) {
+	for _, tc := range []struct {
+		events []string
+		event  string
+		wants  bool
+	}{
+		{nil, "connect", true},
+		{[]string{"connect"}, "connect", true},
+		{[]string{"connect", "disconnect"}, "disconnect", true},
+		{[]string{"connect"}, "disconnect", false},
+	} {
+		if got := (WebhookHookCfg{Events: tc.events}).wants(tc.event); got != tc.wants {
+			t.Errorf("hook %v wants %s = %t, want %t", tc.events, tc.event, got, tc.wants)
+		}
+	}
+}
+
+func TestWebhookSecretPerHook(t *testing.T) {
+	signatures := make(chan http.Header, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		signatures <- r.Header
+	}))
+	defer srv.Close()
+
+	// two hooks on one url with their own secrets and filters
+	w, cleanup := testWebhooks(t, []WebhookHookCfg{
+		{Url: srv.URL, Secret: "first", Events: []string{"connect"}},
+		{Url: srv.URL, Secret: "second", Events: []string{"disconnect"}},
+	}, 10)
+	defer cleanup()
+
+	w.Enqueue(Event{Type: "connect"})
+	w.Enqueue(Event{Type: "disconnect"})
+
+	due := w.due()
+	if len(due) != 2 {
+		t.Fatalf("%d deliveries, want 2", len(due))
+	}
+
+	for _, delivery := range due {
+		w.deliver(delivery)
+
+		header := <-signatures
+		secret := map[string]string{"connect": "first", "disconnect": "second"}[delivery.Type]
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(header.Get("X-Iotwifi-Timestamp") + "."))
+		mac.Write(delivery.Body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-Iotwifi-Signature") != want {
+			t.Errorf("%s signed %s, want the %s secret", delivery.Type, header.Get("X-Iotwifi-Signature"), secret)
+		}
+	}
+
+	if ids := outboxIds(t, w); len(ids) != 0 {
+		t.Errorf("outbox has %v after delivery", ids)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	w, cleanup := testWebhooks(t, []WebhookHookCfg{{Url: srv.URL}}, 10)
+	defer cleanup()
+
+	w.Enqueue(Event{Type: "connect"})
+	delivery := w.due()[0]
+
+	w.deliver(delivery)
+	if delivery.Attempts != 1 || len(w.due()) != 0 {
+		t.Fatalf("failed delivery not rescheduled: %+v", delivery)
+	}
+
+	// a restart picks the rescheduled delivery up from the outbox
+	reloaded := NewWebhooks(testLogger(t), w.WebhookCfg)
+	if len(reloaded.pending) != 1 || reloaded.pending[0].Attempts != 1 || reloaded.pending[0].Hook != 0 {
+		t.Fatalf("outbox reloaded as %+v", reloaded.pending)
+	}
+
+	w.deliver(delivery)
+	w.deliver(delivery)
+	if len(w.pending) != 0 || len(outboxIds(t, w)) != 0 {
+		t.Error("delivery kept after MaxAttempts")
+	}
+}
+
+func TestWebhookOverflowInFlight(t *testing.T) {
+	posted := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		posted <- struct{}{}
+		<-release
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	w, cleanup := testWebhooks(t, []WebhookHookCfg{{Url: srv.URL}}, 1)
+	defer cleanup()
+
+	w.Enqueue(Event{Type: "connect"})
+	inFlight := w.due()[0]
+
+	done := make(chan struct{})
+	go func() {
+		w.deliver(inFlight)
+		close(done)
+	}()
+	<-posted
+
+	// overflowing the outbox drops the delivery being posted
+	w.Enqueue(Event{Type: "disconnect"})
+	close(release)
+	<-done
+
+	ids := outboxIds(t, w)
+	if len(ids) != 1 || ids[0] == inFlight.Id {
+		t.Errorf("outbox has %v, want only the newer delivery", ids)
+	}
+	if len(w.pending) != 1 || w.pending[0] == inFlight {
+		t.Errorf("pending has %d deliveries, want only the newer one", len(w.pending))
+	}
+}
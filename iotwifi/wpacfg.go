@@ -3,9 +3,12 @@ package iotwifi
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bhoriuchi/go-bunyan/bunyan"
@@ -13,9 +16,29 @@ import (
 
 // WpaCfg for configuring wpa
 type WpaCfg struct {
-	Log    bunyan.Logger
-	WpaCmd []string
-	WpaCfg *SetupCfg
+	Log     bunyan.Logger
+	WpaCmd  []string
+	WpaCfg  *SetupCfg
+	Events  *EventBus
+	Prober  *Prober
+	Metrics *Metrics
+	Link    *LinkMonitor
+	Journal *Journal
+
+	mu        sync.Mutex
+	hostapd   *exec.Cmd
+	provision ProvisionStatus
+	received  bool
+	dpp       DppStatus
+	dppId     string
+	apChan    string
+	bridge    bool
+	follow    chan struct{}
+
+	provisioned chan ProvisionStatus
+
+	placement    RadioPlacement
+	placementErr error
 }
 
 // WpaNetwork defines a wifi network to connect to.
@@ -25,12 +48,24 @@ type WpaNetwork struct {
 	SignalLevel string `json:"signal_level"`
 	Flags       string `json:"flags"`
 	Ssid        string `json:"ssid"`
+	Hidden      bool   `json:"hidden"`
 }
 
-// WpaCredentials defines wifi network credentials.
+// WpaConfiguredNetwork defines a network saved in wpa_supplicant.
+type WpaConfiguredNetwork struct {
+	Id    string `json:"id"`
+	Ssid  string `json:"ssid"`
+	Bssid string `json:"bssid"`
+	Flags string `json:"flags"`
+}
+
+// WpaCredentials defines wifi network credentials. Sae selects
+// WPA3-Personal, which needs the passphrase rather than a hex key.
 type WpaCredentials struct {
-	Ssid string `json:"ssid"`
-	Psk  string `json:"psk"`
+	Ssid   string `json:"ssid"`
+	Psk    string `json:"psk"`
+	Hidden bool   `json:"hidden"`
+	Sae    bool   `json:"sae"`
 }
 
 // WpaConnection defines a WPA connection.
@@ -49,15 +84,73 @@ func NewWpaCfg(log bunyan.Logger, cfgLocation string) *WpaCfg {
 		log.Error("Could not load config: %s", err.Error())
 		panic(err)
 	}
+	setupCfg.validate(log)
+
+	events := NewEventBus(log)
 
-	return &WpaCfg{
-		Log:    log,
-		WpaCfg: setupCfg,
+	wpa := &WpaCfg{
+		Log:     log,
+		WpaCfg:  setupCfg,
+		Events:  events,
+		Prober:  NewProber(log, setupCfg.ProbeCfg, events),
+		Metrics: NewMetrics(),
+		Link:    NewLinkMonitor(log, setupCfg.LinkCfg, events),
+		Journal: NewJournal(log, setupCfg.JournalCfg),
+		follow:  make(chan struct{}, 1),
+
+		provisioned: make(chan ProvisionStatus, 4),
 	}
+	registerMetrics(wpa)
+	events.Subscribe(wpa.Journal.Record)
+	events.Subscribe(wpa.handleChannelEvent)
+
+	return wpa
 }
 
-// StartAP starts AP mode.
-func (wpa *WpaCfg) StartAP() {
+// hostapdCfg returns the hostapd configuration for the AP on channel.
+func (wpa *WpaCfg) hostapdCfg(channel string) string {
+	cfg := `interface=uap0
+ssid=` + wpa.WpaCfg.HostApdCfg.Ssid + `
+hw_mode=g
+channel=` + channel + `
+macaddr_acl=0
+auth_algs=1
+ignore_broadcast_ssid=0
+wpa=2
+wpa_psk=` + wpa.apPsk() + `
+wpa_key_mgmt=WPA-PSK
+wpa_pairwise=TKIP
+rsn_pairwise=CCMP
+ctrl_interface=` + hostapdCtrl
+
+	// hostapd refuses to start with a country it does not know
+	if country := wpa.WpaCfg.RegulatoryCfg.Country; country != "" && ValidateCountry(country) == nil {
+		cfg += `
+country_code=` + wpa.WpaCfg.RegulatoryCfg.Country + `
+ieee80211d=1`
+	}
+
+	if wpa.WpaCfg.BridgeCfg.Enabled {
+		cfg += `
+bridge=` + wpa.WpaCfg.BridgeCfg.Name
+	}
+
+	if wpa.WpaCfg.HostApdCfg.Wps {
+		cfg += `
+wps_state=2
+eap_server=1
+config_methods=push_button virtual_push_button keypad`
+	}
+
+	return cfg
+}
+
+// apStartTimeout is how long hostapd has to enable the AP.
+const apStartTimeout = 30 * time.Second
+
+// StartAP starts AP mode and returns once hostapd has enabled the AP. The
+// AP is torn down again when hostapd fails to enable it.
+func (wpa *WpaCfg) StartAP() error {
 	wpa.Log.Info("Starting Hostapd.")
 
 	command := &Command{
@@ -65,10 +158,27 @@ func (wpa *WpaCfg) StartAP() {
 		SetupCfg: wpa.WpaCfg,
 	}
 
+	phy, err := wpa.apPhy()
+	if err != nil {
+		return err
+	}
+
+	channel := wpa.resolveApChannel()
+	if err := wpa.checkApChannel(channel); err != nil {
+		return err
+	}
+
 	command.RemoveApInterface()
-	command.AddApInterface()
+	command.AddApInterface(phy)
 	command.UpApInterface()
-	command.ConfigureApInterface()
+
+	// hostapd adds uap0 to the bridge, the AP interface
+	// itself does not get an address in bridge mode.
+	if wpa.WpaCfg.BridgeCfg.Enabled {
+		wpa.addBridge(command)
+	} else {
+		command.ConfigureApInterface()
+	}
 
 	cmd := exec.Command("hostapd", "-d", "/dev/stdin")
 
@@ -76,80 +186,237 @@ func (wpa *WpaCfg) StartAP() {
 	hostapdPipe, _ := cmd.StdinPipe()
 	cmdStdoutReader, err := cmd.StdoutPipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	messages := make(chan string, 1)
+	started := make(chan struct{})
+	exited := make(chan struct{})
+	defer close(started)
 
+	// keep draining hostapd output after StartAP returns so
+	// hostapd never blocks on a full pipe.
 	stdOutScanner := bufio.NewScanner(cmdStdoutReader)
 	go func() {
 		for stdOutScanner.Scan() {
 			wpa.Log.Info("HOSTAPD GOT: %s", stdOutScanner.Text())
-			messages <- stdOutScanner.Text()
+			wpa.handleHostapdMessage(stdOutScanner.Text())
+			select {
+			case messages <- stdOutScanner.Text():
+			case <-started:
+			}
 		}
+		close(exited)
 	}()
 
-	cfg := `interface=uap0
-ssid=` + wpa.WpaCfg.HostApdCfg.Ssid + `
-hw_mode=g
-channel=` + wpa.WpaCfg.HostApdCfg.Channel + `
-macaddr_acl=0
-auth_algs=1
-ignore_broadcast_ssid=0
-wpa=2
-wpa_passphrase=` + wpa.WpaCfg.HostApdCfg.WpaPassphrase + `
-wpa_key_mgmt=WPA-PSK
-wpa_pairwise=TKIP
-rsn_pairwise=CCMP`
+	cfg := wpa.hostapdCfg(channel)
 
 	wpa.Log.Info("Hostapd CFG: %s", cfg)
 	hostapdPipe.Write([]byte(cfg))
 
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		hostapdPipe.Close()
+		command.RemoveApInterface()
+		return err
+	}
 	hostapdPipe.Close()
 
+	wpa.mu.Lock()
+	wpa.hostapd = cmd
+	wpa.apChan = channel
+	wpa.mu.Unlock()
+
+	timeout := time.After(apStartTimeout)
 	for {
-		out := <-messages // Block until we receive a message on the channel
-		if strings.Contains(out, "uap0: AP-DISABLED") {
-			wpa.Log.Info("Hostapd DISABLED")
-			//cmd.Process.Kill()
-			//cmd.Wait()
+		select {
+		case out := <-messages:
+			if strings.Contains(out, "uap0: AP-DISABLED") {
+				wpa.Log.Info("Hostapd DISABLED")
+				wpa.StopAP()
+				return errors.New("hostapd disabled the AP")
+			}
+			if strings.Contains(out, "uap0: AP-ENABLED") {
+				wpa.Log.Info("Hostapd ENABLED")
+				return nil
+			}
 
-			return
+		case <-exited:
+			wpa.StopAP()
+			return errors.New("hostapd exited before enabling the AP")
 
+		case <-timeout:
+			wpa.StopAP()
+			return errors.New("hostapd did not enable the AP within " + apStartTimeout.String())
 		}
-		if strings.Contains(out, "uap0: AP-ENABLED") {
-			wpa.Log.Info("Hostapd ENABLED")
-			return
-		}
 	}
 }
 
+// StopAP stops hostapd and removes the AP interface.
+func (wpa *WpaCfg) StopAP() {
+	wpa.Log.Info("Stopping Hostapd.")
+
+	wpa.mu.Lock()
+	hostapd := wpa.hostapd
+	wpa.hostapd = nil
+	wpa.apChan = ""
+	wpa.mu.Unlock()
+
+	if hostapd != nil && hostapd.Process != nil {
+		hostapd.Process.Kill()
+		hostapd.Wait()
+	}
+
+	command := &Command{
+		Log:      wpa.Log,
+		SetupCfg: wpa.WpaCfg,
+	}
+
+	command.RemoveApInterface()
+	wpa.removeBridge(command)
+}
+
+// addBridge sets up the bridge for the AP. A bridge that already
+// exists, for example one the host manages, is used as it is and
+// left in place when the AP stops.
+func (wpa *WpaCfg) addBridge(command *Command) {
+	if err := command.AddBridge(); err != nil {
+		wpa.Log.Info("Using existing bridge %s", wpa.WpaCfg.BridgeCfg.Name)
+	} else {
+		wpa.mu.Lock()
+		wpa.bridge = true
+		wpa.mu.Unlock()
+	}
+
+	command.AddBridgeInterface()
+	command.UpBridge()
+}
+
+// removeBridge removes the bridge if addBridge created it.
+func (wpa *WpaCfg) removeBridge(command *Command) {
+	wpa.mu.Lock()
+	created := wpa.bridge
+	wpa.bridge = false
+	wpa.mu.Unlock()
+
+	if created {
+		command.RemoveBridge()
+	}
+}
+
+// ApClientCount returns the number of clients associated with the AP.
+func (wpa *WpaCfg) ApClientCount() int {
+	dumpOut, err := exec.Command("iw", "dev", "uap0", "station", "dump").Output()
+	if err != nil {
+		return 0
+	}
+
+	return strings.Count(string(dumpOut), "Station ")
+}
+
 // ConfiguredNetworks returns a list of configured wifi networks.
-func (wpa *WpaCfg) ConfiguredNetworks() string {
-	netOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan").Output()
+func (wpa *WpaCfg) ConfiguredNetworks() ([]WpaConfiguredNetwork, error) {
+	networks := []WpaConfiguredNetwork{}
+
+	netOut, err := exec.Command("wpa_cli", "-i", "wlan0", "list_networks").Output()
 	if err != nil {
-		wpa.Log.Fatal(err)
+		wpa.Log.Error(err.Error())
+		return networks, err
 	}
 
-	return string(netOut)
+	// network id / ssid / bssid / flags
+	lines := strings.Split(strings.TrimSpace(string(netOut)), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			continue
+		}
+
+		networks = append(networks, WpaConfiguredNetwork{
+			Id:    fields[0],
+			Ssid:  decodeSsid(fields[1]),
+			Bssid: fields[2],
+			Flags: fields[3],
+		})
+	}
+
+	return networks, nil
 }
 
+// connectPollInterval is how often the state of a new network is
+// checked while connecting to it.
+var connectPollInterval = 3 * time.Second
+
 // ConnectNetwork connects to a wifi network
 func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
-	connection := WpaConnection{}
+	if err := ValidateCredentials(creds); err != nil {
+		return WpaConnection{}, err
+	}
+
+	wpa.Events.Publish(Event{
+		Type:    EventConnectAttempt,
+		Message: "Connecting to " + creds.Ssid,
+		Payload: map[string]string{"ssid": creds.Ssid},
+	})
 
+	connection, err := wpa.connectNetwork(creds)
+
+	result := Event{
+		Type:    EventConnectResult,
+		Message: "Connection to " + creds.Ssid + " " + connection.State,
+		Payload: connection,
+	}
+	if err != nil {
+		result.Message = "Connection to " + creds.Ssid + " failed: " + err.Error()
+	}
+	wpa.Events.Publish(result)
+
+	return connection, err
+}
+
+// connectNetwork adds, enables and saves a network. A network that could
+// not be set up or did not connect is removed again, so a retry does not
+// leave it behind.
+func (wpa *WpaCfg) connectNetwork(creds WpaCredentials) (WpaConnection, error) {
 	// 1. Add a network
 	addNetOut, err := exec.Command("wpa_cli", "-i", "wlan0", "add_network").Output()
 	if err != nil {
-		wpa.Log.Fatal(err)
-		return connection, err
+		wpa.Log.Error("WPA add network failed: %s", err.Error())
+		return WpaConnection{}, err
 	}
 	net := strings.TrimSpace(string(addNetOut))
 	wpa.Log.Info("WPA add network got: %s", net)
 
+	connection, err := wpa.setupNetwork(net, creds)
+	if err != nil || connection.State != "COMPLETED" {
+		wpa.removeNetwork(net)
+	}
+
+	return connection, err
+}
+
+// removeNetwork removes a network from wpa_supplicant.
+func (wpa *WpaCfg) removeNetwork(net string) {
+	out, err := exec.Command("wpa_cli", "-i", "wlan0", "remove_network", net).Output()
+	if err != nil {
+		wpa.Log.Error("WPA remove network %s failed: %s", net, err.Error())
+		return
+	}
+	wpa.Log.Info("WPA remove network %s got: %s", net, strings.TrimSpace(string(out)))
+}
+
+// supplicantUp reports whether wpa_supplicant answers on wlan0.
+func (wpa *WpaCfg) supplicantUp() bool {
+	out, err := exec.Command("wpa_cli", "-i", "wlan0", "ping").Output()
+
+	return err == nil && strings.TrimSpace(string(out)) == "PONG"
+}
+
+// setupNetwork configures, enables and saves an added network.
+func (wpa *WpaCfg) setupNetwork(net string, creds WpaCredentials) (WpaConnection, error) {
+	connection := WpaConnection{}
+
 	// 2. Set the ssid for the new network
-	addSsidOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "ssid", "\""+creds.Ssid+"\"").Output()
+	addSsidOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "ssid", encodeSsid(creds.Ssid)).Output()
 	if err != nil {
 		wpa.Log.Fatal(err)
 		return connection, err
@@ -157,14 +424,48 @@ func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 	ssidStatus := strings.TrimSpace(string(addSsidOut))
 	wpa.Log.Info("WPA add ssid got: %s", ssidStatus)
 
-	// 3. Set the psk for the new network
-	addPskOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "psk", "\""+creds.Psk+"\"").Output()
-	if err != nil {
-		wpa.Log.Fatal(err.Error())
-		return connection, err
+	// hidden networks do not beacon their ssid and have to be probed for
+	if creds.Hidden {
+		scanSsidOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "scan_ssid", "1").Output()
+		if err != nil {
+			wpa.Log.Fatal(err)
+			return connection, err
+		}
+		wpa.Log.Info("WPA scan_ssid got: %s", strings.TrimSpace(string(scanSsidOut)))
+	}
+
+	// 3. Set the psk for the new network, open networks have none. WPA2
+	// networks get the derived key so the passphrase is never saved, SAE
+	// networks keep theirs in memory and in the secrets file. The keys go
+	// over the control socket to stay off the command line.
+	pskSettings := [][]string{{"psk", DerivePsk(creds.Ssid, creds.Psk)}}
+	if isHexPsk(creds.Psk) {
+		pskSettings = [][]string{{"psk", encodePsk(creds.Psk)}}
+	}
+	if creds.Psk == "" {
+		pskSettings = [][]string{{"key_mgmt", "NONE"}}
+	}
+	if creds.Sae {
+		if err := wpa.storeSecret(creds.Ssid, creds.Psk); err != nil {
+			wpa.Log.Error("Could not store SAE passphrase: %s", err.Error())
+			return connection, err
+		}
+
+		pskSettings = [][]string{
+			{"key_mgmt", "SAE"},
+			{"ieee80211w", "2"},
+			{"mem_only_psk", "1"},
+			{"psk", encodePsk(creds.Psk)},
+		}
+	}
+	for _, setting := range pskSettings {
+		pskStatus, err := wpa.wpaCtrl("SET_NETWORK " + net + " " + setting[0] + " " + setting[1])
+		if err != nil {
+			wpa.Log.Error("WPA %s failed: %s", setting[0], err.Error())
+			return connection, err
+		}
+		wpa.Log.Info("WPA %s got: %s", setting[0], pskStatus)
 	}
-	pskStatus := strings.TrimSpace(string(addPskOut))
-	wpa.Log.Info("WPA psk got: %s", pskStatus)
 
 	// 4. Enable the new network
 	enableOut, err := exec.Command("wpa_cli", "-i", "wlan0", "enable_network", net).Output()
@@ -203,18 +504,27 @@ func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 				saveStatus := strings.TrimSpace(string(saveOut))
 				wpa.Log.Info("WPA save got: %s", saveStatus)
 
+				wpa.Events.Publish(Event{
+					Type:    EventConfigChanged,
+					Message: "Saved " + creds.Ssid + " to " + wpa.WpaCfg.WpaSupplicantCfg.CfgFile,
+					Payload: map[string]string{"ssid": creds.Ssid, "file": wpa.WpaCfg.WpaSupplicantCfg.CfgFile},
+				})
+
 				connection.Ssid = creds.Ssid
 				connection.State = state
 
+				wpa.Prober.Trigger()
+
 				return connection, nil
 			}
 		}
 
-		time.Sleep(3 * time.Second)
+		time.Sleep(connectPollInterval)
 	}
 
+	connection.Ssid = creds.Ssid
 	connection.State = "FAIL"
-	connection.Message = "Unable to connection to " + creds.Ssid
+	connection.Message = "Unable to connect to " + creds.Ssid
 	return connection, nil
 }
 
@@ -233,14 +543,102 @@ func (wpa *WpaCfg) Status() (map[string]string, error) {
 	return cfgMap, nil
 }
 
-// cfgMapper takes a byte array and splits by \n and then by = and puts it all in a map.
+// rEventBssid matches the BSSID of a CTRL-EVENT-CONNECTED message.
+var rEventBssid = regexp.MustCompile("Connection to ([0-9a-fA-F:]{17})")
+
+// HandleSupplicantMessage publishes station events found in
+// wpa_supplicant output.
+func (wpa *WpaCfg) HandleSupplicantMessage(cmsg CmdMessage) {
+	if strings.Contains(cmsg.Message, "WPS-") {
+		wpa.handleWpsMessage(cmsg.Message)
+	}
+
+	if strings.Contains(cmsg.Message, "DPP-") {
+		wpa.handleDppMessage(cmsg.Message)
+	}
+
+	// answering waits on the control socket, which wpa_supplicant
+	// serves from the loop that writes these messages
+	if strings.Contains(cmsg.Message, "CTRL-REQ-PSK_PASSPHRASE-") {
+		go wpa.handlePskRequest(cmsg.Message)
+	}
+
+	switch {
+	case strings.Contains(cmsg.Message, "CTRL-EVENT-CONNECTED"):
+		wpa.connectProvision()
+
+		payload := make(map[string]string, 0)
+		if ms := rEventBssid.FindStringSubmatch(cmsg.Message); len(ms) > 1 {
+			payload["bssid"] = ms[1]
+		}
+
+		wpa.Events.Publish(Event{
+			Type:    EventStationConnected,
+			Message: "Station connected",
+			Payload: payload,
+		})
+
+	case strings.Contains(cmsg.Message, "CTRL-EVENT-DISCONNECTED"):
+		wpa.Events.Publish(Event{
+			Type:    EventStationDisconnected,
+			Message: "Station disconnected",
+			Payload: fieldMapper(cmsg.Message),
+		})
+	}
+}
+
+// handleHostapdMessage publishes AP client events found in
+// hostapd output.
+func (wpa *WpaCfg) handleHostapdMessage(line string) {
+	for marker, eventType := range map[string]string{
+		"AP-STA-CONNECTED ":    EventApClientJoined,
+		"AP-STA-DISCONNECTED ": EventApClientLeft,
+	} {
+		i := strings.Index(line, marker)
+		if i < 0 {
+			continue
+		}
+
+		fields := strings.Fields(line[i+len(marker):])
+		if len(fields) == 0 {
+			continue
+		}
+
+		message := "AP client joined " + fields[0]
+		if eventType == EventApClientLeft {
+			message = "AP client left " + fields[0]
+		}
+
+		wpa.Events.Publish(Event{
+			Type:    eventType,
+			Message: message,
+			Payload: map[string]string{"mac": fields[0]},
+		})
+	}
+}
+
+// fieldMapper puts the key=value fields of a single line in a map.
+func fieldMapper(line string) map[string]string {
+	fieldMap := make(map[string]string, 0)
+
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			fieldMap[kv[0]] = kv[1]
+		}
+	}
+
+	return fieldMap
+}
+
+// cfgMapper takes a byte array and splits by \n and then by the first = and puts it all in a map.
 func cfgMapper(data []byte) map[string]string {
 	cfgMap := make(map[string]string, 0)
 
 	lines := bytes.Split(data, []byte("\n"))
 
 	for _, line := range lines {
-		kv := bytes.Split(line, []byte("="))
+		kv := bytes.SplitN(line, []byte("="), 2)
 		if len(kv) > 1 {
 			cfgMap[string(kv[0])] = string(kv[1])
 		}
@@ -249,11 +647,37 @@ func cfgMapper(data []byte) map[string]string {
 	return cfgMap
 }
 
-// ScanNetworks returns a map of WpaNetwork data structures.
+// ScanNetworks returns a map of WpaNetwork data structures. Hidden
+// networks have an empty ssid and are keyed by bssid.
 func (wpa *WpaCfg) ScanNetworks() (map[string]WpaNetwork, error) {
+	return wpa.scanNetworks("scan")
+}
+
+// ScanSsid actively probes for an ssid, which finds hidden networks
+// broadcasting it, and returns the networks that answered.
+func (wpa *WpaCfg) ScanSsid(ssid string) (map[string]WpaNetwork, error) {
+	networks, err := wpa.scanNetworks("scan", "ssid", hex.EncodeToString([]byte(ssid)))
+
+	found := make(map[string]WpaNetwork, 0)
+	for key, network := range networks {
+		if network.Ssid == ssid {
+			found[key] = network
+		}
+	}
+
+	return found, err
+}
+
+// scanNetworks runs a wpa_cli scan command and reads the results.
+func (wpa *WpaCfg) scanNetworks(scanArgs ...string) (map[string]WpaNetwork, error) {
 	wpaNetworks := make(map[string]WpaNetwork, 0)
 
-	scanOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan").Output()
+	start := time.Now()
+	defer func() {
+		wpa.Metrics.Observe("iotwifi_scan_duration_seconds", time.Since(start).Seconds())
+	}()
+
+	scanOut, err := exec.Command("wpa_cli", append([]string{"-i", "wlan0"}, scanArgs...)...).Output()
 	if err != nil {
 		wpa.Log.Fatal(err)
 		return wpaNetworks, err
@@ -270,27 +694,47 @@ func (wpa *WpaCfg) ScanNetworks() (map[string]WpaNetwork, error) {
 			return wpaNetworks, err
 		}
 
-		networkListOutArr := strings.Split(string(networkListOut), "\n")
-		for _, netRecord := range networkListOutArr[1:] {
-			if strings.Contains(netRecord, "[P2P]") {
-				continue
-			}
+		wpaNetworks = parseScanResults(string(networkListOut))
+	}
+
+	return wpaNetworks, nil
+}
 
-			fields := strings.Fields(netRecord)
+// parseScanResults reads wpa_cli scan_results output. Hidden networks
+// have an empty ssid and are keyed by bssid.
+func parseScanResults(out string) map[string]WpaNetwork {
+	wpaNetworks := make(map[string]WpaNetwork, 0)
 
-			if len(fields) > 4 {
-				ssid := strings.Join(fields[4:], " ")
-				wpaNetworks[ssid] = WpaNetwork{
-					Bssid:       fields[0],
-					Frequency:   fields[1],
-					SignalLevel: fields[2],
-					Flags:       fields[3],
-					Ssid:        ssid,
-				}
-			}
+	networkListOutArr := strings.Split(out, "\n")
+	for _, netRecord := range networkListOutArr[1:] {
+		if strings.Contains(netRecord, "[P2P]") {
+			continue
+		}
+
+		// bssid / frequency / signal level / flags / ssid
+		fields := strings.Split(netRecord, "\t")
+		if len(fields) < 5 {
+			continue
 		}
 
+		network := WpaNetwork{
+			Bssid:       fields[0],
+			Frequency:   fields[1],
+			SignalLevel: fields[2],
+			Flags:       fields[3],
+			Ssid:        decodeSsid(fields[4]),
+		}
+
+		// hidden networks beacon an empty or zeroed ssid
+		if strings.Trim(network.Ssid, "\x00") == "" {
+			network.Ssid = ""
+			network.Hidden = true
+			wpaNetworks[network.Bssid] = network
+			continue
+		}
+
+		wpaNetworks[network.Ssid] = network
 	}
 
-	return wpaNetworks, nil
+	return wpaNetworks
 }
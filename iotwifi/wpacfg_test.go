@@ -0,0 +1,194 @@
+package iotwifi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScanResults(t *testing.T) {
+	header := "bssid / frequency / signal level / flags / ssid\n"
+
+	for _, tc := range []struct {
+		name     string
+		out      string
+		networks map[string]WpaNetwork
+	}{
+		{
+			"visible",
+			header + "aa:bb:cc:dd:ee:01\t2412\t-40\t[WPA2-PSK-CCMP][ESS]\thome\n",
+			map[string]WpaNetwork{
+				"home": {Bssid: "aa:bb:cc:dd:ee:01", Frequency: "2412", SignalLevel: "-40", Flags: "[WPA2-PSK-CCMP][ESS]", Ssid: "home"},
+			},
+		},
+		{
+			"hidden keyed by bssid",
+			header + "aa:bb:cc:dd:ee:01\t2412\t-40\t[WPA2-PSK-CCMP][ESS]\t\naa:bb:cc:dd:ee:02\t2437\t-60\t[WPA2-PSK-CCMP][ESS]\t\n",
+			map[string]WpaNetwork{
+				"aa:bb:cc:dd:ee:01": {Bssid: "aa:bb:cc:dd:ee:01", Frequency: "2412", SignalLevel: "-40", Flags: "[WPA2-PSK-CCMP][ESS]", Hidden: true},
+				"aa:bb:cc:dd:ee:02": {Bssid: "aa:bb:cc:dd:ee:02", Frequency: "2437", SignalLevel: "-60", Flags: "[WPA2-PSK-CCMP][ESS]", Hidden: true},
+			},
+		},
+		{
+			"zeroed ssid",
+			header + `aa:bb:cc:dd:ee:01	2412	-40	[ESS]	\x00\x00\x00` + "\n",
+			map[string]WpaNetwork{
+				"aa:bb:cc:dd:ee:01": {Bssid: "aa:bb:cc:dd:ee:01", Frequency: "2412", SignalLevel: "-40", Flags: "[ESS]", Hidden: true},
+			},
+		},
+		{
+			"escaped ssid",
+			header + `aa:bb:cc:dd:ee:01	5180	-50	[ESS]	caf\xc3\xa9` + "\n",
+			map[string]WpaNetwork{
+				"café": {Bssid: "aa:bb:cc:dd:ee:01", Frequency: "5180", SignalLevel: "-50", Flags: "[ESS]", Ssid: "café"},
+			},
+		},
+		{
+			"p2p and short lines skipped",
+			header + "aa:bb:cc:dd:ee:01\t2412\t-40\t[WPA2-PSK-CCMP][P2P]\tDIRECT-xy\naa:bb:cc:dd:ee:02\t2412\n",
+			map[string]WpaNetwork{},
+		},
+		{"empty", header, map[string]WpaNetwork{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if networks := parseScanResults(tc.out); !reflect.DeepEqual(networks, tc.networks) {
+				t.Errorf("networks = %+v, want %+v", networks, tc.networks)
+			}
+		})
+	}
+}
+
+func TestConnectNetworkHidden(t *testing.T) {
+	for _, tc := range []struct {
+		hidden   bool
+		scanSsid bool
+	}{
+		{true, true},
+		{false, false},
+	} {
+		calls, cleanupCli := fakeWpaCli(t)
+
+		wpa := testWpaCfg(t)
+		_, cleanupCtrl := fakeWpaCtrl(t, wpa, "OK")
+
+		if _, err := wpa.ConnectNetwork(WpaCredentials{Ssid: "home", Psk: "password1", Hidden: tc.hidden}); err != nil {
+			t.Errorf("hidden %t: %s", tc.hidden, err)
+		}
+
+		called, err := ioutil.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Contains(called, []byte("set_network 0 scan_ssid 1")); got != tc.scanSsid {
+			t.Errorf("hidden %t: scan_ssid set %t, wpa_cli calls:\n%s", tc.hidden, got, called)
+		}
+
+		cleanupCtrl()
+		cleanupCli()
+	}
+}
+
+func TestConnectNetworkRemoval(t *testing.T) {
+	interval := connectPollInterval
+	connectPollInterval = time.Millisecond
+	defer func() { connectPollInterval = interval }()
+
+	for _, tc := range []struct {
+		state   string
+		removed bool
+	}{
+		{"COMPLETED", false},
+		{"SCANNING", true},
+		{"4WAY_HANDSHAKE", true},
+	} {
+		dir, cleanupCli := fakeCommand(t, "wpa_cli", func(dir string) string {
+			return `echo "$@" >> ` + filepath.Join(dir, "calls") + `
+case "$3" in
+add_network) echo 0;;
+status) printf 'wpa_state=` + tc.state + `\n';;
+*) echo OK;;
+esac
+`
+		})
+
+		wpa := testWpaCfg(t)
+		_, cleanupCtrl := fakeWpaCtrl(t, wpa, "OK")
+
+		connection, err := wpa.ConnectNetwork(WpaCredentials{Ssid: "home", Psk: "password1"})
+		if err != nil {
+			t.Errorf("%s: %s", tc.state, err)
+		}
+
+		called, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connection.Ssid != "home" {
+			t.Errorf("%s: connection ssid %q", tc.state, connection.Ssid)
+		}
+		if removed := bytes.Contains(called, []byte("remove_network 0")); removed != tc.removed {
+			t.Errorf("%s: state %s, network removed %t, wpa_cli calls:\n%s", tc.state, connection.State, removed, called)
+		}
+
+		cleanupCtrl()
+		cleanupCli()
+	}
+}
+
+func TestBridgeRemoval(t *testing.T) {
+	_, cleanupIw := fakeCommand(t, "iw", func(dir string) string { return "exit 0\n" })
+	defer cleanupIw()
+	_, cleanupIfconfig := fakeCommand(t, "ifconfig", func(dir string) string { return "exit 0\n" })
+	defer cleanupIfconfig()
+
+	dir, cleanupBrctl := fakeCommand(t, "brctl", func(dir string) string {
+		return `echo "$@" >> ` + filepath.Join(dir, "calls") + `
+if [ "$1" = addbr ] && [ -f ` + filepath.Join(dir, "exists") + ` ]; then exit 1; fi
+`
+	})
+	defer cleanupBrctl()
+
+	for _, tc := range []struct {
+		exists  bool
+		removed bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		os.Remove(filepath.Join(dir, "calls"))
+		os.Remove(filepath.Join(dir, "exists"))
+		if tc.exists {
+			if err := ioutil.WriteFile(filepath.Join(dir, "exists"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		wpa := testWpaCfg(t)
+		wpa.WpaCfg.BridgeCfg = BridgeCfg{Enabled: true, Name: "br0", Interface: "eth0"}
+		command := &Command{Log: wpa.Log, SetupCfg: wpa.WpaCfg}
+
+		wpa.addBridge(command)
+		wpa.StopAP()
+		// a second stop finds nothing left to remove
+		wpa.StopAP()
+
+		called, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed := bytes.Count(called, []byte("delbr br0")); removed > 1 || (removed == 1) != tc.removed {
+			t.Errorf("existing %t: bridge removed %d times, brctl calls:\n%s", tc.exists, removed, called)
+		}
+	}
+
+	// without bridge mode a bridge is never touched
+	os.Remove(filepath.Join(dir, "calls"))
+	testWpaCfg(t).StopAP()
+	if called, _ := ioutil.ReadFile(filepath.Join(dir, "calls")); len(called) != 0 {
+		t.Errorf("brctl called without bridge mode:\n%s", called)
+	}
+}
@@ -0,0 +1,57 @@
+package iotwifi
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// wpaCtrlTimeout bounds a control socket request.
+const wpaCtrlTimeout = 5 * time.Second
+
+// wpaCtrl sends a command to wpa_supplicant over its control socket and
+// returns the reply. Commands carrying keys or passphrases go this way
+// rather than through wpa_cli, whose arguments show up in a process
+// listing.
+func (wpa *WpaCfg) wpaCtrl(command string) (string, error) {
+	remote := filepath.Join(wpa.WpaCfg.WpaSupplicantCfg.CtrlInterface, "wlan0")
+
+	// wpa_supplicant replies to the address of the sender, so the local
+	// end needs a path of its own
+	dir, err := ioutil.TempDir("", "iotwifi-ctrl")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: filepath.Join(dir, "ctrl"), Net: "unixgram"},
+		&net.UnixAddr{Name: remote, Net: "unixgram"})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(wpaCtrlTimeout))
+
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return "", err
+	}
+
+	reply := make([]byte, 4096)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return "", err
+	}
+
+	out := strings.TrimSpace(string(reply[:n]))
+	if out == "FAIL" || strings.HasPrefix(out, "UNKNOWN COMMAND") {
+		return out, errors.New("wpa_supplicant answered " + out)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,202 @@
+package iotwifi
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// WPS provisioning methods.
+const (
+	ProvisionWpsPbc = "wps_pbc"
+	ProvisionWpsPin = "wps_pin"
+)
+
+// wpsTimeout bounds a WPS run, wpa_supplicant itself gives up after
+// the two minute walk time.
+const wpsTimeout = 150 * time.Second
+
+// hostapdCtrl is the hostapd control socket directory, used for WPS
+// and channel switches.
+const hostapdCtrl = "/var/run/hostapd"
+
+// AP WPS errors.
+var (
+	ErrApWpsDisabled = errors.New("WPS is not enabled on the AP")
+	ErrApDown        = errors.New("the AP is not up")
+)
+
+// WpsRequest starts a WPS run. Bssid limits the run to one AP, any AP
+// is used when empty. Pin is used by PIN runs and is generated when
+// empty.
+type WpsRequest struct {
+	Bssid string `json:"bssid"`
+	Pin   string `json:"pin"`
+}
+
+// ValidateWpsPin checks that a pin is 4 digits or 8 digits with a
+// valid checksum digit.
+func ValidateWpsPin(pin string) error {
+	if len(pin) != 4 && len(pin) != 8 {
+		return errors.New("pin must be 4 or 8 digits")
+	}
+
+	for i := 0; i < len(pin); i++ {
+		if pin[i] < '0' || pin[i] > '9' {
+			return errors.New("pin must be 4 or 8 digits")
+		}
+	}
+
+	if len(pin) == 4 {
+		return nil
+	}
+
+	// the last digit checks the first seven, weighted 3, 1, 3, ...
+	sum := 0
+	for i := 0; i < 8; i++ {
+		digit := int(pin[i] - '0')
+		if i%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	if sum%10 != 0 {
+		return errors.New("pin checksum digit is wrong")
+	}
+
+	return nil
+}
+
+// WpsPbc starts a WPS push button run on the station. The AP's button
+// has to be pressed within two minutes.
+func (wpa *WpaCfg) WpsPbc(req WpsRequest) (ProvisionStatus, error) {
+	if err := wpa.startProvision(ProvisionWpsPbc, wpsTimeout); err != nil {
+		return wpa.Provision(), err
+	}
+
+	args := []string{"-i", "wlan0", "wps_pbc"}
+	if req.Bssid != "" {
+		args = append(args, req.Bssid)
+	}
+
+	if _, err := wpa.wpsCommand(args...); err != nil {
+		return wpa.Provision(), err
+	}
+
+	return wpa.Provision(), nil
+}
+
+// WpsPin starts a WPS PIN run on the station. The pin, generated by
+// wpa_supplicant when the request has none, has to be entered on the
+// AP within two minutes.
+func (wpa *WpaCfg) WpsPin(req WpsRequest) (ProvisionStatus, error) {
+	if req.Pin != "" {
+		if err := ValidateWpsPin(req.Pin); err != nil {
+			return wpa.Provision(), err
+		}
+	}
+
+	if err := wpa.startProvision(ProvisionWpsPin, wpsTimeout); err != nil {
+		return wpa.Provision(), err
+	}
+
+	bssid := req.Bssid
+	if bssid == "" {
+		bssid = "any"
+	}
+
+	args := []string{"-i", "wlan0", "wps_pin", bssid}
+	if req.Pin != "" {
+		args = append(args, req.Pin)
+	}
+
+	pin, err := wpa.wpsCommand(args...)
+	if err != nil {
+		return wpa.Provision(), err
+	}
+	wpa.setProvisionPin(pin)
+
+	return wpa.Provision(), nil
+}
+
+// wpsCommand runs a wpa_cli WPS command and fails the pending run when
+// wpa_supplicant refuses it.
+func (wpa *WpaCfg) wpsCommand(args ...string) (string, error) {
+	out, err := exec.Command("wpa_cli", args...).Output()
+	if err != nil {
+		wpa.finishProvision(ProvisionFailed, err.Error())
+		return "", err
+	}
+
+	result := strings.TrimSpace(string(out))
+	wpa.Log.Info("WPA %s got: %s", args[2], result)
+
+	if result == "FAIL" || strings.HasPrefix(result, "FAIL-") {
+		err := errors.New("wpa_supplicant refused " + args[2] + ": " + result)
+		wpa.finishProvision(ProvisionFailed, err.Error())
+		return "", err
+	}
+
+	return result, nil
+}
+
+// handleWpsMessage follows the pending WPS run in wpa_supplicant
+// output. A failed exchange is retried by wpa_supplicant until the walk
+// time ends with WPS-TIMEOUT.
+func (wpa *WpaCfg) handleWpsMessage(line string) {
+	if !strings.HasPrefix(wpa.Provision().Method, "wps_") {
+		return
+	}
+
+	switch {
+	case strings.Contains(line, "WPS-SUCCESS"):
+		wpa.receiveProvision("Credentials received")
+	case strings.Contains(line, "WPS-OVERLAP-DETECTED"):
+		wpa.finishProvision(ProvisionFailed, "More than one AP is in push button mode")
+	case strings.Contains(line, "WPS-TIMEOUT"):
+		wpa.finishProvision(ProvisionFailed, "Timed out waiting for the AP")
+	case strings.Contains(line, "WPS-FAIL"):
+		wpa.Log.Warn("WPS attempt failed, retrying: %s", strings.TrimSpace(line[strings.Index(line, "WPS-FAIL")+len("WPS-FAIL"):]))
+	}
+}
+
+// ApWpsPbc presses the WPS button of the AP so a client can join
+// without the passphrase.
+func (wpa *WpaCfg) ApWpsPbc() error {
+	return wpa.apWpsCommand("wps_pbc")
+}
+
+// ApWpsPin lets a client with the given pin join the AP.
+func (wpa *WpaCfg) ApWpsPin(pin string) error {
+	if err := ValidateWpsPin(pin); err != nil {
+		return err
+	}
+
+	return wpa.apWpsCommand("wps_pin", "any", pin)
+}
+
+// apWpsCommand runs a hostapd_cli WPS command on the AP.
+func (wpa *WpaCfg) apWpsCommand(args ...string) error {
+	if !wpa.WpaCfg.HostApdCfg.Wps {
+		return ErrApWpsDisabled
+	}
+
+	if !wpa.ApStatus().Up {
+		return ErrApDown
+	}
+
+	out, err := exec.Command("hostapd_cli", append([]string{"-p", hostapdCtrl, "-i", "uap0"}, args...)...).Output()
+	if err != nil {
+		return err
+	}
+
+	result := strings.TrimSpace(string(out))
+	wpa.Log.Info("Hostapd %s got: %s", args[0], result)
+
+	if strings.HasPrefix(result, "FAIL") {
+		return errors.New("hostapd refused " + args[0] + ": " + result)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package iotwifi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidateWpsPin(t *testing.T) {
+	for _, tc := range []struct {
+		pin   string
+		valid bool
+	}{
+		{"12345670", true},
+		{"49226874", true},
+		{"00000000", true},
+		{"1234", true},
+		{"12345678", false},
+		{"49226875", false},
+		{"1234567", false},
+		{"123456701", false},
+		{"", false},
+		{"1234567a", false},
+		{"12a4", false},
+		{"-1234567", false},
+	} {
+		if err := ValidateWpsPin(tc.pin); (err == nil) != tc.valid {
+			t.Errorf("ValidateWpsPin(%q) = %v, want valid %t", tc.pin, err, tc.valid)
+		}
+	}
+}
+
+func TestHandleWpsMessage(t *testing.T) {
+	_, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		method  string
+		line    string
+		state   string
+		message string
+	}{
+		{ProvisionWpsPbc, "<3>WPS-SUCCESS", ProvisionPending, "Credentials received"},
+		{ProvisionWpsPbc, "<3>WPS-OVERLAP-DETECTED", ProvisionFailed, "More than one AP is in push button mode"},
+		{ProvisionWpsPin, "<3>WPS-TIMEOUT", ProvisionFailed, "Timed out waiting for the AP"},
+		{ProvisionWpsPin, "<3>WPS-FAIL msg=8 config_error=18", ProvisionPending, ""},
+		{ProvisionWpsPbc, "<3>CTRL-EVENT-SCAN-RESULTS", ProvisionPending, ""},
+		{ProvisionDpp, "<3>WPS-SUCCESS", ProvisionPending, ""},
+	} {
+		wpa := testWpaCfg(t)
+		if err := wpa.startProvision(tc.method, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		wpa.handleWpsMessage(tc.line)
+
+		if status := wpa.Provision(); status.State != tc.state || status.Message != tc.message {
+			t.Errorf("%s %q: %s %q, want %s %q", tc.method, tc.line, status.State, status.Message, tc.state, tc.message)
+		}
+	}
+}
+
+func TestWpsConnect(t *testing.T) {
+	calls, cleanup := fakeWpaCli(t)
+	defer cleanup()
+
+	connected := CmdMessage{Id: "wpa_supplicant", Message: "<3>CTRL-EVENT-CONNECTED - Connection to aa:bb:cc:dd:ee:01 completed"}
+
+	for _, tc := range []struct {
+		lines   []string
+		state   string
+		message string
+	}{
+		{[]string{"<3>WPS-SUCCESS"}, ProvisionSuccess, "Connected to the received network"},
+		{[]string{"<3>WPS-FAIL msg=8 config_error=18", "<3>WPS-SUCCESS"}, ProvisionSuccess, "Connected to the received network"},
+		{[]string{"<3>WPS-FAIL msg=8 config_error=18"}, ProvisionPending, ""},
+		{nil, ProvisionPending, ""},
+	} {
+		os.Remove(calls)
+
+		wpa := testWpaCfg(t)
+		if err := wpa.startProvision(ProvisionWpsPbc, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range tc.lines {
+			wpa.HandleSupplicantMessage(CmdMessage{Id: "wpa_supplicant", Message: line})
+		}
+		wpa.HandleSupplicantMessage(connected)
+
+		status := wpa.Provision()
+		if status.State != tc.state || status.Message != tc.message {
+			t.Errorf("%q: %s %q, want %s %q", tc.lines, status.State, status.Message, tc.state, tc.message)
+		}
+
+		// the run is completed off the message loop
+		called, _ := ioutil.ReadFile(calls)
+		if bytes.Contains(called, []byte("save_config")) {
+			t.Errorf("%q: saved on the message loop", tc.lines)
+		}
+
+		if status.State == ProvisionPending {
+			continue
+		}
+
+		wpa.completeProvision(<-wpa.provisioned)
+
+		called, _ = ioutil.ReadFile(calls)
+		if !bytes.Contains(called, []byte("save_config")) {
+			t.Errorf("%q: received network not saved", tc.lines)
+		}
+	}
+}
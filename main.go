@@ -4,10 +4,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bhoriuchi/go-bunyan/bunyan"
 	"github.com/cjimti/iotwifi/iotwifi"
@@ -20,13 +26,57 @@ type ApiReturn struct {
 	Status  string      `json:"status"`
 	Message string      `json:"message"`
 	Payload interface{} `json:"payload"`
+	Error   *ApiError   `json:"error,omitempty"`
+}
+
+// ApiError describes why an API call failed.
+type ApiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// errorCodes maps HTTP statuses to ApiError codes.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "invalid_request",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusUnprocessableEntity: "connect_failed",
+	http.StatusTooManyRequests:     "rate_limited",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusServiceUnavailable:  "unavailable",
 }
 
 func main() {
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	if command == "serve" {
+		serve()
+		return
+	}
+
+	os.Exit(runCli(command, os.Args[2:]))
+}
+
+// serve runs the wifi manager and its API.
+func serve() {
+
+	// secrets are redacted from the log unless IOTWIFI_LOG_UNSAFE is
+	// set to exactly "true" while debugging
+	logUnsafe := getEnv("IOTWIFI_LOG_UNSAFE", "") == "true"
+
+	logStream := iotwifi.NewRedactWriter(os.Stdout)
+	if logUnsafe {
+		logStream = os.Stdout
+	}
 
 	logConfig := bunyan.Config{
 		Name:   "iotwifi",
-		Stream: os.Stdout,
+		Stream: logStream,
 		Level:  bunyan.LogLevelDebug,
 	}
 
@@ -36,142 +86,265 @@ func main() {
 	}
 
 	blog.Info("Starting IoT Wifi...")
+	if logUnsafe {
+		blog.Warn("IOTWIFI_LOG_UNSAFE is set, secrets are written to the log unredacted")
+	}
 
 	messages := make(chan iotwifi.CmdMessage, 1)
 
 	cfgUrl := setEnvIfEmpty("IOTWIFI_CFG", "cfg/wificfg.json")
 	port := setEnvIfEmpty("IOTWIFI_PORT", "8080")
+	socket := setEnvIfEmpty("IOTWIFI_SOCKET", "/var/run/iotwifi.sock")
 
-	go iotwifi.RunWifi(blog, messages, cfgUrl)
 	wpacfg := iotwifi.NewWpaCfg(blog, cfgUrl)
+	go iotwifi.RunWifi(blog, messages, wpacfg)
 
-	apiPayloadReturn := func(w http.ResponseWriter, message string, payload interface{}) {
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: message,
-			Payload: payload,
-		}
-		ret, _ := json.Marshal(apiReturn)
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+	retError := func(w http.ResponseWriter, status int, err error, details interface{}) {
+		writeError(blog, w, status, err, details)
 	}
 
-	// marshallPost populates a struct with json in post body
-	marshallPost := func(w http.ResponseWriter, r *http.Request, v interface{}) {
-		bytes, err := ioutil.ReadAll(r.Body)
+	// handle /status POSTs json in the form of iotwifi.WpaConnect
+	statusHandler := func(w http.ResponseWriter, r *http.Request) {
+
+		status, err := wpacfg.StationStatus()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			blog.Error(err)
+			retError(w, http.StatusServiceUnavailable, err, nil)
 			return
 		}
 
-		defer r.Body.Close()
+		apiPayloadReturn(w, "status", status)
+	}
 
-		decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+	// scan for wifi networks, probing for a single ssid when one is given
+	scanHandler := func(w http.ResponseWriter, r *http.Request) {
+		blog.Info("Got Scan")
 
-		err = decoder.Decode(&v)
+		var wpaNetworks map[string]iotwifi.WpaNetwork
+		var err error
+		if ssid := r.URL.Query().Get("ssid"); ssid != "" {
+			if len(ssid) > 32 {
+				retError(w, http.StatusBadRequest, errors.New("ssid must be 1 to 32 bytes"), map[string]string{"param": "ssid"})
+				return
+			}
+			wpaNetworks, err = wpacfg.ScanSsid(ssid)
+		} else {
+			wpaNetworks, err = wpacfg.ScanNetworks()
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			blog.Error(err)
+			retError(w, http.StatusServiceUnavailable, err, nil)
 			return
 		}
+
+		apiPayloadReturn(w, "Networks", wpaNetworks)
 	}
 
-	// common error return from api
-	retError := func(w http.ResponseWriter, err error) {
-		apiReturn := &ApiReturn{
-			Status:  "FAIL",
-			Message: err.Error(),
-		}
-		ret, _ := json.Marshal(apiReturn)
+	// kill the application
+	killHandler := func(w http.ResponseWriter, r *http.Request) {
+		messages <- iotwifi.CmdMessage{Id: "kill"}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		apiPayloadReturn(w, "Killing service.", nil)
 	}
 
-	// handle /status POSTs json in the form of iotwifi.WpaConnect
-	statusHandler := func(w http.ResponseWriter, r *http.Request) {
+	// networks saved in wpa_supplicant
+	networksHandler := func(w http.ResponseWriter, r *http.Request) {
+		networks, err := wpacfg.ConfiguredNetworks()
+		if err != nil {
+			retError(w, http.StatusServiceUnavailable, err, nil)
+			return
+		}
 
-		status, err := wpacfg.Status()
+		apiPayloadReturn(w, "Configured networks", networks)
+	}
+
+	// clients associated with the AP
+	clientsHandler := func(w http.ResponseWriter, r *http.Request) {
+		clients, err := wpacfg.ApClients()
 		if err != nil {
-			blog.Error(err.Error())
+			retError(w, http.StatusServiceUnavailable, err, nil)
 			return
 		}
 
-		apiPayloadReturn(w, "status", status)
+		apiPayloadReturn(w, "AP clients", clients)
 	}
 
-	// handle /connect POSTs json in the form of iotwifi.WpaConnect
-	connectHandler := func(w http.ResponseWriter, r *http.Request) {
-		var creds iotwifi.WpaCredentials
-		marshallPost(w, r, &creds)
+	// status of the AP
+	apHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "AP status", wpacfg.ApStatus())
+	}
+
+	// station link quality history, optionally since an RFC 3339 time
+	linkHistoryHandler := func(w http.ResponseWriter, r *http.Request) {
+		since := time.Time{}
+		if s := r.URL.Query().Get("since"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				retError(w, http.StatusBadRequest, err, map[string]string{"param": "since"})
+				return
+			}
+			since = t
+		}
 
-		blog.Info("Connect Handler Got: ssid:|%s| psk:|%s|", creds.Ssid, creds.Psk)
+		apiPayloadReturn(w, "Link history", wpacfg.Link.History(since))
+	}
 
-		connection, err := wpacfg.ConnectNetwork(creds)
-		if err != nil {
-			blog.Error(err.Error())
-			return
+	// query the event journal by time range and event types
+	journalHandler := func(w http.ResponseWriter, r *http.Request) {
+		q := iotwifi.JournalQuery{}
+		params := r.URL.Query()
+
+		for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+			if s := params.Get(name); s != "" {
+				parsed, err := time.Parse(time.RFC3339, s)
+				if err != nil {
+					retError(w, http.StatusBadRequest, err, map[string]string{"param": name})
+					return
+				}
+				*t = parsed
+			}
+		}
+
+		if s := params.Get("type"); s != "" {
+			q.Types = strings.Split(s, ",")
 		}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Connection",
-			Payload: connection,
+		if s := params.Get("limit"); s != "" {
+			limit, err := strconv.Atoi(s)
+			if err != nil {
+				retError(w, http.StatusBadRequest, err, map[string]string{"param": "limit"})
+				return
+			}
+			q.Limit = limit
 		}
 
-		ret, err := json.Marshal(apiReturn)
+		events, err := wpacfg.Journal.Query(q)
 		if err != nil {
-			retError(w, err)
+			retError(w, http.StatusInternalServerError, err, nil)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		apiPayloadReturn(w, "Journal", events)
 	}
 
-	// scan for wifi networks
-	scanHandler := func(w http.ResponseWriter, r *http.Request) {
-		blog.Info("Got Scan")
-		wpaNetworks, err := wpacfg.ScanNetworks()
-		if err != nil {
-			retError(w, err)
+	// status of the last WPS or other provisioning run
+	provisionHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Provisioning", wpacfg.Provision())
+	}
+
+	// start a WPS push button or PIN run on the station
+	wpsHandler := func(start func(iotwifi.WpsRequest) (iotwifi.ProvisionStatus, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// the request body is optional
+			var req iotwifi.WpsRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				retError(w, http.StatusBadRequest, err, nil)
+				return
+			}
+
+			if req.Pin != "" {
+				if err := iotwifi.ValidateWpsPin(req.Pin); err != nil {
+					retError(w, http.StatusBadRequest, err, map[string]string{"field": "pin"})
+					return
+				}
+			}
+
+			status, err := start(req)
+			if err == iotwifi.ErrProvisionPending {
+				retError(w, http.StatusConflict, err, status)
+				return
+			}
+			if err != nil {
+				retError(w, http.StatusServiceUnavailable, err, nil)
+				return
+			}
+
+			apiPayloadReturn(w, "WPS started", status)
+		}
+	}
+
+	// DPP bootstrap URI and onboarding status
+	dppHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "DPP", wpacfg.Dpp())
+	}
+
+	// listen for a DPP configurator
+	dppStartHandler := func(w http.ResponseWriter, r *http.Request) {
+		// the request body is optional
+		var req iotwifi.DppRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			retError(w, http.StatusBadRequest, err, nil)
 			return
 		}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Networks",
-			Payload: wpaNetworks,
+		if req.Channel != 0 {
+			if err := iotwifi.ValidateDppChannel(req.Channel); err != nil {
+				retError(w, http.StatusBadRequest, err, map[string]string{"field": "channel"})
+				return
+			}
 		}
 
-		ret, err := json.Marshal(apiReturn)
+		status, err := wpacfg.DppStart(req)
+		if err == iotwifi.ErrProvisionPending {
+			retError(w, http.StatusConflict, err, status)
+			return
+		}
 		if err != nil {
-			retError(w, err)
+			retError(w, http.StatusServiceUnavailable, err, nil)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		apiPayloadReturn(w, "DPP listening", status)
 	}
 
-	// kill the application
-	killHandler := func(w http.ResponseWriter, r *http.Request) {
-		messages <- iotwifi.CmdMessage{Id: "kill"}
+	// stop listening for a DPP configurator
+	dppStopHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "DPP stopped", wpacfg.DppStop())
+	}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Killing service.",
+	// press the WPS button of the AP
+	apWpsPbcHandler := func(w http.ResponseWriter, r *http.Request) {
+		if err := wpacfg.ApWpsPbc(); err != nil {
+			retError(w, apWpsStatus(err), err, nil)
+			return
 		}
-		ret, err := json.Marshal(apiReturn)
-		if err != nil {
-			retError(w, err)
+
+		apiPayloadReturn(w, "AP WPS button pressed", nil)
+	}
+
+	// let a client with a WPS pin join the AP
+	apWpsPinHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.WpsRequest
+		if err := marshallPost(r, &req); err != nil {
+			retError(w, http.StatusBadRequest, err, nil)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		if err := iotwifi.ValidateWpsPin(req.Pin); err != nil {
+			retError(w, http.StatusBadRequest, err, map[string]string{"field": "pin"})
+			return
+		}
+
+		if err := wpacfg.ApWpsPin(req.Pin); err != nil {
+			retError(w, apWpsStatus(err), err, nil)
+			return
+		}
+
+		apiPayloadReturn(w, "AP WPS pin accepted", nil)
+	}
+
+	// radio capabilities and where the station and AP were placed
+	radiosHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Radios", wpacfg.Radios())
+	}
+
+	// configured country and the regulatory rules in effect
+	regulatoryHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Regulatory domain", wpacfg.Regulatory())
+	}
+
+	// prometheus metrics
+	metricsHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		wpacfg.Metrics.Write(w)
 	}
 
 	// common log middleware for api
@@ -187,15 +360,284 @@ func main() {
 		})
 	}
 
+	// audited records calls to api routes that change device state
+	audited := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next(sw, r)
+
+			wpacfg.Events.Publish(iotwifi.Event{
+				Type:    iotwifi.EventApiRequest,
+				Message: r.Method + " " + r.URL.Path + " from " + r.RemoteAddr,
+				Payload: iotwifi.ApiRequest{
+					Remote: r.RemoteAddr,
+					Method: r.Method,
+					Path:   r.URL.Path,
+					Status: sw.status,
+				},
+			})
+		}
+	}
+
+	limiter := iotwifi.NewLimiter(blog, wpacfg.WpaCfg.LimitCfg, wpacfg.Events)
+
+	// limited applies the limiter to api routes that change device state
+	limited := func(next http.HandlerFunc) http.HandlerFunc {
+		return limitedHandler(limiter, wpacfg.Metrics, next)
+	}
+
+	// deprecated marks a legacy route as an alias of its v1 successor
+	deprecated := func(successor string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+			next(w, r)
+		}
+	}
+
+	// request count and latency middleware for api
+	metricsMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if tpl, err := current.GetPathTemplate(); err == nil {
+					route = tpl
+				}
+			}
+
+			wpacfg.Metrics.Add("iotwifi_http_requests_total", 1, "route", route, "method", r.Method, "code", strconv.Itoa(sw.status))
+			wpacfg.Metrics.Observe("iotwifi_http_request_duration_seconds", time.Since(start).Seconds(), "route", route, "method", r.Method)
+		})
+	}
+
 	// setup router and middleware
 	r := mux.NewRouter()
 	r.Use(logHandler)
+	r.Use(metricsMiddleware)
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		retError(w, http.StatusNotFound, errors.New("no route for "+r.URL.Path), nil)
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		retError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" is not allowed on "+r.URL.Path), nil)
+	})
+
+	dateTime := map[string]interface{}{"type": "string", "format": "date-time"}
+
+	// set app routes, each served under /v1 with its methods enforced,
+	// routes predating /v1 also at their legacy path as a deprecated alias
+	routes := []apiRoute{
+		{
+			path:    "/status",
+			methods: []string{"GET"},
+			summary: "Station status.",
+			payload: iotwifi.StationStatus{},
+			legacy:  true,
+			handler: statusHandler,
+		},
+		{
+			path:          "/connect",
+			methods:       []string{"POST"},
+			legacyMethods: []string{"POST"},
+			summary:       "Connect the station to a network.",
+			body:          iotwifi.WpaCredentials{},
+			required:      []string{"ssid"},
+			payload:       iotwifi.WpaConnection{},
+			legacy:        true,
+			limited:       true,
+			handler:       connectHandler(blog, wpacfg.ConnectNetwork),
+		},
+		{
+			path:    "/scan",
+			methods: []string{"GET"},
+			summary: "Scan for networks, keyed by ssid or by bssid for hidden networks.",
+			params: []apiParam{
+				{"ssid", map[string]interface{}{"type": "string"}, "actively probe for this ssid, finding hidden networks"},
+			},
+			payload: map[string]iotwifi.WpaNetwork{},
+			legacy:  true,
+			handler: scanHandler,
+		},
+		{
+			path:          "/kill",
+			methods:       []string{"POST"},
+			legacyMethods: []string{"POST"},
+			summary:       "Stop the service.",
+			legacy:        true,
+			limited:       true,
+			handler:       killHandler,
+		},
+		{
+			path:    "/metrics",
+			methods: []string{"GET"},
+			summary: "Metrics in the Prometheus text format.",
+			text:    true,
+			legacy:  true,
+			handler: metricsHandler,
+		},
+		{
+			path:    "/link/history",
+			methods: []string{"GET"},
+			summary: "Station link quality history.",
+			params: []apiParam{
+				{"since", dateTime, "only samples after this time"},
+			},
+			payload: []iotwifi.LinkSample{},
+			legacy:  true,
+			handler: linkHistoryHandler,
+		},
+		{
+			path:    "/journal",
+			methods: []string{"GET"},
+			summary: "Query the event journal.",
+			params: []apiParam{
+				{"since", dateTime, "only events at or after this time"},
+				{"until", dateTime, "only events at or before this time"},
+				{"type", map[string]interface{}{"type": "string"}, "comma separated event types"},
+				{"limit", map[string]interface{}{"type": "integer", "minimum": 1}, "only the most recent events"},
+			},
+			payload: []iotwifi.Event{},
+			legacy:  true,
+			handler: journalHandler,
+		},
+		{
+			path:    "/networks",
+			methods: []string{"GET"},
+			summary: "Networks saved in wpa_supplicant.",
+			payload: []iotwifi.WpaConfiguredNetwork{},
+			legacy:  true,
+			handler: networksHandler,
+		},
+		{
+			path:    "/clients",
+			methods: []string{"GET"},
+			summary: "Clients associated with the AP.",
+			payload: []iotwifi.ApClient{},
+			legacy:  true,
+			handler: clientsHandler,
+		},
+		{
+			path:    "/ap",
+			methods: []string{"GET"},
+			summary: "AP status.",
+			payload: iotwifi.ApStatus{},
+			legacy:  true,
+			handler: apHandler,
+		},
+		{
+			path:    "/wps",
+			methods: []string{"GET"},
+			summary: "Status of the last WPS run.",
+			payload: iotwifi.ProvisionStatus{},
+			handler: provisionHandler,
+		},
+		{
+			path:         "/wps/pbc",
+			methods:      []string{"POST"},
+			summary:      "Start WPS push button provisioning of the station.",
+			body:         iotwifi.WpsRequest{},
+			bodyOptional: true,
+			payload:      iotwifi.ProvisionStatus{},
+			limited:      true,
+			handler:      wpsHandler(wpacfg.WpsPbc),
+		},
+		{
+			path:         "/wps/pin",
+			methods:      []string{"POST"},
+			summary:      "Start WPS PIN provisioning of the station, generating a pin when none is given.",
+			body:         iotwifi.WpsRequest{},
+			bodyOptional: true,
+			payload:      iotwifi.ProvisionStatus{},
+			limited:      true,
+			handler:      wpsHandler(wpacfg.WpsPin),
+		},
+		{
+			path:    "/dpp",
+			methods: []string{"GET"},
+			summary: "DPP bootstrap URI, to show as a QR code, and onboarding status.",
+			payload: iotwifi.DppStatus{},
+			handler: dppHandler,
+		},
+		{
+			path:         "/dpp",
+			methods:      []string{"POST"},
+			summary:      "Listen for a DPP configurator, generating the bootstrap URI.",
+			body:         iotwifi.DppRequest{},
+			bodyOptional: true,
+			payload:      iotwifi.DppStatus{},
+			limited:      true,
+			handler:      dppStartHandler,
+		},
+		{
+			path:    "/dpp",
+			methods: []string{"DELETE"},
+			summary: "Stop listening for a DPP configurator.",
+			payload: iotwifi.DppStatus{},
+			limited: true,
+			handler: dppStopHandler,
+		},
+		{
+			path:    "/ap/wps/pbc",
+			methods: []string{"POST"},
+			summary: "Press the WPS button of the AP.",
+			limited: true,
+			handler: apWpsPbcHandler,
+		},
+		{
+			path:     "/ap/wps/pin",
+			methods:  []string{"POST"},
+			summary:  "Let a client with a WPS pin join the AP.",
+			body:     iotwifi.WpsRequest{},
+			required: []string{"pin"},
+			limited:  true,
+			handler:  apWpsPinHandler,
+		},
+		{
+			path:    "/radios",
+			methods: []string{"GET"},
+			summary: "Radio capabilities and the PHYs the station and AP run on.",
+			payload: iotwifi.RadioStatus{},
+			handler: radiosHandler,
+		},
+		{
+			path:    "/regulatory",
+			methods: []string{"GET"},
+			summary: "Configured country, the regulatory rules in effect and whether the AP channel is allowed.",
+			payload: iotwifi.RegulatoryStatus{},
+			handler: regulatoryHandler,
+		},
+	}
+
+	spec := openApiSpec(routes)
+
+	// guarded limits and audits routes that change device state
+	guarded := func(next http.HandlerFunc) http.HandlerFunc {
+		return limited(audited(next))
+	}
+
+	for _, route := range routes {
+		r.HandleFunc("/v1"+route.path, routeHandler(blog, spec, route, true, guarded)).Methods(route.methods...)
+
+		if !route.legacy {
+			continue
+		}
+
+		legacy := r.HandleFunc(route.path, deprecated("/v1"+route.path, routeHandler(blog, spec, route, false, guarded)))
+		if route.legacyMethods != nil {
+			legacy.Methods(route.legacyMethods...)
+		}
+	}
+
+	// the OpenAPI document for the v1 routes
+	r.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spec)
+	}).Methods("GET")
 
-	// set app routes
-	r.HandleFunc("/status", statusHandler)
-	r.HandleFunc("/connect", connectHandler).Methods("POST")
-	r.HandleFunc("/scan", scanHandler)
-	r.HandleFunc("/kill", killHandler)
 	http.Handle("/", r)
 
 	// CORS
@@ -203,10 +645,228 @@ func main() {
 	originsOk := handlers.AllowedOrigins([]string{"*"})
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
 
+	handler := handlers.CORS(originsOk, headersOk, methodsOk)(r)
+
+	// serve http on the unix socket for the cli
+	listener, err := listenSocket(socket)
+	if err != nil {
+		blog.Error("Could not listen on %s: %s", socket, err.Error())
+	} else {
+		blog.Info("HTTP Listening on " + socket)
+		go http.Serve(listener, handler)
+	}
+
 	// serve http
 	blog.Info("HTTP Listening on " + port)
-	http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(r))
+	http.ListenAndServe(":"+port, handler)
+
+}
+
+// apiPayloadReturn writes an OK api return.
+func apiPayloadReturn(w http.ResponseWriter, message string, payload interface{}) {
+	apiReturn := &ApiReturn{
+		Status:  "OK",
+		Message: message,
+		Payload: payload,
+	}
+	ret, _ := json.Marshal(apiReturn)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// marshallPost populates a struct with json in post body
+func marshallPost(r *http.Request, v interface{}) error {
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if len(strings.TrimSpace(string(bytes))) == 0 {
+		return errors.New("request body is empty")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+
+	return decoder.Decode(v)
+}
+
+// writeError is the common error return from api, server errors
+// are logged.
+func writeError(log bunyan.Logger, w http.ResponseWriter, status int, err error, details interface{}) {
+	if status >= http.StatusInternalServerError {
+		log.Error(err.Error())
+	}
+
+	apiReturn := &ApiReturn{
+		Status:  "FAIL",
+		Message: err.Error(),
+		Error: &ApiError{
+			Code:    errorCodes[status],
+			Message: err.Error(),
+			Details: details,
+		},
+	}
+	ret, _ := json.Marshal(apiReturn)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(ret)
+}
+
+// connectHandler handles /connect POSTs json in the form of
+// iotwifi.WpaCredentials.
+func connectHandler(log bunyan.Logger, connect func(iotwifi.WpaCredentials) (iotwifi.WpaConnection, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var creds iotwifi.WpaCredentials
+		if err := marshallPost(r, &creds); err != nil {
+			writeError(log, w, http.StatusBadRequest, err, nil)
+			return
+		}
+
+		if err := iotwifi.ValidateCredentials(creds); err != nil {
+			writeError(log, w, http.StatusBadRequest, err, map[string]string{"field": err.(*iotwifi.CredentialsError).Field})
+			return
+		}
+
+		log.Info("Connect Handler Got: ssid:|%s| hidden:|%t| sae:|%t|", creds.Ssid, creds.Hidden, creds.Sae)
+
+		connection, err := connect(creds)
+		if err != nil {
+			writeError(log, w, http.StatusServiceUnavailable, err, nil)
+			return
+		}
+
+		// a wrong passphrase or a network that never associates
+		if connection.State != "COMPLETED" {
+			writeError(log, w, http.StatusUnprocessableEntity, errors.New(connection.Message), connection)
+			return
+		}
+
+		apiPayloadReturn(w, "Connection", connection)
+	}
+}
+
+// listenSocket listens on the unix socket at path, replacing a stale
+// one. Requests over the socket are not limited, so only its owner may
+// connect.
+func listenSocket(path string) (net.Listener, error) {
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// routeHandler serves route, rejecting requests that do not match the
+// OpenAPI document. Routes that change device state are wrapped by
+// guarded, outside the validation so invalid requests are limited too.
+func routeHandler(log bunyan.Logger, spec map[string]interface{}, route apiRoute, strict bool, guarded func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
+	handler := validatedHandler(log, spec, route, strict, route.handler)
+	if route.limited {
+		handler = guarded(handler)
+	}
+
+	return handler
+}
+
+// validatedHandler rejects requests that do not match the OpenAPI
+// document. Legacy aliases take any method, which is validated as the
+// route's first method, and unknown fields as they always did.
+func validatedHandler(log bunyan.Logger, spec map[string]interface{}, route apiRoute, strict bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := route.methods[0]
+		for _, m := range route.methods {
+			if m == r.Method {
+				method = m
+			}
+		}
+
+		details, err := validateRequest(spec, route.path, method, strict, r)
+		if err != nil {
+			writeError(log, w, http.StatusBadRequest, err, details)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// limitedHandler applies a limiter to an api route that changes device
+// state. Requests answered with a 4xx or 5xx count as failed, requests
+// over the unix socket are not limited.
+func limitedHandler(limiter *iotwifi.Limiter, metrics *iotwifi.Metrics, next http.HandlerFunc) http.HandlerFunc {
+	if limiter.LimitCfg.Disabled {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, local := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); local {
+			next(w, r)
+			return
+		}
+
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			client = host
+		}
+
+		wait, err := limiter.Acquire(client)
+		if err != nil {
+			retry := int(math.Ceil(wait.Seconds()))
+			metrics.Add("iotwifi_http_limited_total", 1, "reason", limitReason(err))
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			writeError(limiter.Log, w, http.StatusTooManyRequests, err, map[string]int{"retry_after": retry})
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r)
+		limiter.Release(client, sw.status >= http.StatusBadRequest)
+	}
+}
+
+// apWpsStatus returns the HTTP status for an AP WPS error.
+func apWpsStatus(err error) int {
+	if err == iotwifi.ErrApWpsDisabled || err == iotwifi.ErrApDown {
+		return http.StatusConflict
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+// limitReason names a limiter error for metrics.
+func limitReason(err error) string {
+	switch err {
+	case iotwifi.ErrLockedOut:
+		return "locked_out"
+	case iotwifi.ErrBusy:
+		return "busy"
+	}
+
+	return "rate"
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
 
+// WriteHeader records the status code before writing it.
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
 }
 
 // getEnv gets an environment variable or sets a default if
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/cjimti/iotwifi/iotwifi"
+)
+
+// testLogger returns a logger that discards its output.
+func testLogger(t *testing.T) bunyan.Logger {
+	log, err := bunyan.CreateLogger(bunyan.Config{
+		Name:   "iotwifi-test",
+		Stream: ioutil.Discard,
+		Level:  bunyan.LogLevelFatal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return log
+}
+
+// testLimitCfg is the default limit_cfg with rates high enough that
+// only failures matter.
+var testLimitCfg = iotwifi.LimitCfg{
+	ClientRate:       600,
+	ClientBurst:      100,
+	Rate:             600,
+	Burst:            100,
+	ClientConcurrent: 1,
+	Concurrent:       2,
+	MaxFailures:      5,
+	Lockout:          60,
+	MaxLockout:       3600,
+}
+
+// postConnect posts credentials to handler from remote.
+func postConnect(handler http.Handler, remote string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/connect", strings.NewReader(body))
+	req.RemoteAddr = remote
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// decodeError decodes the error of an api return.
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) ApiError {
+	var ret struct {
+		Status string   `json:"status"`
+		Error  ApiError `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+		t.Fatalf("decoding %q: %s", rec.Body.String(), err)
+	}
+	if ret.Status != "FAIL" {
+		t.Fatalf("status = %q, want FAIL", ret.Status)
+	}
+
+	return ret.Error
+}
+
+func TestConnectFailure(t *testing.T) {
+	log := testLogger(t)
+
+	for _, tc := range []struct {
+		name       string
+		connection iotwifi.WpaConnection
+		status     int
+		code       string
+	}{
+		{"completed", iotwifi.WpaConnection{Ssid: "home", State: "COMPLETED"}, http.StatusOK, ""},
+		{"failed", iotwifi.WpaConnection{State: "FAIL", Message: "Unable to connect to home"}, http.StatusUnprocessableEntity, "connect_failed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			connect := func(creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+				return tc.connection, nil
+			}
+
+			rec := postConnect(connectHandler(log, connect), "192.0.2.1:4000", `{"ssid":"home","psk":"wrongpassword"}`)
+			if rec.Code != tc.status {
+				t.Fatalf("code = %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			if tc.code != "" {
+				if apiErr := decodeError(t, rec); apiErr.Code != tc.code {
+					t.Errorf("error code = %q, want %q", apiErr.Code, tc.code)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectLockout(t *testing.T) {
+	log := testLogger(t)
+
+	attempts := 0
+	connect := func(creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+		attempts++
+		return iotwifi.WpaConnection{State: "FAIL", Message: "Unable to connect to " + creds.Ssid}, nil
+	}
+
+	var lockouts []iotwifi.Lockout
+	events := iotwifi.NewEventBus(log)
+	events.Subscribe(func(event iotwifi.Event) {
+		if lockout, ok := event.Payload.(iotwifi.Lockout); ok {
+			lockouts = append(lockouts, lockout)
+		}
+	})
+
+	limiter := iotwifi.NewLimiter(log, testLimitCfg, events)
+	handler := limitedHandler(limiter, iotwifi.NewMetrics(), connectHandler(log, connect))
+
+	// wrong passphrases up to max_failures are tried
+	for i := 0; i < testLimitCfg.MaxFailures; i++ {
+		rec := postConnect(handler, "192.0.2.1:4000", `{"ssid":"home","psk":"guess000`+strconv.Itoa(i)+`"}`)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("attempt %d: code = %d, want 422", i+1, rec.Code)
+		}
+	}
+
+	rec := postConnect(handler, "192.0.2.1:4001", `{"ssid":"home","psk":"guess0009"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("after %d failures code = %d, want 429", testLimitCfg.MaxFailures, rec.Code)
+	}
+	if apiErr := decodeError(t, rec); apiErr.Message != iotwifi.ErrLockedOut.Error() {
+		t.Errorf("error = %q, want %q", apiErr.Message, iotwifi.ErrLockedOut.Error())
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Retry-After = %q, want 60", retry)
+	}
+
+	if attempts != testLimitCfg.MaxFailures {
+		t.Errorf("locked out client reached connect, %d attempts", attempts)
+	}
+	if len(lockouts) != 1 || lockouts[0].Client != "192.0.2.1" {
+		t.Errorf("lockout events = %+v", lockouts)
+	}
+
+	// other clients are not locked out
+	rec = postConnect(handler, "192.0.2.2:4000", `{"ssid":"home","psk":"guess0010"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("other client code = %d, want 422", rec.Code)
+	}
+}
+
+func TestConnectSuccessClearsFailures(t *testing.T) {
+	log := testLogger(t)
+
+	state := "FAIL"
+	connect := func(creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+		return iotwifi.WpaConnection{Ssid: creds.Ssid, State: state}, nil
+	}
+
+	limiter := iotwifi.NewLimiter(log, testLimitCfg, iotwifi.NewEventBus(log))
+	handler := limitedHandler(limiter, iotwifi.NewMetrics(), connectHandler(log, connect))
+
+	for round := 0; round < 3; round++ {
+		state = "FAIL"
+		for i := 0; i < testLimitCfg.MaxFailures-1; i++ {
+			postConnect(handler, "192.0.2.1:4000", `{"ssid":"home","psk":"wrongpassword"}`)
+		}
+
+		state = "COMPLETED"
+		if rec := postConnect(handler, "192.0.2.1:4000", `{"ssid":"home","psk":"rightpassword"}`); rec.Code != http.StatusOK {
+			t.Fatalf("round %d: code = %d, want 200", round, rec.Code)
+		}
+	}
+}
+
+func TestInvalidRequestsLimited(t *testing.T) {
+	log := testLogger(t)
+
+	attempts := 0
+	connect := func(creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+		attempts++
+		return iotwifi.WpaConnection{Ssid: creds.Ssid, State: "COMPLETED"}, nil
+	}
+
+	limiter := iotwifi.NewLimiter(log, testLimitCfg, iotwifi.NewEventBus(log))
+	guarded := func(next http.HandlerFunc) http.HandlerFunc {
+		return limitedHandler(limiter, iotwifi.NewMetrics(), next)
+	}
+
+	route := testRoutes[0]
+	route.limited = true
+	route.handler = connectHandler(log, connect)
+	handler := routeHandler(log, openApiSpec(testRoutes), route, true, guarded)
+
+	// requests failing validation count as failures
+	for i := 0; i < testLimitCfg.MaxFailures; i++ {
+		rec := postConnect(handler, "192.0.2.1:4000", `{"psk":"mystrongpassword"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("attempt %d: code = %d, want 400", i+1, rec.Code)
+		}
+	}
+
+	rec := postConnect(handler, "192.0.2.1:4000", `{"ssid":"home","psk":"mystrongpassword"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("after %d invalid requests code = %d, want 429", testLimitCfg.MaxFailures, rec.Code)
+	}
+	if attempts != 0 {
+		t.Errorf("locked out client reached connect, %d attempts", attempts)
+	}
+
+	// routes that do not change device state are not limited
+	route.limited = false
+	handler = routeHandler(log, openApiSpec(testRoutes), route, true, guarded)
+	if rec := postConnect(handler, "192.0.2.1:4000", `{"ssid":"home","psk":"mystrongpassword"}`); rec.Code != http.StatusOK {
+		t.Errorf("unlimited route code = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiRoute describes an API route. The route table drives both the
+// router and the OpenAPI document, and the document drives request
+// validation, so the three can not drift apart.
+type apiRoute struct {
+	path          string
+	methods       []string
+	legacy        bool // also served at path without /v1, deprecated
+	legacyMethods []string
+	summary       string
+	params        []apiParam
+	body          interface{} // request body type, nil for none
+	bodyOptional  bool        // an empty request body is accepted
+	required      []string    // required request body fields
+	payload       interface{} // response payload type, nil for none
+	text          bool        // response is plain text, not an ApiReturn
+	limited       bool        // changes device state, rate limited and audited
+	handler       http.HandlerFunc
+}
+
+// apiParam describes a query parameter.
+type apiParam struct {
+	name        string
+	schema      map[string]interface{}
+	description string
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// openApiSpec builds an OpenAPI 3 document for the v1 routes, deriving
+// schemas from the Go types the handlers encode and decode.
+func openApiSpec(routes []apiRoute) map[string]interface{} {
+	components := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	errorResponse := map[string]interface{}{
+		"description": "Failure, with a 4xx or 5xx status and an error object.",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": typeSchema(reflect.TypeOf(ApiReturn{}), components),
+			},
+		},
+	}
+
+	for _, route := range routes {
+		operation := map[string]interface{}{
+			"summary":   route.summary,
+			"responses": map[string]interface{}{"default": errorResponse},
+		}
+
+		if len(route.params) > 0 {
+			params := []interface{}{}
+			for _, param := range route.params {
+				params = append(params, map[string]interface{}{
+					"name":        param.name,
+					"in":          "query",
+					"description": param.description,
+					"schema":      param.schema,
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if route.body != nil {
+			schema := structSchema(reflect.TypeOf(route.body), components)
+			if len(route.required) > 0 {
+				schema["required"] = route.required
+			}
+
+			operation["requestBody"] = map[string]interface{}{
+				"required": !route.bodyOptional,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schema},
+				},
+			}
+		}
+
+		ok := map[string]interface{}{"description": "Success."}
+		if route.text {
+			ok["content"] = map[string]interface{}{
+				"text/plain": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				},
+			}
+		} else {
+			schema := structSchema(reflect.TypeOf(ApiReturn{}), components)
+			properties := schema["properties"].(map[string]interface{})
+			properties["payload"] = map[string]interface{}{}
+			if route.payload != nil {
+				properties["payload"] = typeSchema(reflect.TypeOf(route.payload), components)
+			}
+			delete(properties, "error")
+
+			ok["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schema},
+			}
+		}
+		operation["responses"].(map[string]interface{})["200"] = ok
+
+		// a path may be split over routes by method
+		item, exists := paths["/v1"+route.path].(map[string]interface{})
+		if !exists {
+			item = map[string]interface{}{}
+			paths["/v1"+route.path] = item
+		}
+		for _, method := range route.methods {
+			item[strings.ToLower(method)] = operation
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "IOT Wifi",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": components},
+	}
+}
+
+// typeSchema returns the schema for a Go type, adding named structs to
+// components and referring to them.
+func typeSchema(t reflect.Type, components map[string]interface{}) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == rawType {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), components)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem(), components),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem(), components),
+		}
+	case reflect.Struct:
+		if _, ok := components[t.Name()]; !ok {
+			// placeholder so recursive types terminate
+			components[t.Name()] = map[string]interface{}{}
+			components[t.Name()] = structSchema(t, components)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	// interface{} and anything else may hold any value
+	return map[string]interface{}{}
+}
+
+// structSchema returns the inline object schema for a struct type.
+func structSchema(t reflect.Type, components map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+
+		properties[name] = typeSchema(field.Type, components)
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// validateRequest checks the query parameters and JSON body of a request
+// against the route's operation for method in the OpenAPI document. The
+// body is restored for the handler. Unless strict, as for the legacy
+// aliases, fields the document does not know are ignored. The returned
+// details name the failing parameter or field.
+func validateRequest(spec map[string]interface{}, path string, method string, strict bool, r *http.Request) (interface{}, error) {
+	item, ok := spec["paths"].(map[string]interface{})["/v1"+path].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	operation, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		return nil, errors.New(method + " is not documented for /v1" + path)
+	}
+	components := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	if params, ok := operation["parameters"].([]interface{}); ok {
+		query := r.URL.Query()
+		for _, p := range params {
+			param := p.(map[string]interface{})
+			name := param["name"].(string)
+			s := query.Get(name)
+			if s == "" {
+				continue
+			}
+
+			if err := validateParam(param["schema"].(map[string]interface{}), s); err != nil {
+				return map[string]string{"param": name}, fmt.Errorf("query parameter %s %s", name, err.Error())
+			}
+		}
+	}
+
+	requestBody, ok := operation["requestBody"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	schema := requestBody["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		if requestBody["required"] == false {
+			return nil, nil
+		}
+		return nil, errors.New("request body is empty")
+	}
+
+	var body interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, errors.New("request body is not valid JSON: " + err.Error())
+	}
+
+	if field, err := validateValue(schema, components, body, "", strict); err != nil {
+		return map[string]string{"field": field}, err
+	}
+
+	return nil, nil
+}
+
+// validateParam checks a query parameter value against its schema.
+func validateParam(schema map[string]interface{}, s string) error {
+	switch {
+	case schema["format"] == "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return errors.New("must be an RFC 3339 time")
+		}
+	case schema["type"] == "integer":
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		if min, ok := schema["minimum"].(int); ok && n < min {
+			return fmt.Errorf("must be at least %d", min)
+		}
+	}
+
+	return nil
+}
+
+// validateValue checks a decoded JSON value against a schema and returns
+// the path of the failing field. Unknown fields are only rejected when
+// strict.
+func validateValue(schema map[string]interface{}, components map[string]interface{}, v interface{}, path string, strict bool) (string, error) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = components[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+	}
+
+	field := path
+	if field == "" {
+		field = "body"
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return field, errors.New(field + " must be an object")
+		}
+
+		if required, ok := schema["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := object[name]; !ok {
+					return joinField(path, name), errors.New(joinField(path, name) + " is required")
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			propSchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+					propSchema = additional
+				} else if schema["additionalProperties"] == false && strict {
+					return joinField(path, name), errors.New(joinField(path, name) + " is not a known field")
+				} else {
+					continue
+				}
+			}
+
+			if failed, err := validateValue(propSchema, components, object[name], joinField(path, name), strict); err != nil {
+				return failed, err
+			}
+		}
+	case "array":
+		array, ok := v.([]interface{})
+		if !ok {
+			return field, errors.New(field + " must be an array")
+		}
+
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			if failed, err := validateValue(items, components, item, path+"["+strconv.Itoa(i)+"]", strict); err != nil {
+				return failed, err
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return field, errors.New(field + " must be a string")
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return field, errors.New(field + " must be an RFC 3339 time")
+			}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return field, errors.New(field + " must be an integer")
+		}
+		if _, err := n.Int64(); err != nil {
+			return field, errors.New(field + " must be an integer")
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return field, errors.New(field + " must be a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return field, errors.New(field + " must be a boolean")
+		}
+	}
+
+	return "", nil
+}
+
+// joinField appends a field name to a dotted field path.
+func joinField(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cjimti/iotwifi/iotwifi"
+)
+
+// testRoutes is a route table shaped like the served one.
+var testRoutes = []apiRoute{
+	{
+		path:     "/connect",
+		methods:  []string{"POST"},
+		body:     iotwifi.WpaCredentials{},
+		required: []string{"ssid"},
+		payload:  iotwifi.WpaConnection{},
+		legacy:   true,
+	},
+	{
+		path:    "/journal",
+		methods: []string{"GET"},
+		params: []apiParam{
+			{"limit", map[string]interface{}{"type": "integer", "minimum": 1}, ""},
+			{"since", map[string]interface{}{"type": "string", "format": "date-time"}, ""},
+		},
+	},
+}
+
+func TestValidateRequest(t *testing.T) {
+	spec := openApiSpec(testRoutes)
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		method  string
+		strict  bool
+		target  string
+		body    string
+		details interface{}
+		fails   bool
+	}{
+		{"valid body", "/connect", "POST", true, "/v1/connect", `{"ssid":"home","psk":"password1"}`, nil, false},
+		{"empty body", "/connect", "POST", true, "/v1/connect", ``, nil, true},
+		{"missing field", "/connect", "POST", true, "/v1/connect", `{"psk":"password1"}`, map[string]string{"field": "ssid"}, true},
+		{"wrong type", "/connect", "POST", true, "/v1/connect", `{"ssid":"home","hidden":"yes"}`, map[string]string{"field": "hidden"}, true},
+		{"unknown field", "/connect", "POST", true, "/v1/connect", `{"ssid":"home","extra":1}`, map[string]string{"field": "extra"}, true},
+		{"legacy unknown field", "/connect", "POST", false, "/connect", `{"ssid":"home","extra":1}`, nil, false},
+		{"legacy wrong type", "/connect", "POST", false, "/connect", `{"ssid":"home","hidden":"yes"}`, map[string]string{"field": "hidden"}, true},
+		{"undocumented method", "/connect", "GET", true, "/v1/connect", `{"ssid":"home"}`, nil, true},
+		{"valid params", "/journal", "GET", true, "/v1/journal?limit=5&since=2026-10-19T00:00:00Z", ``, nil, false},
+		{"bad integer", "/journal", "GET", true, "/v1/journal?limit=x", ``, map[string]string{"param": "limit"}, true},
+		{"below minimum", "/journal", "GET", true, "/v1/journal?limit=0", ``, map[string]string{"param": "limit"}, true},
+		{"bad time", "/journal", "GET", true, "/v1/journal?since=yesterday", ``, map[string]string{"param": "since"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+
+			details, err := validateRequest(spec, tc.path, tc.method, tc.strict, r)
+			if (err != nil) != tc.fails {
+				t.Fatalf("err = %v, want failure %t", err, tc.fails)
+			}
+			if !reflect.DeepEqual(details, tc.details) {
+				t.Errorf("details = %#v, want %#v", details, tc.details)
+			}
+
+			// the body is left for the handler
+			if body, _ := ioutil.ReadAll(r.Body); tc.body != "" && string(body) != tc.body {
+				t.Errorf("body = %q, want %q", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestOpenApiSpecPaths(t *testing.T) {
+	spec := openApiSpec(testRoutes)
+	paths := spec["paths"].(map[string]interface{})
+
+	connect, ok := paths["/v1/connect"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no /v1/connect in %v", paths)
+	}
+	if _, ok := connect["post"]; !ok {
+		t.Error("/v1/connect has no post operation")
+	}
+	if _, ok := connect["get"]; ok {
+		t.Error("/v1/connect has an undeclared get operation")
+	}
+
+	if _, ok := paths["/connect"]; ok {
+		t.Error("legacy alias is documented")
+	}
+
+	operation := connect["post"].(map[string]interface{})
+	responses := operation["responses"].(map[string]interface{})
+	for _, status := range []string{"200", "default"} {
+		if _, ok := responses[status]; !ok {
+			t.Errorf("no %s response", status)
+		}
+	}
+
+	if _, ok := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})["WpaConnection"]; !ok {
+		t.Error("payload type is not a component")
+	}
+}